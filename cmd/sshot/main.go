@@ -24,14 +24,19 @@ func main() {
 	version := flag.Bool("version", false, "Show version information")
 	dryRun := flag.Bool("dry-run", false, "Run in dry-run mode (don't execute commands)")
 	dryRunShort := flag.Bool("n", false, "Run in dry-run mode (shorthand)")
+	check := flag.Bool("check", false, "Connect and report what would change without making changes")
+	diff := flag.Bool("diff", false, "Show a diff of file changes made by copy and template tasks")
 	verbose := flag.Bool("verbose", false, "Enable verbose logging")
 	verboseShort := flag.Bool("v", false, "Enable verbose logging (shorthand)")
 	progress := flag.Bool("progress", false, "Show progress indicators for long-running tasks")
 	noColor := flag.Bool("no-color", false, "Disable colored output")
 	fullOutput := flag.Bool("full-output", false, "Show complete command output without truncation")
 	fullOutputShort := flag.Bool("f", false, "Show complete command output (shorthand)")
+	noStrictVars := flag.Bool("no-strict-vars", false, "Render undefined template variables as <no value> instead of failing")
+	deadline := flag.Duration("deadline", 0, "Fail the hosts still running after this duration (e.g. 30m), killing their commands")
 	inventory := flag.String("inventory", "", "Path to inventory file (if separate from playbook)")
 	inventoryShort := flag.String("i", "", "Path to inventory file (shorthand)")
+	sshConfig := flag.String("ssh-config", "", "Path to an OpenSSH client config file (default: ~/.ssh/config)")
 
 	flag.Parse()
 
@@ -44,10 +49,15 @@ func main() {
 	}
 
 	execOptions.DryRun = *dryRun || *dryRunShort
+	execOptions.Check = *check
+	execOptions.Diff = *diff
 	execOptions.Verbose = *verbose || *verboseShort
 	execOptions.Progress = *progress
 	execOptions.NoColor = *noColor
 	execOptions.FullOutput = *fullOutput || *fullOutputShort
+	execOptions.NoStrictVars = *noStrictVars
+	execOptions.Deadline = *deadline
+	execOptions.SSHConfigFile = *sshConfig
 
 	// Use inventory flag (prefer long form over short form)
 	if *inventory != "" {
@@ -75,14 +85,23 @@ func main() {
 		}
 	}
 
+	if execOptions.SSHConfigFile != "" {
+		if _, err := os.Stat(execOptions.SSHConfigFile); os.IsNotExist(err) {
+			log.Fatalf("SSH config file not found: %s", execOptions.SSHConfigFile)
+		}
+	}
+
 	if execOptions.Verbose {
 		log.Printf("[VERBOSE] Starting sshot")
 		log.Printf("[VERBOSE] Playbook path: %s", playbookPath)
 		if execOptions.InventoryFile != "" {
 			log.Printf("[VERBOSE] Inventory path: %s", execOptions.InventoryFile)
 		}
-		log.Printf("[VERBOSE] Options: dry-run=%v, verbose=%v, progress=%v, no-color=%v, full-output=%v",
-			execOptions.DryRun, execOptions.Verbose, execOptions.Progress, execOptions.NoColor, execOptions.FullOutput)
+		if execOptions.SSHConfigFile != "" {
+			log.Printf("[VERBOSE] SSH config path: %s", execOptions.SSHConfigFile)
+		}
+		log.Printf("[VERBOSE] Options: dry-run=%v, check=%v, diff=%v, verbose=%v, progress=%v, no-color=%v, full-output=%v, no-strict-vars=%v, deadline=%s",
+			execOptions.DryRun, execOptions.Check, execOptions.Diff, execOptions.Verbose, execOptions.Progress, execOptions.NoColor, execOptions.FullOutput, execOptions.NoStrictVars, execOptions.Deadline)
 	}
 
 	if err := playbook.Run(playbookPath, &execOptions); err != nil {
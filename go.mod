@@ -5,8 +5,12 @@ go 1.24.0
 toolchain go1.24.8
 
 require (
+	github.com/pkg/sftp v1.13.10
 	golang.org/x/crypto v0.43.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.37.0 // indirect
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+)
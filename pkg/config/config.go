@@ -33,10 +33,13 @@ func unmarshalPlaybook(data []byte) (*types.Playbook, error) {
 	}
 
 	return &types.Playbook{
-		Name:     pbConfig.Name,
-		Parallel: pbConfig.Parallel,
-		Facts:    pbConfig.Facts,
-		Tasks:    pbConfig.Tasks,
+		Name:            pbConfig.Name,
+		Parallel:        pbConfig.Parallel,
+		StrictVars:      pbConfig.StrictVars,
+		Environment:     pbConfig.Environment,
+		Facts:           pbConfig.Facts,
+		TaskConcurrency: pbConfig.TaskConcurrency,
+		Tasks:           pbConfig.Tasks,
 	}, nil
 }
 
@@ -93,28 +96,65 @@ func loadCombinedFile(playbookPath string) (*types.Config, error) {
 	return &config, nil
 }
 
-func ApplySSHDefaults(config *types.Config) {
-	// Apply defaults to direct hosts
-	for i := range config.Inventory.Hosts {
+// ApplySSHDefaults completes the connection settings of every host with the
+// inventory ssh_config, then with the OpenSSH client config unless the host
+// opts out with use_ssh_config: false
+func ApplySSHDefaults(config *types.Config) error {
+	// The OpenSSH config is only read once a host uses it
+	var sshCfg *sshConfig
+	openSSHConfig := func() (*sshConfig, error) {
+		if sshCfg != nil {
+			return sshCfg, nil
+		}
+		cfg, err := loadSSHConfig(types.ExecOptions.SSHConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ssh config: %w", err)
+		}
+		sshCfg = cfg
+		return sshCfg, nil
+	}
+
+	applyToHost := func(host *types.Host) error {
 		if config.Inventory.SSHConfig != nil {
-			applySSHDefaultsToHost(&config.Inventory.Hosts[i], config.Inventory.SSHConfig)
+			applySSHDefaultsToHost(host, config.Inventory.SSHConfig)
 		} else {
 			// No ssh_config, just ensure secure defaults
-			ensureSecureDefaults(&config.Inventory.Hosts[i])
+			ensureSecureDefaults(host)
+		}
+
+		switch host.HostKeyPolicy {
+		case "", types.HostKeyPolicyStrict, types.HostKeyPolicyAcceptNew, types.HostKeyPolicyOff:
+		default:
+			return fmt.Errorf("invalid host_key_policy '%s' for host '%s' (expected strict, accept-new or off)", host.HostKeyPolicy, host.Name)
+		}
+
+		if host.UseSSHConfig != nil && !*host.UseSSHConfig {
+			return resolveJumps(host, nil)
+		}
+		cfg, err := openSSHConfig()
+		if err != nil {
+			return err
+		}
+		applySSHConfigToHost(host, cfg)
+		return resolveJumps(host, cfg)
+	}
+
+	// Apply defaults to direct hosts
+	for i := range config.Inventory.Hosts {
+		if err := applyToHost(&config.Inventory.Hosts[i]); err != nil {
+			return err
 		}
 	}
 
 	// Apply defaults to group hosts
 	for i := range config.Inventory.Groups {
 		for j := range config.Inventory.Groups[i].Hosts {
-			if config.Inventory.SSHConfig != nil {
-				applySSHDefaultsToHost(&config.Inventory.Groups[i].Hosts[j], config.Inventory.SSHConfig)
-			} else {
-				// No ssh_config, just ensure secure defaults
-				ensureSecureDefaults(&config.Inventory.Groups[i].Hosts[j])
+			if err := applyToHost(&config.Inventory.Groups[i].Hosts[j]); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
 func ensureSecureDefaults(host *types.Host) {
@@ -163,6 +203,35 @@ func applySSHDefaultsToHost(host *types.Host, defaults *types.SSHConfig) {
 	if host.Port == 0 && defaults.Port != 0 {
 		host.Port = defaults.Port
 	}
+	if host.RemoteTmp == "" && defaults.RemoteTmp != "" {
+		host.RemoteTmp = defaults.RemoteTmp
+	}
+	if host.KeepaliveInterval == 0 && defaults.KeepaliveInterval != 0 {
+		host.KeepaliveInterval = defaults.KeepaliveInterval
+	}
+	if host.KeepaliveCountMax == 0 && defaults.KeepaliveCountMax != 0 {
+		host.KeepaliveCountMax = defaults.KeepaliveCountMax
+	}
+	if host.ConnectTimeout == 0 && defaults.ConnectTimeout != 0 {
+		host.ConnectTimeout = defaults.ConnectTimeout
+	}
+	if host.ConnectRetries == 0 && defaults.ConnectRetries != 0 {
+		host.ConnectRetries = defaults.ConnectRetries
+	}
+	if host.ConnectRetryDelay == 0 && defaults.ConnectRetryDelay != 0 {
+		host.ConnectRetryDelay = defaults.ConnectRetryDelay
+	}
+	if host.UseSSHConfig == nil && defaults.UseSSHConfig != nil {
+		host.UseSSHConfig = defaults.UseSSHConfig
+	}
+	if len(host.KnownHostsFile) == 0 && len(defaults.KnownHostsFile) > 0 {
+		host.KnownHostsFile = defaults.KnownHostsFile
+	}
+	// A host setting its own strict_host_key_check keeps it over the default
+	// host_key_policy
+	if host.HostKeyPolicy == "" && host.StrictHostKeyCheck == nil {
+		host.HostKeyPolicy = defaults.HostKeyPolicy
+	}
 
 	// Apply strict host key check logic
 	// Host-level setting takes precedence if explicitly set
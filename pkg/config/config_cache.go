@@ -28,3 +28,27 @@ func (c *cache) Get() (*types.Config, bool) {
 	defer c.RUnlock()
 	return c.config, c.config != nil
 }
+
+// Host retrieves an inventory host by name, whether it is listed directly or
+// in a group
+func (c *cache) Host(name string) (types.Host, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.config == nil {
+		return types.Host{}, false
+	}
+
+	for _, host := range c.config.Inventory.Hosts {
+		if host.Name == name {
+			return host, true
+		}
+	}
+	for _, group := range c.config.Inventory.Groups {
+		for _, host := range group.Hosts {
+			if host.Name == name {
+				return host, true
+			}
+		}
+	}
+	return types.Host{}, false
+}
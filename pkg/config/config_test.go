@@ -2,6 +2,8 @@ package config
 
 import (
 	"github.com/fgouteroux/sshot/pkg/types"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -50,7 +52,43 @@ playbook:
 	}
 }
 
+func TestUnmarshalPlaybook(t *testing.T) {
+	data := `
+name: Deploy
+strict_vars: false
+environment:
+  LANG: C.UTF-8
+  APP_ENV: production
+tasks:
+  - name: Migrate
+    command: ./migrate
+    chdir: /srv/app
+    umask: "0027"
+    environment:
+      APP_ENV: staging
+`
+	playbook, err := unmarshalPlaybook([]byte(data))
+	if err != nil {
+		t.Fatalf("unmarshalPlaybook() error = %v", err)
+	}
+
+	if playbook.StrictVars == nil || *playbook.StrictVars {
+		t.Errorf("StrictVars = %v, want false", types.FormatBoolPtr(playbook.StrictVars))
+	}
+	if playbook.Environment["LANG"] != "C.UTF-8" || playbook.Environment["APP_ENV"] != "production" {
+		t.Errorf("Environment = %v", playbook.Environment)
+	}
+
+	task := playbook.Tasks[0]
+	if task.Chdir != "/srv/app" || task.Umask != "0027" || task.Environment["APP_ENV"] != "staging" {
+		t.Errorf("task = %+v", task)
+	}
+}
+
 func TestApplySSHDefaults(t *testing.T) {
+	// No OpenSSH config is read from the user's home
+	t.Setenv("HOME", t.TempDir())
+
 	tests := []struct {
 		name     string
 		config   types.Config
@@ -278,7 +316,9 @@ func TestApplySSHDefaults(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ApplySSHDefaults(&tt.config)
+			if err := ApplySSHDefaults(&tt.config); err != nil {
+				t.Fatalf("ApplySSHDefaults() error = %v", err)
+			}
 
 			// Compare hosts
 			if len(tt.config.Inventory.Hosts) != len(tt.expected.Inventory.Hosts) {
@@ -382,6 +422,96 @@ func TestApplySSHDefaultsToHost(t *testing.T) {
 				StrictHostKeyCheck: types.BoolPtr(true),
 			},
 		},
+		{
+			name: "apply remote tmp default",
+			host: types.Host{
+				Name: "web1",
+			},
+			defaults: types.SSHConfig{
+				RemoteTmp: "/var/tmp",
+			},
+			expected: types.Host{
+				Name:               "web1",
+				RemoteTmp:          "/var/tmp",
+				StrictHostKeyCheck: types.BoolPtr(true),
+			},
+		},
+		{
+			name: "preserve host remote tmp",
+			host: types.Host{
+				Name:      "web1",
+				RemoteTmp: "~/.sshot/tmp",
+			},
+			defaults: types.SSHConfig{
+				RemoteTmp: "/var/tmp",
+			},
+			expected: types.Host{
+				Name:               "web1",
+				RemoteTmp:          "~/.sshot/tmp",
+				StrictHostKeyCheck: types.BoolPtr(true),
+			},
+		},
+		{
+			name: "apply keepalive defaults",
+			host: types.Host{
+				Name:              "web1",
+				KeepaliveInterval: 10,
+			},
+			defaults: types.SSHConfig{
+				KeepaliveInterval: 60,
+				KeepaliveCountMax: 5,
+			},
+			expected: types.Host{
+				Name:               "web1",
+				KeepaliveInterval:  10,
+				KeepaliveCountMax:  5,
+				StrictHostKeyCheck: types.BoolPtr(true),
+			},
+		},
+		{
+			name: "apply connect defaults",
+			host: types.Host{
+				Name:           "web1",
+				ConnectRetries: 1,
+			},
+			defaults: types.SSHConfig{
+				ConnectTimeout:    30,
+				ConnectRetries:    5,
+				ConnectRetryDelay: 10,
+			},
+			expected: types.Host{
+				Name:               "web1",
+				ConnectTimeout:     30,
+				ConnectRetries:     1,
+				ConnectRetryDelay:  10,
+				StrictHostKeyCheck: types.BoolPtr(true),
+			},
+		},
+		{
+			name: "known hosts defaults",
+			host: types.Host{Name: "web1"},
+			defaults: types.SSHConfig{
+				KnownHostsFile: types.StringList{"~/.ssh/known_hosts", "/etc/ssh/ssh_known_hosts"},
+				HostKeyPolicy:  types.HostKeyPolicyAcceptNew,
+			},
+			expected: types.Host{
+				Name:               "web1",
+				KnownHostsFile:     types.StringList{"~/.ssh/known_hosts", "/etc/ssh/ssh_known_hosts"},
+				HostKeyPolicy:      types.HostKeyPolicyAcceptNew,
+				StrictHostKeyCheck: types.BoolPtr(true),
+			},
+		},
+		{
+			name: "host strict_host_key_check keeps over default host_key_policy",
+			host: types.Host{Name: "web1", StrictHostKeyCheck: types.BoolPtr(false)},
+			defaults: types.SSHConfig{
+				HostKeyPolicy: types.HostKeyPolicyAcceptNew,
+			},
+			expected: types.Host{
+				Name:               "web1",
+				StrictHostKeyCheck: types.BoolPtr(false),
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -394,10 +524,36 @@ func TestApplySSHDefaultsToHost(t *testing.T) {
 			if tt.host.User != tt.expected.User {
 				t.Errorf("User = %q, want %q", tt.host.User, tt.expected.User)
 			}
+			if tt.host.RemoteTmp != tt.expected.RemoteTmp {
+				t.Errorf("RemoteTmp = %q, want %q", tt.host.RemoteTmp, tt.expected.RemoteTmp)
+			}
+			if tt.host.KeepaliveInterval != tt.expected.KeepaliveInterval || tt.host.KeepaliveCountMax != tt.expected.KeepaliveCountMax {
+				t.Errorf("Keepalive = %d/%d, want %d/%d", tt.host.KeepaliveInterval, tt.host.KeepaliveCountMax, tt.expected.KeepaliveInterval, tt.expected.KeepaliveCountMax)
+			}
+			if tt.host.ConnectTimeout != tt.expected.ConnectTimeout || tt.host.ConnectRetries != tt.expected.ConnectRetries || tt.host.ConnectRetryDelay != tt.expected.ConnectRetryDelay {
+				t.Errorf("Connect = %d/%d/%d, want %d/%d/%d", tt.host.ConnectTimeout, tt.host.ConnectRetries, tt.host.ConnectRetryDelay, tt.expected.ConnectTimeout, tt.expected.ConnectRetries, tt.expected.ConnectRetryDelay)
+			}
 			if !types.CompareBoolPtr(tt.host.StrictHostKeyCheck, tt.expected.StrictHostKeyCheck) {
 				t.Errorf("StrictHostKeyCheck = %v, want %v",
 					types.FormatBoolPtr(tt.host.StrictHostKeyCheck), types.FormatBoolPtr(tt.expected.StrictHostKeyCheck))
 			}
+			if !reflect.DeepEqual(tt.host.KnownHostsFile, tt.expected.KnownHostsFile) || tt.host.HostKeyPolicy != tt.expected.HostKeyPolicy {
+				t.Errorf("Host keys = %v/%q, want %v/%q", tt.host.KnownHostsFile, tt.host.HostKeyPolicy, tt.expected.KnownHostsFile, tt.expected.HostKeyPolicy)
+			}
 		})
 	}
 }
+
+func TestApplySSHDefaults_InvalidHostKeyPolicy(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := &types.Config{
+		Inventory: types.Inventory{
+			Hosts: []types.Host{{Name: "web1", HostKeyPolicy: "ask"}},
+		},
+	}
+	err := ApplySSHDefaults(cfg)
+	if err == nil || !strings.Contains(err.Error(), "invalid host_key_policy 'ask' for host 'web1'") {
+		t.Errorf("ApplySSHDefaults() error = %v, want an invalid host_key_policy", err)
+	}
+}
@@ -0,0 +1,477 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// maxSSHConfigDepth limits nested Include directives, as OpenSSH does
+const maxSSHConfigDepth = 16
+
+// sshConfig is a parsed OpenSSH client config: its Host and Match blocks in
+// file order, includes expanded in place
+type sshConfig struct {
+	blocks []*sshConfigBlock
+}
+
+// sshConfigBlock holds the options of a Host or Match block. The options
+// before the first block have no conditions and apply to every host.
+type sshConfigBlock struct {
+	conditions []sshConfigCondition
+	// never is set for Match blocks with criteria sshot does not evaluate
+	never   bool
+	options []sshConfigOption
+}
+
+// sshConfigCondition is a host pattern list a block requires to match, or
+// not to match when negated. Host lines and Match originalhost are matched
+// against the alias, Match host against the host name once resolved.
+type sshConfigCondition struct {
+	patterns []string
+	negate   bool
+	original bool
+}
+
+type sshConfigOption struct {
+	key  string
+	args []string
+}
+
+// loadSSHConfig parses the OpenSSH client config at path, or ~/.ssh/config
+// when path is empty. A missing default file is an empty config.
+func loadSSHConfig(path string) (*sshConfig, error) {
+	explicit := path != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &sshConfig{}, nil
+		}
+		path = filepath.Join(home, ".ssh", "config")
+	}
+
+	cfg := &sshConfig{}
+	if err := cfg.parseFile(path, &sshConfigBlock{}, 0); err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return &sshConfig{}, nil
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseFile appends the blocks of a config file. The options before its first
+// Host or Match line belong to a block with the conditions of outer, so an
+// Include inside a block is conditional.
+func (c *sshConfig) parseFile(path string, outer *sshConfigBlock, depth int) error {
+	if depth > maxSSHConfigDepth {
+		return fmt.Errorf("too many nested includes in '%s'", path)
+	}
+
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	block := outer.inherit()
+	c.blocks = append(c.blocks, block)
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		key, args, err := parseSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			if len(args) == 0 {
+				return fmt.Errorf("%s:%d: Host requires at least one pattern", path, line)
+			}
+			block = &sshConfigBlock{conditions: []sshConfigCondition{{patterns: args, original: true}}}
+			c.blocks = append(c.blocks, block)
+		case "match":
+			if block, err = parseMatch(args); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			c.blocks = append(c.blocks, block)
+		case "include":
+			for _, pattern := range args {
+				matches, err := filepath.Glob(includePath(pattern))
+				if err != nil {
+					return fmt.Errorf("%s:%d: invalid Include '%s': %w", path, line, pattern, err)
+				}
+				for _, match := range matches {
+					if err := c.parseFile(match, block, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			// The options after the Include keep the conditions of the block
+			block = block.inherit()
+			c.blocks = append(c.blocks, block)
+		default:
+			block.options = append(block.options, sshConfigOption{key: key, args: args})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read '%s': %w", path, err)
+	}
+	return nil
+}
+
+// inherit returns an empty block with the same conditions
+func (b *sshConfigBlock) inherit() *sshConfigBlock {
+	return &sshConfigBlock{conditions: b.conditions, never: b.never}
+}
+
+// parseSSHConfigLine splits a line into its lowercased keyword and arguments.
+// The keyword may be followed by spaces or "=", and arguments may be quoted.
+func parseSSHConfigLine(text string) (string, []string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.HasPrefix(text, "#") {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(text, " \t=")
+	if end < 0 {
+		return "", nil, fmt.Errorf("missing argument for '%s'", text)
+	}
+	key := strings.ToLower(text[:end])
+	rest := strings.TrimLeft(text[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return "", nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return key, args, nil
+}
+
+// parseMatch parses the criteria of a Match line. Only all, host and
+// originalhost are evaluated, blocks with other criteria never apply.
+func parseMatch(args []string) (*sshConfigBlock, error) {
+	block := &sshConfigBlock{}
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		switch criterion {
+		case "all":
+			if negate {
+				block.never = true
+			}
+		case "host", "originalhost":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("Match %s requires a pattern list", criterion)
+			}
+			i++
+			block.conditions = append(block.conditions, sshConfigCondition{
+				patterns: strings.Split(args[i], ","),
+				negate:   negate,
+				original: criterion == "originalhost",
+			})
+		case "canonical", "final":
+			block.never = true
+		default:
+			// exec, user, localuser, localnetwork, tagged... take an argument
+			block.never = true
+			i++
+		}
+	}
+	return block, nil
+}
+
+// includePath expands ~ in an Include path. Relative paths are in ~/.ssh, as
+// for the includes of a user config.
+func includePath(pattern string) string {
+	home, _ := os.UserHomeDir()
+	switch {
+	case strings.HasPrefix(pattern, "~/"):
+		return filepath.Join(home, pattern[2:])
+	case filepath.IsAbs(pattern):
+		return pattern
+	}
+	return filepath.Join(home, ".ssh", pattern)
+}
+
+// lookup returns the options applying to a host alias. The first value of an
+// option wins, except IdentityFile which accumulates.
+func (c *sshConfig) lookup(alias string) map[string][]string {
+	options := make(map[string][]string)
+	hostname := alias
+	for _, block := range c.blocks {
+		if !block.matches(alias, hostname) {
+			continue
+		}
+		for _, option := range block.options {
+			if option.key == "identityfile" {
+				options[option.key] = append(options[option.key], option.args...)
+				continue
+			}
+			if _, ok := options[option.key]; ok || len(option.args) == 0 {
+				continue
+			}
+			options[option.key] = option.args
+			if option.key == "hostname" {
+				hostname = expandSSHTokens(option.args[0], alias, "", "")
+			}
+		}
+	}
+	return options
+}
+
+// matches reports whether the block applies to a host
+func (b *sshConfigBlock) matches(alias, hostname string) bool {
+	if b.never {
+		return false
+	}
+	for _, condition := range b.conditions {
+		name := hostname
+		if condition.original {
+			name = alias
+		}
+		if matchPatternList(name, condition.patterns) == condition.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPatternList reports whether a host matches a pattern list: one of its
+// patterns matches and none of its negated patterns do
+func matchPatternList(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(host, pattern[1:]) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(host, pattern) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern matches a host against a pattern where * matches any sequence
+// and ? any single character
+func matchPattern(host, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(host); i >= 0; i-- {
+				if matchPattern(host[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if host == "" {
+				return false
+			}
+		default:
+			if host == "" || host[0] != pattern[0] {
+				return false
+			}
+		}
+		host, pattern = host[1:], pattern[1:]
+	}
+	return host == ""
+}
+
+// expandSSHTokens expands the %h, %r, %u, %d and %% tokens, and a leading ~
+func expandSSHTokens(value, hostname, remoteUser, port string) string {
+	home, _ := os.UserHomeDir()
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'h':
+			b.WriteString(hostname)
+		case 'r':
+			b.WriteString(remoteUser)
+		case 'u':
+			b.WriteString(localUser)
+		case 'd':
+			b.WriteString(home)
+		case 'p':
+			b.WriteString(port)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(value[i])
+		}
+	}
+
+	expanded := b.String()
+	if strings.HasPrefix(expanded, "~/") {
+		expanded = filepath.Join(home, expanded[2:])
+	}
+	return expanded
+}
+
+// sshConfigAlias returns the name a host is looked up by in the OpenSSH
+// config: its address, or its name when it has none
+func sshConfigAlias(host *types.Host) string {
+	switch {
+	case host.Address != "":
+		return host.Address
+	case host.Hostname != "":
+		return host.Hostname
+	}
+	return host.Name
+}
+
+// applySSHConfigToHost fills the settings a host gets neither from the
+// inventory nor from its ssh_config with the OpenSSH client config
+func applySSHConfigToHost(host *types.Host, cfg *sshConfig) {
+	alias := sshConfigAlias(host)
+	if alias == "" {
+		return
+	}
+	options := cfg.lookup(alias)
+
+	// The alias is replaced by the real host name, as ssh does
+	if hostname, ok := options["hostname"]; ok {
+		host.Address = expandSSHTokens(hostname[0], alias, "", "")
+	}
+	if value, ok := options["user"]; ok && host.User == "" {
+		host.User = value[0]
+	}
+	if value, ok := options["port"]; ok && host.Port == 0 {
+		if port, err := strconv.Atoi(value[0]); err == nil {
+			host.Port = port
+		}
+	}
+	// Missing identity files are skipped like ssh does, a host without any
+	// still getting the keys of the agent unless IdentitiesOnly is set
+	if files, ok := options["identityfile"]; ok && host.KeyFile == "" {
+		host.KeyFile = firstIdentityFile(files, host)
+	}
+	if value, ok := options["identitiesonly"]; ok && strings.EqualFold(value[0], "yes") {
+		host.IdentitiesOnly = true
+	}
+	if value, ok := options["proxyjump"]; ok && host.ProxyJump == "" {
+		host.ProxyJump = value[0]
+	}
+}
+
+// firstIdentityFile returns the first identity file that exists, or "" when
+// none does
+func firstIdentityFile(files []string, host *types.Host) string {
+	port := strconv.Itoa(host.Port)
+	if host.Port == 0 {
+		port = "22"
+	}
+	for _, file := range files {
+		path := expandSSHTokens(file, host.Address, host.User, port)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// resolveJumps builds the jump hosts of a host from its ProxyJump, a comma
+// separated list of [user@]host[:port] hops. A hop gets its settings from the
+// OpenSSH config when cfg is not nil, and the user, key and host key checking
+// of the host otherwise. Pinned host keys are not shared with the jump hosts.
+func resolveJumps(host *types.Host, cfg *sshConfig) error {
+	host.Jumps = nil
+	if host.ProxyJump == "" || strings.EqualFold(host.ProxyJump, "none") {
+		return nil
+	}
+
+	for _, spec := range strings.Split(host.ProxyJump, ",") {
+		spec = strings.TrimPrefix(strings.TrimSpace(spec), "ssh://")
+		if spec == "" {
+			return fmt.Errorf("invalid proxy_jump '%s' of host '%s'", host.ProxyJump, host.Name)
+		}
+
+		jump := types.Host{Name: spec}
+		address := spec
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			jump.User = address[:at]
+			address = address[at+1:]
+		}
+		if i := strings.LastIndex(address, ":"); i >= 0 && !strings.HasSuffix(address, "]") {
+			port, err := strconv.Atoi(address[i+1:])
+			if err != nil {
+				return fmt.Errorf("invalid port in proxy_jump '%s' of host '%s'", spec, host.Name)
+			}
+			jump.Port = port
+			address = address[:i]
+		}
+		jump.Address = strings.Trim(address, "[]")
+
+		if cfg != nil {
+			applySSHConfigToHost(&jump, cfg)
+		}
+		if jump.User == "" {
+			jump.User = host.User
+		}
+		if jump.KeyFile == "" {
+			jump.KeyFile = host.KeyFile
+			jump.KeyPassword = host.KeyPassword
+		}
+		jump.UseAgent = jump.UseAgent || host.UseAgent
+		jump.StrictHostKeyCheck = host.StrictHostKeyCheck
+		jump.HostKeyPolicy = host.HostKeyPolicy
+		jump.KnownHostsFile = host.KnownHostsFile
+		jump.ConnectTimeout = host.ConnectTimeout
+		// Jump hosts do not chain further
+		jump.ProxyJump = ""
+
+		host.Jumps = append(host.Jumps, jump)
+	}
+	return nil
+}
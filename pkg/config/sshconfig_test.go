@@ -0,0 +1,336 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// writeSSHConfig writes an OpenSSH config file under a temporary home and
+// returns its path
+func writeSSHConfig(t *testing.T, home, name, content string) string {
+	t.Helper()
+	path := filepath.Join(home, ".ssh", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+func TestParseSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		wantKey  string
+		wantArgs []string
+		wantErr  bool
+	}{
+		{"", "", nil, false},
+		{"  # comment", "", nil, false},
+		{"HostName example.com", "hostname", []string{"example.com"}, false},
+		{"Port=2222", "port", []string{"2222"}, false},
+		{"User = admin", "user", []string{"admin"}, false},
+		{"\tHost web-* !web-test", "host", []string{"web-*", "!web-test"}, false},
+		{`IdentityFile "~/.ssh/my key"`, "identityfile", []string{"~/.ssh/my key"}, false},
+		{`IdentityFile "~/.ssh/my key`, "", nil, true},
+		{"HostName", "", nil, true},
+	}
+
+	for _, tt := range tests {
+		key, args, err := parseSSHConfigLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSSHConfigLine(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if key != tt.wantKey || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("parseSSHConfigLine(%q) = %q, %q, want %q, %q", tt.line, key, args, tt.wantKey, tt.wantArgs)
+		}
+	}
+}
+
+func TestMatchPatternList(t *testing.T) {
+	tests := []struct {
+		host     string
+		patterns []string
+		want     bool
+	}{
+		{"web1", []string{"*"}, true},
+		{"web1", []string{"web?"}, true},
+		{"web10", []string{"web?"}, false},
+		{"web1.example.com", []string{"*.example.com"}, true},
+		{"WEB1", []string{"web*"}, true},
+		{"db1", []string{"web*", "db*"}, true},
+		{"web-test", []string{"web-*", "!web-test"}, false},
+		{"web-prod", []string{"web-*", "!web-test"}, true},
+		{"web1", []string{"!db*"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPatternList(tt.host, tt.patterns); got != tt.want {
+			t.Errorf("matchPatternList(%q, %q) = %v, want %v", tt.host, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestSSHConfigLookup(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	writeSSHConfig(t, home, "config.d/bastion.conf", `
+Host bastion
+    HostName bastion.example.com
+    User jump
+`)
+	writeSSHConfig(t, home, "included.conf", `
+Port 2200
+`)
+	path := writeSSHConfig(t, home, "config", `
+Include config.d/*.conf
+
+Host web1
+    HostName 10.0.0.11
+    IdentityFile ~/.ssh/web1
+    Include included.conf
+
+Host web*
+    User deploy
+    Port 2222
+    IdentityFile ~/.ssh/id_%h
+
+Match host 10.0.0.*
+    ProxyJump bastion
+
+Match originalhost db*
+    User dba
+
+Match user root
+    Port 22
+
+Host *
+    User nobody
+    IdentitiesOnly yes
+`)
+
+	cfg, err := loadSSHConfig(path)
+	if err != nil {
+		t.Fatalf("loadSSHConfig() error = %v", err)
+	}
+
+	tests := []struct {
+		alias string
+		want  map[string][]string
+	}{
+		{
+			// The include in the Host block only applies to web1, the first
+			// value wins and identity files accumulate
+			alias: "web1",
+			want: map[string][]string{
+				"hostname":       {"10.0.0.11"},
+				"identityfile":   {"~/.ssh/web1", "~/.ssh/id_%h"},
+				"port":           {"2200"},
+				"user":           {"deploy"},
+				"proxyjump":      {"bastion"},
+				"identitiesonly": {"yes"},
+			},
+		},
+		{
+			alias: "web2",
+			want: map[string][]string{
+				"user":           {"deploy"},
+				"port":           {"2222"},
+				"identityfile":   {"~/.ssh/id_%h"},
+				"identitiesonly": {"yes"},
+			},
+		},
+		{
+			alias: "bastion",
+			want: map[string][]string{
+				"hostname":       {"bastion.example.com"},
+				"user":           {"jump"},
+				"identitiesonly": {"yes"},
+			},
+		},
+		{
+			alias: "db1",
+			want: map[string][]string{
+				"user":           {"dba"},
+				"identitiesonly": {"yes"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.lookup(tt.alias); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%q) = %v, want %v", tt.alias, got, tt.want)
+		}
+	}
+}
+
+func TestLoadSSHConfig_Missing(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	// A missing ~/.ssh/config is an empty config, a missing explicit file an error
+	cfg, err := loadSSHConfig("")
+	if err != nil {
+		t.Fatalf("loadSSHConfig() error = %v", err)
+	}
+	if len(cfg.lookup("web1")) != 0 {
+		t.Error("lookup() on an empty config returned options")
+	}
+
+	if _, err := loadSSHConfig(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loadSSHConfig() of a missing file succeeded")
+	}
+}
+
+func TestLoadSSHConfig_IncludeLoop(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := writeSSHConfig(t, home, "config", "Include config\n")
+
+	if _, err := loadSSHConfig(path); err == nil {
+		t.Error("loadSSHConfig() of a config including itself succeeded")
+	}
+}
+
+func TestApplySSHDefaults_SSHConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	key := writeSSHConfig(t, home, "web_key", "key")
+	writeSSHConfig(t, home, "config", `
+Host web1 web2
+    HostName %h.example.com
+    User ssh-user
+    Port 2222
+    IdentityFile ~/.ssh/missing_key
+    IdentityFile ~/.ssh/web_key
+
+Host bastion
+    HostName bastion.example.com
+    Port 2200
+
+Host web2
+    ProxyJump admin@bastion,gw:2201
+`)
+
+	disabled := false
+	cfg := &types.Config{
+		Inventory: types.Inventory{
+			SSHConfig: &types.SSHConfig{Port: 22},
+			Hosts: []types.Host{
+				{Name: "web1", User: "inventory-user"},
+				{Name: "web2"},
+				{Name: "web3", Address: "web1", UseSSHConfig: &disabled},
+			},
+		},
+	}
+	if err := ApplySSHDefaults(cfg); err != nil {
+		t.Fatalf("ApplySSHDefaults() error = %v", err)
+	}
+
+	// The inventory and its ssh_config take precedence over the OpenSSH config
+	web1 := cfg.Inventory.Hosts[0]
+	if web1.Address != "web1.example.com" || web1.User != "inventory-user" || web1.Port != 22 || web1.KeyFile != key {
+		t.Errorf("web1 = %s@%s:%d key %s, want inventory-user@web1.example.com:22 key %s", web1.User, web1.Address, web1.Port, web1.KeyFile, key)
+	}
+
+	web2 := cfg.Inventory.Hosts[1]
+	if web2.User != "ssh-user" || web2.ProxyJump != "admin@bastion,gw:2201" {
+		t.Errorf("web2 user = %s, proxy_jump = %s", web2.User, web2.ProxyJump)
+	}
+	if len(web2.Jumps) != 2 {
+		t.Fatalf("web2 has %d jump hosts, want 2", len(web2.Jumps))
+	}
+	bastion := web2.Jumps[0]
+	if bastion.Address != "bastion.example.com" || bastion.Port != 2200 || bastion.User != "admin" || bastion.KeyFile != key {
+		t.Errorf("jump host = %s@%s:%d key %s", bastion.User, bastion.Address, bastion.Port, bastion.KeyFile)
+	}
+	gw := web2.Jumps[1]
+	if gw.Address != "gw" || gw.Port != 2201 || gw.User != "ssh-user" {
+		t.Errorf("jump host = %s@%s:%d", gw.User, gw.Address, gw.Port)
+	}
+
+	// use_ssh_config: false ignores the OpenSSH config
+	web3 := cfg.Inventory.Hosts[2]
+	if web3.Address != "web1" || web3.User != "" {
+		t.Errorf("web3 = %s@%s, want the OpenSSH config ignored", web3.User, web3.Address)
+	}
+}
+
+func TestApplySSHDefaults_SSHConfigDisabled(t *testing.T) {
+	// Opting out in the inventory ssh_config does not even read the config
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte("Host \"web1\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	types.ExecOptions.SSHConfigFile = path
+	defer func() { types.ExecOptions.SSHConfigFile = "" }()
+
+	disabled := false
+	cfg := &types.Config{
+		Inventory: types.Inventory{
+			SSHConfig: &types.SSHConfig{UseSSHConfig: &disabled},
+			Hosts:     []types.Host{{Name: "web1"}},
+		},
+	}
+	if err := ApplySSHDefaults(cfg); err != nil {
+		t.Errorf("ApplySSHDefaults() error = %v", err)
+	}
+
+	cfg.Inventory.SSHConfig = nil
+	cfg.Inventory.Hosts[0].UseSSHConfig = nil
+	if err := ApplySSHDefaults(cfg); err == nil {
+		t.Error("ApplySSHDefaults() with an invalid ssh config succeeded")
+	}
+}
+
+func TestResolveJumps_Invalid(t *testing.T) {
+	for _, proxyJump := range []string{"bastion:ssh", "bastion,,gw"} {
+		host := &types.Host{Name: "web1", ProxyJump: proxyJump}
+		if err := resolveJumps(host, nil); err == nil {
+			t.Errorf("resolveJumps(%q) succeeded", proxyJump)
+		}
+	}
+
+	host := &types.Host{Name: "web1", ProxyJump: "none"}
+	if err := resolveJumps(host, nil); err != nil || host.Jumps != nil {
+		t.Errorf("resolveJumps(none) = %v, %v", host.Jumps, err)
+	}
+}
+
+func TestApplySSHDefaults_SSHConfigMissingIdentities(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeSSHConfig(t, home, "config", `
+Host web1
+    IdentityFile ~/.ssh/missing_key
+    IdentityFile ~/.ssh/id_%h
+
+Host web2
+    IdentityFile ~/.ssh/missing_key
+    IdentitiesOnly yes
+`)
+
+	cfg := &types.Config{
+		Inventory: types.Inventory{
+			Hosts: []types.Host{{Name: "web1"}, {Name: "web2"}},
+		},
+	}
+	if err := ApplySSHDefaults(cfg); err != nil {
+		t.Fatalf("ApplySSHDefaults() error = %v", err)
+	}
+
+	// Without an existing identity file, the host keeps no key file so the
+	// agent is still offered, unless IdentitiesOnly restricts it
+	for i, wantOnly := range []bool{false, true} {
+		host := cfg.Inventory.Hosts[i]
+		if host.KeyFile != "" || host.IdentitiesOnly != wantOnly {
+			t.Errorf("%s key file = %q, identities_only = %v, want no key file and %v", host.Name, host.KeyFile, host.IdentitiesOnly, wantOnly)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package executor
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+const (
+	// asyncJobsDir is the directory of the async jobs, in the home of the
+	// remote user. A job keeps its files there after the run so its log can
+	// be read later.
+	asyncJobsDir = ".sshot_async"
+
+	// defaultAsyncPoll is the interval between status checks of an async job
+	// when poll is unset
+	defaultAsyncPoll = 10 * time.Second
+
+	// asyncLogLimit is the size of the end of the job log returned as the
+	// task output
+	asyncLogLimit = 1 << 20
+
+	// asyncPollFailures is the number of consecutive failed status checks
+	// after which sshot stops polling a job
+	asyncPollFailures = 3
+)
+
+// asyncJobPattern matches valid job ids, which are used in remote paths
+var asyncJobPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// asyncWrapper runs the job command in its own session when setsid is
+// available, with its output in the job log. The exit code is written
+// atomically once the command is finished. A watcher kills the command group
+// after the async limit, and records the timeout if the kill succeeded. The
+// job files are readable by the remote user when the wrapper runs with sudo,
+// the job directory keeping them private.
+const asyncWrapper = `dir=$1
+limit=$3
+umask 022
+if command -v setsid >/dev/null 2>&1; then
+  setsid sh -c "$2" </dev/null >"$dir/log" 2>&1 &
+  group=-
+else
+  sh -c "$2" </dev/null >"$dir/log" 2>&1 &
+  group=
+fi
+child=$!
+(
+  sleep "$limit" & s=$!
+  trap 'kill $s 2>/dev/null; exit 0' TERM
+  wait $s
+  trap '' TERM
+  kill -TERM "$group$child" 2>/dev/null || exit 0
+  echo "$limit" > "$dir/timed_out"
+  sleep 2
+  kill -KILL "$group$child" 2>/dev/null
+) >/dev/null 2>&1 &
+watcher=$!
+wait "$child"
+rc=$?
+kill "$watcher" 2>/dev/null
+wait "$watcher"
+echo "$rc" > "$dir/rc.tmp" && mv "$dir/rc.tmp" "$dir/rc"
+`
+
+// asyncLaunchScript creates the job directory and starts the wrapper detached
+// from the SSH session, so the job survives the loss of the connection. The
+// wrapper pid tells whether the job is alive. The arguments are the quoted job
+// id, command, async limit, wrapper and sudo prefix. With sudo, the whole
+// wrapper runs as root so its watcher can kill the job, and the sudo file
+// tells the status script to check the wrapper with sudo.
+const asyncLaunchScript = `set -e
+umask 077
+dir="$HOME/` + asyncJobsDir + `/"%[1]s
+mkdir -p "$dir"
+printf '%%s\n' %[2]s > "$dir/command"
+sudo=%[5]s
+if [ -n "$sudo" ]; then $sudo true; : > "$dir/sudo"; fi
+if command -v setsid >/dev/null 2>&1; then detach=setsid; else detach=nohup; fi
+$detach $sudo sh -c %[4]s sshot-async "$dir" %[2]s %[3]d </dev/null >/dev/null 2>&1 &
+echo $! > "$dir/pid"
+`
+
+// asyncStatusScript prints the state of a job: "finished <rc> [<limit>]",
+// the limit being set when the job was killed by it, "running", "died" when
+// the wrapper is gone without an exit code, or "missing"
+const asyncStatusScript = `dir="$HOME/` + asyncJobsDir + `/"%[1]s
+pid=$(cat "$dir/pid" 2>/dev/null)
+if [ ! -d "$dir" ]; then echo missing
+elif [ -f "$dir/rc" ]; then echo finished "$(cat "$dir/rc")" "$(cat "$dir/timed_out" 2>/dev/null)"
+elif kill -0 "$pid" 2>/dev/null; then echo running
+elif [ -f "$dir/sudo" ] && sudo -n kill -0 "$pid" 2>/dev/null; then echo running
+else echo died
+fi
+`
+
+// asyncJob is the state of an async job as printed by asyncStatusScript
+type asyncJob struct {
+	State    string
+	RC       int
+	TimedOut int
+}
+
+// validateAsync checks the async options of a task
+func validateAsync(task types.Task) error {
+	if task.Async < 0 {
+		return fmt.Errorf("invalid async %d", task.Async)
+	}
+	if task.Poll != nil && *task.Poll < 0 {
+		return fmt.Errorf("invalid poll %d", *task.Poll)
+	}
+	if task.Async == 0 {
+		if task.Poll != nil {
+			return fmt.Errorf("poll requires async")
+		}
+		return nil
+	}
+	if task.Command == "" && task.Shell == "" {
+		return fmt.Errorf("async is only supported on command and shell tasks")
+	}
+	if task.Stdin != "" {
+		return fmt.Errorf("async tasks cannot read stdin")
+	}
+	// Another attempt would start the job again while the first one runs
+	if task.Retries > 0 || task.UntilSuccess {
+		return fmt.Errorf("async tasks cannot be retried, wait for the job with async_status instead")
+	}
+	return nil
+}
+
+// asyncPoll returns the interval between status checks of an async task, 0
+// meaning the job is not waited for
+func asyncPoll(task types.Task) time.Duration {
+	if task.Poll == nil {
+		return defaultAsyncPoll
+	}
+	return time.Duration(*task.Poll) * time.Second
+}
+
+// asyncLogPath returns the path of the log of a job, for display
+func asyncLogPath(jid string) string {
+	return "~/" + asyncJobsDir + "/" + jid + "/log"
+}
+
+// executeAsync starts a command as a detached job limited to limit seconds.
+// With a poll interval it waits for the job and returns its log, otherwise it
+// returns the job id to check it later with async_status. Polling stops when
+// the task runs out of time but the job keeps running.
+func (e *Executor) executeAsync(cmd string, limit int, poll time.Duration, sudo bool) (string, error) {
+	writer := e.OutputWriter
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	// The job cannot answer a password prompt
+	sudoPrefix := ""
+	if sudo {
+		sudoPrefix = "sudo -n"
+	}
+
+	jid := fmt.Sprintf("%d.%s", time.Now().Unix(), randomSuffix())
+
+	script := fmt.Sprintf(asyncLaunchScript, utils.ShellQuote(jid), utils.ShellQuote(cmd), limit, utils.ShellQuote(asyncWrapper), utils.ShellQuote(sudoPrefix))
+	if _, err := e.runWithStdin("sh -c "+utils.ShellQuote(script), nil, false); err != nil {
+		return "", fmt.Errorf("failed to start async job: %w", err)
+	}
+
+	e.mu.Lock()
+	fmt.Fprintf(writer, "  ↦ Started async job %s (log: %s)\n", jid, asyncLogPath(jid))
+	e.mu.Unlock()
+
+	if poll == 0 {
+		return jid, nil
+	}
+
+	ctx := e.taskContext()
+	start := time.Now()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("%w, async job %s keeps running", contextError(ctx), jid)
+		case <-time.After(poll):
+		}
+
+		job, err := e.asyncJobStatus(jid)
+		if err != nil {
+			failures++
+			if failures >= asyncPollFailures {
+				return "", fmt.Errorf("lost track of async job %s: %w (it keeps running, check it with async_status)", jid, err)
+			}
+			continue
+		}
+		failures = 0
+
+		if types.ExecOptions.Verbose {
+			e.mu.Lock()
+			log.SetOutput(writer)
+			log.Printf("[VERBOSE] [%s] Async job %s is %s after %s", e.Host.Name, jid, job.State, time.Since(start).Round(time.Second))
+			log.SetOutput(os.Stderr)
+			e.mu.Unlock()
+		}
+
+		if job.State != "running" {
+			return e.asyncJobResult(jid, job)
+		}
+	}
+}
+
+// executeAsyncStatus checks a job started with poll: 0. A running job is an
+// error, so that retries or until_success wait for it.
+func (e *Executor) executeAsyncStatus(status *types.AsyncStatusTask) (string, error) {
+	if !asyncJobPattern.MatchString(status.Jid) {
+		return "", fmt.Errorf("invalid async job id '%s'", status.Jid)
+	}
+
+	job, err := e.asyncJobStatus(status.Jid)
+	if err != nil {
+		return "", err
+	}
+	if job.State == "running" {
+		return "", fmt.Errorf("async job %s is still running", status.Jid)
+	}
+
+	output, err := e.asyncJobResult(status.Jid, job)
+	if status.Cleanup && job.State != "missing" {
+		dir := `"$HOME/` + asyncJobsDir + `/"` + status.Jid
+		if _, rmErr := e.runWithStdin("sh -c "+utils.ShellQuote("rm -rf "+dir), nil, false); rmErr != nil && err == nil {
+			err = fmt.Errorf("failed to remove async job %s: %w", status.Jid, rmErr)
+		}
+	}
+	return output, err
+}
+
+// asyncJobStatus returns the state of a job
+func (e *Executor) asyncJobStatus(jid string) (asyncJob, error) {
+	output, err := e.runWithStdin("sh -c "+utils.ShellQuote(fmt.Sprintf(asyncStatusScript, jid)), nil, false)
+	if err != nil {
+		return asyncJob{}, fmt.Errorf("failed to check async job %s: %w", jid, err)
+	}
+	return parseAsyncJob(output)
+}
+
+// parseAsyncJob parses the output of asyncStatusScript
+func parseAsyncJob(output string) (asyncJob, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return asyncJob{}, fmt.Errorf("unexpected async job status %q", output)
+	}
+
+	job := asyncJob{State: fields[0]}
+	switch job.State {
+	case "running", "died", "missing":
+		return job, nil
+	case "finished":
+		if len(fields) < 2 {
+			return job, fmt.Errorf("unexpected async job status %q", output)
+		}
+		var err error
+		if job.RC, err = strconv.Atoi(fields[1]); err != nil {
+			return job, fmt.Errorf("unexpected async job exit code %q", fields[1])
+		}
+		if len(fields) > 2 {
+			job.TimedOut, _ = strconv.Atoi(fields[2])
+		}
+		return job, nil
+	}
+	return job, fmt.Errorf("unexpected async job status %q", output)
+}
+
+// asyncJobResult returns the end of the log of a job that is no longer
+// running, and an error unless it succeeded
+func (e *Executor) asyncJobResult(jid string, job asyncJob) (string, error) {
+	switch job.State {
+	case "missing":
+		return "", fmt.Errorf("async job %s not found", jid)
+	case "died":
+		return "", fmt.Errorf("async job %s stopped without an exit code (was the host rebooted?)", jid)
+	}
+
+	script := fmt.Sprintf(`tail -c %d "$HOME/%s/"%s`, asyncLogLimit, asyncJobsDir, jid+"/log")
+	output, err := e.runWithStdin("sh -c "+utils.ShellQuote(script), nil, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the log of async job %s: %w", jid, err)
+	}
+
+	switch {
+	case job.TimedOut > 0:
+		return output, fmt.Errorf("async job %s killed after %d seconds", jid, job.TimedOut)
+	case job.RC != 0:
+		return output, fmt.Errorf("async job %s failed with exit code %d", jid, job.RC)
+	}
+	return output, nil
+}
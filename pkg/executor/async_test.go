@@ -0,0 +1,214 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+func TestValidateAsync(t *testing.T) {
+	zero, negative := 0, -1
+	tests := []struct {
+		name    string
+		task    types.Task
+		wantErr string
+	}{
+		{name: "no async", task: types.Task{Command: "true"}},
+		{name: "command", task: types.Task{Command: "true", Async: 60}},
+		{name: "shell fire and forget", task: types.Task{Shell: "true", Async: 60, Poll: &zero}},
+		{name: "negative async", task: types.Task{Command: "true", Async: -1}, wantErr: "invalid async -1"},
+		{name: "negative poll", task: types.Task{Command: "true", Async: 60, Poll: &negative}, wantErr: "invalid poll -1"},
+		{name: "poll without async", task: types.Task{Command: "true", Poll: &zero}, wantErr: "poll requires async"},
+		{name: "copy", task: types.Task{Copy: &types.CopyTask{Src: "a", Dest: "b"}, Async: 60}, wantErr: "only supported on command and shell"},
+		{name: "stdin", task: types.Task{Command: "cat", Stdin: "data", Async: 60}, wantErr: "cannot read stdin"},
+		{name: "retries", task: types.Task{Command: "true", Async: 60, Retries: 3}, wantErr: "cannot be retried"},
+		{name: "until success", task: types.Task{Command: "true", Async: 60, UntilSuccess: true}, wantErr: "cannot be retried"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAsync(tt.task)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateAsync() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateAsync() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAsyncJob(t *testing.T) {
+	tests := []struct {
+		output  string
+		want    asyncJob
+		wantErr bool
+	}{
+		{output: "running\n", want: asyncJob{State: "running"}},
+		{output: "missing\n", want: asyncJob{State: "missing"}},
+		{output: "died\n", want: asyncJob{State: "died"}},
+		{output: "finished 0 \n", want: asyncJob{State: "finished"}},
+		{output: "finished 2 \n", want: asyncJob{State: "finished", RC: 2}},
+		{output: "finished 143 30\n", want: asyncJob{State: "finished", RC: 143, TimedOut: 30}},
+		{output: "finished\n", wantErr: true},
+		{output: "finished x\n", wantErr: true},
+		{output: "", wantErr: true},
+		{output: "unknown\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAsyncJob(tt.output)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAsyncJob(%q) error = %v, wantErr %v", tt.output, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseAsyncJob(%q) = %+v, want %+v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestAsyncScripts(t *testing.T) {
+	t.Run("user", func(t *testing.T) {
+		testAsyncScripts(t, "", os.Getenv("PATH"))
+	})
+
+	// A fake sudo logs its use and runs the command as is
+	t.Run("sudo", func(t *testing.T) {
+		bin := t.TempDir()
+		sudo := "#!/bin/sh\n[ \"$1\" = -n ] && shift\necho \"$*\" >> \"$SUDO_LOG\"\nexec \"$@\"\n"
+		if err := os.WriteFile(filepath.Join(bin, "sudo"), []byte(sudo), 0700); err != nil { //nolint:gosec // the fake sudo must be executable
+			t.Fatalf("Failed to write sudo: %v", err)
+		}
+		sudoLog := filepath.Join(bin, "sudo.log")
+		t.Setenv("SUDO_LOG", sudoLog)
+		testAsyncScripts(t, "sudo -n", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+		content, _ := os.ReadFile(sudoLog)
+		if !strings.Contains(string(content), "sh -c") || !strings.Contains(string(content), "sshot-async") {
+			t.Errorf("sudo log = %q, want the wrapper run with sudo", content)
+		}
+	})
+}
+
+// testAsyncScripts launches jobs with the given sudo prefix and checks them
+// with the status script
+func testAsyncScripts(t *testing.T, sudo, path string) {
+	home := t.TempDir()
+	run := func(script string) string {
+		cmd := exec.Command("/bin/sh", "-c", script)
+		cmd.Env = append(os.Environ(), "HOME="+home, "PATH="+path)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("script failed: %v", err)
+		}
+		return string(out)
+	}
+	launch := func(jid, command string, limit int) {
+		run(fmt.Sprintf(asyncLaunchScript, utils.ShellQuote(jid), utils.ShellQuote(command), limit, utils.ShellQuote(asyncWrapper), utils.ShellQuote(sudo)))
+	}
+	wait := func(jid string) asyncJob {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			job, err := parseAsyncJob(run(fmt.Sprintf(asyncStatusScript, jid)))
+			if err != nil {
+				t.Fatalf("parseAsyncJob() error = %v", err)
+			}
+			if job.State != "running" || time.Now().After(deadline) {
+				return job
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if job := wait("none"); job.State != "missing" {
+		t.Errorf("unknown job state = %s, want missing", job.State)
+	}
+
+	launch("ok", "echo started; echo failed >&2", 60)
+	if job := wait("ok"); job != (asyncJob{State: "finished"}) {
+		t.Errorf("successful job = %+v, want finished with exit code 0", job)
+	}
+	if log, _ := os.ReadFile(filepath.Join(home, asyncJobsDir, "ok", "log")); string(log) != "started\nfailed\n" {
+		t.Errorf("job log = %q, want stdout and stderr", log)
+	}
+	if command, _ := os.ReadFile(filepath.Join(home, asyncJobsDir, "ok", "command")); !strings.Contains(string(command), "echo started") {
+		t.Errorf("job command = %q, want the command", command)
+	}
+
+	launch("failed", "exit 3", 60)
+	if job := wait("failed"); job != (asyncJob{State: "finished", RC: 3}) {
+		t.Errorf("failed job = %+v, want finished with exit code 3", job)
+	}
+
+	launch("slow", "sleep 30", 1)
+	if job := wait("slow"); job.State != "finished" || job.TimedOut != 1 || job.RC == 0 {
+		t.Errorf("slow job = %+v, want killed after 1 second", job)
+	}
+}
+
+func TestExecutor_AsyncDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() { types.ExecOptions.DryRun = false }()
+
+	output := &bytes.Buffer{}
+	exec := &Executor{
+		Host:           types.Host{Name: "test"},
+		Variables:      map[string]interface{}{"job": "1700000000.abc"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   output,
+	}
+
+	zero := 0
+	tasks := []types.Task{
+		{Name: "start", Shell: "./backup.sh", Async: 3600, Poll: &zero},
+		{Name: "wait", Command: "./migrate", Async: 600},
+		{Name: "check", AsyncStatus: &types.AsyncStatusTask{Jid: "{{ .job }}"}},
+	}
+	for _, task := range tasks {
+		if err := exec.ExecuteTask(task); err != nil {
+			t.Fatalf("ExecuteTask(%s) error = %v", task.Name, err)
+		}
+	}
+
+	for _, want := range []string{
+		"Async: 3600s (poll: 0s)",
+		"Async: 600s (poll: 10s)",
+		"Async status: 1700000000.abc",
+	} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("output = %q, want %q", output.String(), want)
+		}
+	}
+}
+
+func TestExecutor_AsyncInvalid(t *testing.T) {
+	exec := &Executor{
+		Host:           types.Host{Name: "test"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &bytes.Buffer{},
+	}
+
+	err := exec.ExecuteTask(types.Task{Name: "copy", Copy: &types.CopyTask{Src: "a", Dest: "b"}, Async: 60})
+	if err == nil || !strings.Contains(err.Error(), "async is only supported on command and shell tasks in task 'copy'") {
+		t.Errorf("ExecuteTask() error = %v, want an async error", err)
+	}
+
+	if _, err := exec.executeAsyncStatus(&types.AsyncStatusTask{Jid: "../etc"}); err == nil || !strings.Contains(err.Error(), "invalid async job id") {
+		t.Errorf("executeAsyncStatus() error = %v, want an invalid job id error", err)
+	}
+}
@@ -0,0 +1,76 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+// defaultShellExecutable runs shell tasks when no executable is set
+const defaultShellExecutable = "/bin/bash"
+
+// shellOperators are words that only have a meaning for a shell
+var shellOperators = map[string]bool{
+	"|": true, "||": true, "&&": true, "&": true, ";": true,
+	">": true, ">>": true, "<": true, "2>": true, "2>&1": true,
+}
+
+// renderCommand splits a command into words before rendering each of them, so
+// a variable always ends up in a single argument whatever its content, then
+// quotes every word. The command runs without any shell expansion.
+func (e *Executor) renderCommand(taskName, command string) (string, error) {
+	words, err := utils.SplitArgs(command)
+	if err != nil {
+		return "", fmt.Errorf("invalid command of task '%s': %w", taskName, err)
+	}
+
+	argv := make([]string, len(words))
+	for i, word := range words {
+		if shellOperators[word] {
+			e.warnShellOperator(word)
+		}
+		rendered, err := e.renderField(taskName, "command", word)
+		if err != nil {
+			return "", err
+		}
+		argv[i] = utils.ShellQuote(rendered)
+	}
+	return strings.Join(argv, " "), nil
+}
+
+// warnShellOperator reports a shell operator passed as a literal argument
+func (e *Executor) warnShellOperator(word string) {
+	writer := e.OutputWriter
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fmt.Fprintf(writer, "  %s⚠ '%s' is passed to the command as an argument, use shell: for pipes, redirections and command lists%s\n",
+		utils.Color(utils.ColorYellow), word, utils.Color(utils.ColorReset))
+}
+
+// buildShellCommand runs a script through an explicit shell, with pipefail
+// so a failure anywhere in a pipeline fails the task
+func buildShellCommand(script, executable string, pipefail bool) string {
+	if executable == "" {
+		executable = defaultShellExecutable
+	}
+	if pipefail {
+		script = "set -o pipefail\n" + script
+	}
+	return utils.ShellQuote(executable) + " -c " + utils.ShellQuote(script)
+}
+
+// taskStdin returns the input of a command or shell task, if any
+func taskStdin(task types.Task) io.Reader {
+	if task.Stdin == "" {
+		return nil
+	}
+	return strings.NewReader(task.Stdin)
+}
@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestExecutor_RenderCommand(t *testing.T) {
+	var output bytes.Buffer
+	executor := &Executor{
+		Variables: map[string]interface{}{
+			"name":    "x; touch injected",
+			"message": "it's $HOME",
+		},
+		OutputWriter: &output,
+	}
+
+	cmd, err := executor.renderCommand("Print", `printf '%s\n' {{ .name }} "{{ .message }}" plain`)
+	if err != nil {
+		t.Fatalf("renderCommand() error = %v", err)
+	}
+
+	result, err := exec.Command("/bin/sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatalf("command failed: %v\n%s", err, cmd)
+	}
+	expected := "x; touch injected\nit's $HOME\nplain\n"
+	if string(result) != expected {
+		t.Errorf("output = %q, want %q (command: %s)", string(result), expected, cmd)
+	}
+	if output.Len() != 0 {
+		t.Errorf("no warning expected, got %q", output.String())
+	}
+
+	// Shell operators are passed as arguments, with a warning
+	cmd, err = executor.renderCommand("Print", "echo a | wc -l")
+	if err != nil {
+		t.Fatalf("renderCommand() error = %v", err)
+	}
+	if cmd != "echo a '|' wc -l" {
+		t.Errorf("renderCommand() = %q, want the pipe quoted", cmd)
+	}
+	if !strings.Contains(output.String(), "use shell:") {
+		t.Errorf("a warning should suggest shell:, got %q", output.String())
+	}
+
+	if _, err := executor.renderCommand("Print", "echo 'unterminated"); err == nil || !strings.Contains(err.Error(), "task 'Print'") {
+		t.Errorf("renderCommand() error = %v, want an error naming the task", err)
+	}
+}
+
+func TestBuildShellCommand(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	// With pipefail a failing command in a pipeline fails the script
+	cmd := buildShellCommand("false | cat", "", true)
+	if err := exec.Command("/bin/sh", "-c", cmd).Run(); err == nil {
+		t.Error("pipeline should fail with pipefail")
+	}
+
+	cmd = buildShellCommand("false | cat", "", false)
+	if err := exec.Command("/bin/sh", "-c", cmd).Run(); err != nil {
+		t.Errorf("pipeline should succeed without pipefail: %v", err)
+	}
+
+	cmd = buildShellCommand(`echo "$0" | tr a-z A-Z`, "/bin/sh", false)
+	if !strings.HasPrefix(cmd, "/bin/sh -c ") {
+		t.Errorf("buildShellCommand() = %q, want the executable to be used", cmd)
+	}
+	out, err := exec.Command("/bin/sh", "-c", cmd).Output()
+	if err != nil || strings.TrimSpace(string(out)) != "/BIN/SH" {
+		t.Errorf("output = %q, err = %v", string(out), err)
+	}
+}
+
+func TestExecutor_ShellTaskDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      map[string]interface{}{"db": "app"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	task := types.Task{
+		Name:       "Load schema",
+		Shell:      "psql {{ .db }} | tee /tmp/load.log",
+		Executable: "/bin/zsh",
+		Stdin:      "CREATE TABLE t (id int);",
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+	for _, expected := range []string{"Shell: psql app | tee /tmp/load.log", "Executable: /bin/zsh", "Stdin: 24 bytes"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Output should contain %q, got: %q", expected, output.String())
+		}
+	}
+}
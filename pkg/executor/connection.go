@@ -0,0 +1,429 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+const (
+	// defaultKeepaliveInterval is the interval between keepalives when the
+	// host has no keepalive_interval
+	defaultKeepaliveInterval = 30 * time.Second
+
+	// defaultKeepaliveCountMax is the number of unanswered keepalives after
+	// which the connection is closed when the host has no keepalive_count_max
+	defaultKeepaliveCountMax = 3
+
+	// defaultConnectTimeout is the time to open a connection and complete the
+	// handshake when the host has no connect_timeout
+	defaultConnectTimeout = 10 * time.Second
+
+	// defaultConnectRetryDelay is the delay between connection attempts when
+	// the host has no connect_retry_delay
+	defaultConnectRetryDelay = 5 * time.Second
+
+	// reconnectAttempts is the number of attempts to open a new connection
+	// once the current one is lost
+	reconnectAttempts = 5
+)
+
+// reconnectDelay is the delay before the second reconnection attempt, doubled
+// after each attempt
+var reconnectDelay = 1 * time.Second
+
+// connection is the SSH connection to a host, shared by its executor, the
+// forks of the executor and the hosts delegating to it. A lost connection is
+// replaced by a new one with the same configuration.
+type connection struct {
+	host types.Host
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+
+	// redial is the reconnection in progress, which the other users of the
+	// connection wait for instead of dialing too
+	redial *redial
+}
+
+// redial is a reconnection, done once finished
+type redial struct {
+	done     chan struct{}
+	err      error
+	canceled bool
+}
+
+// dialConnection opens a connection to a host
+func dialConnection(host types.Host) (*connection, error) {
+	client, err := dialHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connection{host: host, client: client}
+	c.keepalive(client)
+	return c, nil
+}
+
+// dialHost connects to a host, making connect_retries more attempts after a
+// network failure, connect_retry_delay apart. Authentication and host key
+// failures are returned right away since retrying cannot fix them.
+func dialHost(ctx context.Context, host types.Host) (*ssh.Client, error) {
+	config, address, err := sshClientConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := host.ConnectRetries + 1
+	delay := time.Duration(host.ConnectRetryDelay) * time.Second
+	if delay <= 0 {
+		delay = defaultConnectRetryDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		client, err := dialJumps(ctx, host, address, config)
+		if err == nil {
+			return client, nil
+		}
+		if isAuthError(err) {
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			if attempt == 1 {
+				return nil, fmt.Errorf("failed to dial after 1 attempt: %w", err)
+			}
+			return nil, fmt.Errorf("failed to dial after %d attempts: %w", attempt, err)
+		}
+
+		if types.ExecOptions.Verbose {
+			log.Printf("[VERBOSE] [%s] Connection attempt %d/%d failed, retrying in %s: %v", host.Name, attempt, attempts, delay, err)
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dialContext opens an SSH connection, giving up when ctx is done. The
+// handshake is limited by the configured timeout, like the dial.
+func dialContext(ctx context.Context, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	return dialThrough(ctx, nil, address, config)
+}
+
+// dialJumps opens an SSH connection to the host through its jump hosts, each
+// one reached through the previous one
+func dialJumps(ctx context.Context, host types.Host, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var jump *ssh.Client
+	for _, hop := range host.Jumps {
+		hopConfig, hopAddress, err := sshClientConfig(hop)
+		if err != nil {
+			if jump != nil {
+				_ = jump.Close()
+			}
+			return nil, fmt.Errorf("jump host '%s': %w", hop.Name, err)
+		}
+		// A failed dial closes the previous jump hosts
+		if jump, err = dialThrough(ctx, jump, hopAddress, hopConfig); err != nil {
+			return nil, fmt.Errorf("jump host '%s': %w", hop.Name, err)
+		}
+	}
+	return dialThrough(ctx, jump, address, config)
+}
+
+// dialThrough opens an SSH connection over a channel of the jump client, or
+// directly when jump is nil. Closing the connection closes the jump client.
+func dialThrough(ctx context.Context, jump *ssh.Client, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if jump == nil {
+		dialer := net.Dialer{Timeout: config.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		dialCtx := ctx
+		if config.Timeout > 0 {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, config.Timeout)
+			defer cancel()
+		}
+		conn, err = jump.DialContext(dialCtx, "tcp", address)
+	}
+	if err != nil {
+		if jump != nil {
+			_ = jump.Close()
+		}
+		return nil, err
+	}
+
+	// Channels of a jump client have no deadline, the handshake is then
+	// bounded by the keepalives of the jump connection
+	if config.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		_ = conn.Close()
+		if jump != nil {
+			_ = jump.Close()
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	if jump != nil {
+		go func() {
+			_ = client.Wait()
+			_ = jump.Close()
+		}()
+	}
+	return client, nil
+}
+
+// isAuthError reports whether a connection failed on authentication or host
+// key verification rather than on the network
+func isAuthError(err error) bool {
+	var keyErr *knownhosts.KeyError
+	return errors.As(err, &keyErr) || strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// Client returns the current SSH client of the connection
+func (c *connection) Client() *ssh.Client {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+// Close closes the connection
+func (c *connection) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.client == nil {
+		return nil
+	}
+	return c.client.Close()
+}
+
+// replace swaps in a new client, closing the previous one
+func (c *connection) replace(client *ssh.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		_ = c.client.Close()
+	}
+	c.client = client
+	c.keepalive(client)
+}
+
+// reconnect replaces the lost client with a new one, dialed in up to
+// reconnectAttempts attempts with backoff. Only one user of the connection dials, the
+// others wait for it and share its client, unless it gave up on its own
+// context. The connection stays usable while dialing.
+func (c *connection) reconnect(ctx context.Context, lost *ssh.Client, e *Executor) (*ssh.Client, error) {
+	for {
+		c.mu.Lock()
+		client, r := c.client, c.redial
+		if client == lost && r == nil {
+			r = &redial{done: make(chan struct{})}
+			c.redial = r
+			c.mu.Unlock()
+			return c.dial(ctx, lost, r, e)
+		}
+		c.mu.Unlock()
+		if client != lost {
+			return client, nil
+		}
+
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return nil, contextError(ctx)
+		}
+		if r.err != nil && !r.canceled {
+			return nil, r.err
+		}
+	}
+}
+
+// dial opens the client replacing the lost one, then swaps it in and
+// releases the users waiting for it
+func (c *connection) dial(ctx context.Context, lost *ssh.Client, r *redial, e *Executor) (*ssh.Client, error) {
+	_ = lost.Close()
+	e.logVerbose("Connection to %s lost, reconnecting", c.host.Name)
+
+	client, err := c.redialHost(ctx, e)
+
+	c.mu.Lock()
+	switch {
+	case err != nil:
+		r.err = fmt.Errorf("failed to reconnect: %w", err)
+		r.canceled = ctx.Err() != nil
+	case c.closed:
+		_ = client.Close()
+		r.err = fmt.Errorf("failed to reconnect: connection to %s closed", c.host.Name)
+	default:
+		c.client = client
+		c.keepalive(client)
+	}
+	c.redial = nil
+	c.mu.Unlock()
+	close(r.done)
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	e.logVerbose("Reconnected to %s", c.host.Name)
+	return client, nil
+}
+
+// redialHost connects to the host again, whatever its connect_retries: a lost
+// connection is retried reconnectAttempts times, the delay between attempts
+// doubling from reconnectDelay. Authentication and host key failures are
+// returned right away.
+func (c *connection) redialHost(ctx context.Context, e *Executor) (*ssh.Client, error) {
+	config, address, err := sshClientConfig(c.host)
+	if err != nil {
+		return nil, err
+	}
+
+	delay := reconnectDelay
+	for attempt := 1; ; attempt++ {
+		client, err := dialJumps(ctx, c.host, address, config)
+		if err == nil {
+			return client, nil
+		}
+		if isAuthError(err) {
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+		if attempt >= reconnectAttempts || ctx.Err() != nil {
+			if attempt == 1 {
+				return nil, fmt.Errorf("failed to dial after 1 attempt: %w", err)
+			}
+			return nil, fmt.Errorf("failed to dial after %d attempts: %w", attempt, err)
+		}
+
+		e.logVerbose("Reconnection attempt %d/%d failed, retrying in %s: %v", attempt, reconnectAttempts, delay, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// keepalive sends keepalives on the client at the interval of the host, and
+// closes it when too many are left unanswered so that a dead connection is
+// detected instead of blocking. It stops once the client is closed.
+func (c *connection) keepalive(client *ssh.Client) {
+	interval := time.Duration(c.host.KeepaliveInterval) * time.Second
+	if interval == 0 {
+		interval = defaultKeepaliveInterval
+	}
+	if interval < 0 {
+		return
+	}
+	countMax := c.host.KeepaliveCountMax
+	if countMax <= 0 {
+		countMax = defaultKeepaliveCountMax
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		missed := 0
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			}
+
+			if clientAlive(client, interval) {
+				missed = 0
+				continue
+			}
+			missed++
+			if missed >= countMax {
+				if types.ExecOptions.Verbose {
+					log.Printf("[VERBOSE] [%s] No answer to %d keepalives, closing the connection", c.host.Name, missed)
+				}
+				_ = client.Close()
+				return
+			}
+		}
+	}()
+}
+
+// remoteHost returns the host commands run on, which is the delegate host of
+// a delegate executor
+func (e *Executor) remoteHost() types.Host {
+	if e.conn == nil {
+		return e.Host
+	}
+	return e.conn.host
+}
+
+// newSession opens a session on the connection of the host. A connection
+// found lost is replaced before the session is opened again.
+func (e *Executor) newSession() (*ssh.Session, error) {
+	client := e.conn.Client()
+	if client == nil {
+		return nil, fmt.Errorf("not connected to %s", e.remoteHost().Name)
+	}
+
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+
+	// The server refused the session, the connection itself is fine
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return nil, err
+	}
+
+	if client, err = e.conn.reconnect(e.taskContext(), client, e); err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
+// logVerbose logs a message about the host in verbose mode
+func (e *Executor) logVerbose(format string, args ...interface{}) {
+	if !types.ExecOptions.Verbose {
+		return
+	}
+	writer := e.OutputWriter
+	if writer == nil {
+		writer = os.Stdout
+	}
+	e.mu.Lock()
+	log.SetOutput(writer)
+	log.Printf("[VERBOSE] [%s] "+format, append([]interface{}{e.Host.Name}, args...)...)
+	log.SetOutput(os.Stderr)
+	e.mu.Unlock()
+}
@@ -0,0 +1,608 @@
+package executor
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// testSSHServer is an in-process SSH server running exec requests through a
+// handler, which can drop its connections to simulate a network failure
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	handler  func(cmd string) (string, uint32)
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	dialed int
+	closed int
+	silent bool
+
+	// noForwarding rejects direct-tcpip channels as prohibited
+	noForwarding bool
+
+	// stderr returns what a command writes to stderr
+	stderr func(cmd string) string
+
+	// refuse is the number of next connections closed before the handshake
+	refuse int
+}
+
+// newTestSSHServer starts a server accepting the password "secret" and
+// returns the inventory host to reach it
+func newTestSSHServer(t *testing.T, handler func(cmd string) (string, uint32)) (*testSSHServer, types.Host) {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := &testSSHServer{listener: listener, config: config, hostKey: signer.PublicKey(), handler: handler}
+	go s.serve()
+	t.Cleanup(s.close)
+
+	strict := false
+	host := types.Host{
+		Name:               "test",
+		Address:            "127.0.0.1",
+		Port:               listener.Addr().(*net.TCPAddr).Port,
+		User:               "test",
+		Password:           "secret",
+		StrictHostKeyCheck: &strict,
+	}
+	return s, host
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.dialed++
+		refused := s.refuse > 0
+		if refused {
+			s.refuse--
+		}
+		s.mu.Unlock()
+		if refused {
+			_ = conn.Close()
+			continue
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSSHServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	go func() {
+		for req := range reqs {
+			s.mu.Lock()
+			silent := s.silent
+			s.mu.Unlock()
+			if !silent && req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+
+	defer func() {
+		s.mu.Lock()
+		s.closed++
+		s.mu.Unlock()
+	}()
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go s.forward(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(channel, requests)
+	}
+}
+
+func (s *testSSHServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+
+		cmd := string(req.Payload[4:])
+		_ = req.Reply(true, nil)
+
+		// The input is read before answering, so uploads are not cut short
+		drained := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, channel)
+			close(drained)
+		}()
+		output, status := s.handler(cmd)
+		<-drained
+		s.mu.Lock()
+		stderr := s.stderr
+		s.mu.Unlock()
+		if stderr != nil {
+			_, _ = channel.Stderr().Write([]byte(stderr(cmd)))
+		}
+		_, _ = channel.Write([]byte(output))
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, status)
+		_, _ = channel.SendRequest("exit-status", false, payload)
+		return
+	}
+}
+
+// forward connects a direct-tcpip channel to its destination, as a jump host
+// does
+func (s *testSSHServer) forward(newChannel ssh.NewChannel) {
+	s.mu.Lock()
+	noForwarding := s.noForwarding
+	s.mu.Unlock()
+	if noForwarding {
+		_ = newChannel.Reject(ssh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	var dest struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &dest); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid destination")
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	go func() {
+		_, _ = io.Copy(target, channel)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(channel, target)
+	_ = channel.Close()
+}
+
+// drop closes every open connection, as a network failure would
+func (s *testSSHServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+// connections returns the number of connections accepted so far
+func (s *testSSHServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialed
+}
+
+// open returns the number of connections the clients did not close yet
+func (s *testSSHServer) open() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialed - s.closed
+}
+
+func (s *testSSHServer) close() {
+	_ = s.listener.Close()
+	s.drop()
+}
+
+func echoHandler(cmd string) (string, uint32) {
+	if strings.HasPrefix(cmd, "echo ") {
+		return strings.TrimPrefix(cmd, "echo ") + "\n", 0
+	}
+	return "", 127
+}
+
+// waitClosed waits until the client is closed, or fails the test
+func waitClosed(t *testing.T, client *ssh.Client, timeout time.Duration) {
+	t.Helper()
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(timeout):
+		t.Fatalf("connection still open after %s", timeout)
+	}
+}
+
+func TestExecutor_ReconnectAfterConnectionLoss(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+
+	if output, err := exec.executeCommand("echo before", false); err != nil || output != "before\n" {
+		t.Fatalf("executeCommand() = %q, %v", output, err)
+	}
+
+	lost := exec.conn.Client()
+	server.drop()
+	waitClosed(t, lost, 5*time.Second)
+
+	if output, err := exec.executeCommand("echo after", false); err != nil || output != "after\n" {
+		t.Fatalf("executeCommand() after the connection loss = %q, %v", output, err)
+	}
+	if exec.conn.Client() == lost {
+		t.Error("the lost client was not replaced")
+	}
+	if n := server.connections(); n != 2 {
+		t.Errorf("connections = %d, want 2", n)
+	}
+}
+
+func TestConnection_ReconnectShared(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+
+	conn, err := dialConnection(host)
+	if err != nil {
+		t.Fatalf("dialConnection() error = %v", err)
+	}
+	defer conn.Close()
+
+	// Two users finding the same client lost open a single new connection
+	lost := conn.Client()
+	server.drop()
+	waitClosed(t, lost, 5*time.Second)
+
+	e := &Executor{Host: host}
+	first, err := conn.reconnect(context.Background(), lost, e)
+	if err != nil {
+		t.Fatalf("reconnect() error = %v", err)
+	}
+	second, err := conn.reconnect(context.Background(), lost, e)
+	if err != nil {
+		t.Fatalf("reconnect() error = %v", err)
+	}
+	if first != second {
+		t.Error("second reconnect() opened another connection")
+	}
+	if n := server.connections(); n != 2 {
+		t.Errorf("connections = %d, want 2", n)
+	}
+}
+
+func TestConnection_ReconnectCanceled(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+
+	conn, err := dialConnection(host)
+	if err != nil {
+		t.Fatalf("dialConnection() error = %v", err)
+	}
+	defer conn.Close()
+
+	lost := conn.Client()
+	server.close()
+	waitClosed(t, lost, 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := conn.reconnect(ctx, lost, &Executor{Host: host}); err == nil {
+		t.Error("reconnect() to a stopped server succeeded")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("reconnect() did not stop when the context expired")
+	}
+}
+
+func TestConnection_ReconnectBackoff(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+
+	conn, err := dialConnection(host)
+	if err != nil {
+		t.Fatalf("dialConnection() error = %v", err)
+	}
+	defer conn.Close()
+
+	// The first attempt fails while the host comes back, without any
+	// connect_retries set
+	lost := conn.Client()
+	server.mu.Lock()
+	server.refuse = 1
+	server.mu.Unlock()
+	server.drop()
+	waitClosed(t, lost, 5*time.Second)
+
+	start := time.Now()
+	client, err := conn.reconnect(context.Background(), lost, &Executor{Host: host})
+	if err != nil {
+		t.Fatalf("reconnect() error = %v", err)
+	}
+	if client == lost || conn.Client() != client {
+		t.Error("reconnect() did not swap in a new client")
+	}
+	if elapsed := time.Since(start); elapsed < reconnectDelay {
+		t.Errorf("reconnect() returned after %s, want the backoff delay before the second attempt", elapsed)
+	}
+	if n := server.connections(); n != 3 {
+		t.Errorf("connections = %d, want 3", n)
+	}
+}
+
+func TestConnection_ReconnectOutsideLock(t *testing.T) {
+	defer func(delay time.Duration) { reconnectDelay = delay }(reconnectDelay)
+	reconnectDelay = 50 * time.Millisecond
+
+	server, host := newTestSSHServer(t, echoHandler)
+
+	conn, err := dialConnection(host)
+	if err != nil {
+		t.Fatalf("dialConnection() error = %v", err)
+	}
+	defer conn.Close()
+
+	lost := conn.Client()
+	server.close()
+	waitClosed(t, lost, 5*time.Second)
+
+	// The first user dials with backoff, the second one waits for it and
+	// gets its result
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := conn.reconnect(context.Background(), lost, &Executor{Host: host})
+			errs <- err
+		}()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	if client := conn.Client(); client != lost {
+		t.Error("Client() changed before the reconnection finished")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Client() blocked for %s during the reconnection", elapsed)
+	}
+
+	first, second := <-errs, <-errs
+	if first == nil || !strings.Contains(first.Error(), "failed to reconnect: failed to dial after 5 attempts") {
+		t.Errorf("reconnect() error = %v, want 5 failed attempts", first)
+	}
+	if second != first {
+		t.Errorf("reconnect() errors = %v and %v, want the one of the single dial", first, second)
+	}
+}
+
+func TestConnection_KeepaliveClosesDeadConnection(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+	host.KeepaliveInterval = 1
+	host.KeepaliveCountMax = 2
+
+	conn, err := dialConnection(host)
+	if err != nil {
+		t.Fatalf("dialConnection() error = %v", err)
+	}
+	defer conn.Close()
+
+	// The server stops answering without closing the connection
+	server.mu.Lock()
+	server.silent = true
+	server.mu.Unlock()
+
+	waitClosed(t, conn.Client(), 10*time.Second)
+}
+
+func TestDialHost_RetriesNetworkFailures(t *testing.T) {
+	// A closed listener leaves a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+
+	strict := false
+	host := types.Host{
+		Name:               "down",
+		Address:            "127.0.0.1",
+		Port:               port,
+		User:               "test",
+		Password:           "secret",
+		StrictHostKeyCheck: &strict,
+		ConnectRetries:     2,
+		ConnectRetryDelay:  1,
+	}
+
+	start := time.Now()
+	_, err = dialHost(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "failed to dial after 3 attempts") {
+		t.Errorf("dialHost() error = %v, want a failure after 3 attempts", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("dialHost() returned after %s, want the retry delay between attempts", elapsed)
+	}
+}
+
+func TestDialHost_AuthFailureNotRetried(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+	host.Password = "wrong"
+	host.ConnectRetries = 3
+
+	_, err := dialHost(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("dialHost() error = %v, want an authentication failure", err)
+	}
+	if n := server.connections(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
+
+func TestSSHClientConfig_ConnectTimeout(t *testing.T) {
+	strict := false
+	host := types.Host{Name: "web1", Address: "127.0.0.1", User: "test", Password: "secret", StrictHostKeyCheck: &strict}
+
+	config, _, err := sshClientConfig(host)
+	if err != nil {
+		t.Fatalf("sshClientConfig() error = %v", err)
+	}
+	if config.Timeout != defaultConnectTimeout {
+		t.Errorf("Timeout = %s, want %s", config.Timeout, defaultConnectTimeout)
+	}
+
+	host.ConnectTimeout = 3
+	if config, _, err = sshClientConfig(host); err != nil {
+		t.Fatalf("sshClientConfig() error = %v", err)
+	}
+	if config.Timeout != 3*time.Second {
+		t.Errorf("Timeout = %s, want 3s", config.Timeout)
+	}
+}
+
+func TestSSHClientConfig_KeyLoadedOnce(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("MarshalPrivateKeyWithPassphrase() error = %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	strict := false
+	host := types.Host{Name: "web1", Address: "127.0.0.1", User: "test", KeyFile: keyFile, KeyPassword: "passphrase", StrictHostKeyCheck: &strict}
+	if _, _, err := sshClientConfig(host); err != nil {
+		t.Fatalf("sshClientConfig() error = %v", err)
+	}
+
+	// A reconnection neither reads the key again nor asks for its passphrase
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatalf("Failed to remove key: %v", err)
+	}
+	host.KeyPassword = ""
+	config, _, err := sshClientConfig(host)
+	if err != nil {
+		t.Fatalf("sshClientConfig() after the first dial error = %v", err)
+	}
+	if len(config.Auth) != 1 {
+		t.Errorf("Auth = %d methods, want the key only", len(config.Auth))
+	}
+}
+
+func TestDialHost_ProxyJump(t *testing.T) {
+	jumpServer, jump := newTestSSHServer(t, echoHandler)
+	target, host := newTestSSHServer(t, echoHandler)
+	host.Jumps = []types.Host{jump}
+
+	client, err := dialHost(context.Background(), host)
+	if err != nil {
+		t.Fatalf("dialHost() error = %v", err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession() error = %v", err)
+	}
+	output, err := session.Output("echo through")
+	_ = session.Close()
+	if err != nil || string(output) != "through\n" {
+		t.Errorf("Output() = %q, %v", output, err)
+	}
+	if jumpServer.connections() != 1 || target.connections() != 1 {
+		t.Errorf("connections = %d to the jump host, %d to the target, want 1 each", jumpServer.connections(), target.connections())
+	}
+
+	// Closing the connection closes the one to the jump host
+	_ = client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for jumpServer.open() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection to the jump host is still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDialHost_ProxyJumpFailure(t *testing.T) {
+	_, jump := newTestSSHServer(t, echoHandler)
+	_, host := newTestSSHServer(t, echoHandler)
+	jump.Password = "wrong"
+	host.Jumps = []types.Host{jump}
+	host.ConnectRetries = 2
+
+	_, err := dialHost(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "authentication failed: jump host 'test'") {
+		t.Errorf("dialHost() error = %v, want an authentication failure on the jump host", err)
+	}
+}
@@ -0,0 +1,114 @@
+package executor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/fgouteroux/sshot/pkg/config"
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// delegateConnections holds the connections opened to delegate hosts. They are
+// shared by every host delegating to them and stay open until the end of the
+// run.
+var delegateConnections = struct {
+	sync.Mutex
+	conns map[string]*connection
+}{conns: make(map[string]*connection)}
+
+// isDelegated reports whether a task runs on another inventory host
+func (e *Executor) isDelegated(task types.Task) bool {
+	return task.DelegateTo != "" && task.DelegateTo != e.Host.Name && task.DelegateTo != "localhost"
+}
+
+// outputMutex serializes the output of an executor. A delegate executor
+// shares the one of the host it runs tasks for, as they write to the same
+// output.
+type outputMutex struct {
+	own    sync.Mutex
+	shared *sync.Mutex
+}
+
+func (m *outputMutex) mutex() *sync.Mutex {
+	if m.shared != nil {
+		return m.shared
+	}
+	return &m.own
+}
+
+func (m *outputMutex) Lock()   { m.mutex().Lock() }
+func (m *outputMutex) Unlock() { m.mutex().Unlock() }
+
+// delegateExecutor returns an executor running tasks on the delegate host.
+// Only its connection is the delegate one: the tasks are rendered with the
+// identity, variables and registers of this host, and write to its output.
+func (e *Executor) delegateExecutor(name string) (*Executor, error) {
+	if delegate, ok := e.delegates[name]; ok {
+		return delegate, nil
+	}
+
+	host, ok := config.Cache.Host(name)
+	if !ok {
+		return nil, fmt.Errorf("delegate_to host '%s' not found in inventory", name)
+	}
+
+	conn, err := delegateConnection(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to delegate host '%s': %w", name, err)
+	}
+
+	delegate := &Executor{
+		Host:           e.Host,
+		conn:           conn,
+		Variables:      e.Variables,
+		Environment:    e.Environment,
+		Registers:      e.Registers,
+		CompletedTasks: e.CompletedTasks,
+		GroupName:      e.GroupName,
+		OutputWriter:   e.OutputWriter,
+		StartTime:      e.StartTime,
+	}
+	delegate.mu.shared = e.mu.mutex()
+	if e.delegates == nil {
+		e.delegates = make(map[string]*Executor)
+	}
+	e.delegates[name] = delegate
+	return delegate, nil
+}
+
+// delegateConnection opens a connection to a delegate host, or reuses the one
+// opened by a previous delegation
+func delegateConnection(host types.Host) (*connection, error) {
+	delegateConnections.Lock()
+	defer delegateConnections.Unlock()
+
+	if conn, ok := delegateConnections.conns[host.Name]; ok {
+		return conn, nil
+	}
+
+	if types.ExecOptions.Verbose {
+		log.Printf("[VERBOSE] Connecting to delegate Host: %s", host.Name)
+	}
+
+	conn, err := dialConnection(host)
+	if err != nil {
+		return nil, err
+	}
+
+	delegateConnections.conns[host.Name] = conn
+	return conn, nil
+}
+
+// CloseDelegateConnections closes the connections opened to delegate hosts
+func CloseDelegateConnections() {
+	delegateConnections.Lock()
+	defer delegateConnections.Unlock()
+
+	for name, conn := range delegateConnections.conns {
+		if err := conn.Close(); err != nil && types.ExecOptions.Verbose {
+			log.Printf("[VERBOSE] Failed to close connection to delegate Host %s: %v", name, err)
+		}
+		delete(delegateConnections.conns, name)
+	}
+}
@@ -0,0 +1,116 @@
+package executor
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fgouteroux/sshot/pkg/config"
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestExecutor_DelegateToUnknownHost(t *testing.T) {
+	config.Cache.Set(&types.Config{
+		Inventory: types.Inventory{Hosts: []types.Host{{Name: "web1"}}},
+	})
+	defer config.Cache.Set(nil)
+
+	executor := &Executor{
+		Host:           types.Host{Name: "web1"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &bytes.Buffer{},
+	}
+
+	err := executor.ExecuteTask(types.Task{Name: "Drain", Command: "echo drain", DelegateTo: "lb1"})
+	if err == nil || err.Error() != "delegate_to host 'lb1' not found in inventory in task 'Drain'" {
+		t.Errorf("ExecuteTask() error = %v, want a not found in inventory error", err)
+	}
+}
+
+func TestExecutor_DelegateToRegistersOnHost(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "web1"},
+		Variables:      map[string]interface{}{"backend_port": port},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+	delegate := &Executor{
+		Host:           types.Host{Name: "lb1"},
+		Variables:      executor.Variables,
+		Registers:      executor.Registers,
+		CompletedTasks: executor.CompletedTasks,
+		OutputWriter:   &output,
+	}
+	executor.delegates = map[string]*Executor{"lb1": delegate}
+
+	task := types.Task{
+		Name: "Wait for the backend from the load balancer",
+		WaitFor: &types.WaitForTask{
+			Condition: "port:127.0.0.1:{{ .backend_port }}", From: "controller",
+		},
+		DelegateTo: "lb1",
+		Register:   "lb_wait",
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+
+	if !strings.Contains(output.String(), "Delegated to: lb1") {
+		t.Errorf("Output should mention the delegate host, got: %q", output.String())
+	}
+	if !strings.Contains(executor.Registers["lb_wait"], "port "+strconv.Itoa(port)) {
+		t.Errorf("Registers[lb_wait] = %q, want the wait result", executor.Registers["lb_wait"])
+	}
+	if delegate.ctx != nil {
+		t.Error("the delegate context should be released after the task")
+	}
+}
+
+func TestExecutor_DelegateKeepsHostIdentity(t *testing.T) {
+	_, lb := newTestSSHServer(t, echoHandler)
+	lb.Name = "lb1"
+	lb.RemoteTmp = "/var/tmp/lb"
+	config.Cache.Set(&types.Config{
+		Inventory: types.Inventory{Hosts: []types.Host{{Name: "web1"}, lb}},
+	})
+	defer config.Cache.Set(nil)
+	defer CloseDelegateConnections()
+
+	executor := &Executor{
+		Host:           types.Host{Name: "web1"},
+		Variables:      map[string]interface{}{"role": "web"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &bytes.Buffer{},
+	}
+	delegate, err := executor.delegateExecutor("lb1")
+	if err != nil {
+		t.Fatalf("delegateExecutor() error = %v", err)
+	}
+
+	// Templates describe the delegating host, the connection the delegate
+	data := delegate.templateData("")
+	if data["inventory_hostname"] != "web1" || data["role"] != "web" {
+		t.Errorf("delegate template data = %v, want the ones of web1", data)
+	}
+	if host := delegate.remoteHost(); host.Name != "lb1" || host.RemoteTmp != "/var/tmp/lb" {
+		t.Errorf("delegate remote host = %s (remote_tmp %s), want lb1", host.Name, host.RemoteTmp)
+	}
+	if delegate.mu.mutex() != executor.mu.mutex() {
+		t.Error("the delegate does not share the output mutex of its host")
+	}
+}
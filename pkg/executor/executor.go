@@ -1,9 +1,9 @@
 package executor
 
 import (
+	"context"
 	"net"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/knownhosts"
 	"github.com/fgouteroux/sshot/pkg/types"
 	"github.com/fgouteroux/sshot/pkg/utils"
 	"bytes"
@@ -14,33 +14,62 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 type Executor struct {
 	Host           types.Host
-	client         *ssh.Client
+	conn           *connection
 	Variables      map[string]interface{}
+	Environment    map[string]string
 	Registers      map[string]string
 	CompletedTasks map[string]bool
 	GroupName      string
-	mu             sync.Mutex
+	mu             outputMutex
 	OutputWriter   io.Writer
 	StartTime      time.Time
+
+	sftpClient      *sftp.Client
+	sftpUnavailable bool
+	sftpConn        *ssh.Client
+	sftpMu          sync.Mutex
+
+	remoteTmpDir string
+	remoteTmpMu  sync.Mutex
+
+	// ctx is the context of the running task attempt
+	ctx context.Context
+
+	// delegates are the executors of the hosts tasks are delegated to
+	delegates map[string]*Executor
 }
 
+// missingKeyPattern extracts the variable name from a missingkey=error failure
+var missingKeyPattern = regexp.MustCompile(`no entry for key "([^"]*)"`)
+
 // Singleton SSH agent client to avoid connection exhaustion
 var (
 	sshAgentOnce   sync.Once
 	sshAgentClient agent.ExtendedAgent
 )
 
+// keySigners holds the private keys already loaded, by key file, so that a
+// reconnection does not read a key again nor ask for its passphrase
+var keySigners = struct {
+	sync.Mutex
+	signers map[string]ssh.Signer
+}{signers: make(map[string]ssh.Signer)}
+
 func (e *Executor) CollectFacts(factsConfig types.FactsConfig) error {
 	writer := e.OutputWriter
 	if writer == nil {
@@ -62,28 +91,32 @@ func (e *Executor) CollectFacts(factsConfig types.FactsConfig) error {
 			utils.Color(utils.ColorCyan), utils.Color(utils.ColorReset), collector.Name)
 
 		var output string
-		var err error
+
+		command, err := e.RenderVars(collector.Command)
+		if err != nil {
+			return fmt.Errorf("%w in command of facts collector '%s'", err, collector.Name)
+		}
 
 		if types.ExecOptions.DryRun {
 			// In dry-run mode, just show what would be executed
 			fmt.Fprintf(writer, "    %s🔍 DRY-RUN:%s Would execute: %s\n",
-				utils.Color(utils.ColorYellow), utils.Color(utils.ColorReset), collector.Command)
+				utils.Color(utils.ColorYellow), utils.Color(utils.ColorReset), command)
 
 			// For testing purposes, in dry-run mode, we'll simulate JSON output
 			// This allows tests to run without an actual SSH connection
 			output = `{"simulated": "data", "dry_run": true}`
 
-			if strings.Contains(collector.Command, "echo") {
+			if strings.Contains(command, "echo") {
 				// If the command is an echo command, extract the JSON from it for testing
-				jsonStart := strings.Index(collector.Command, "echo '") + 6
-				jsonEnd := strings.LastIndex(collector.Command, "'")
+				jsonStart := strings.Index(command, "echo '") + 6
+				jsonEnd := strings.LastIndex(command, "'")
 				if jsonStart > 6 && jsonEnd > jsonStart {
-					output = collector.Command[jsonStart:jsonEnd]
+					output = command[jsonStart:jsonEnd]
 				}
 			}
 		} else {
 			// In real mode, execute the command
-			output, err = e.executeCommand(collector.Command, collector.Sudo)
+			output, err = e.executeCommand(command, collector.Sudo)
 			if err != nil {
 				return fmt.Errorf("failed to collect facts with %s: %w", collector.Name, err)
 			}
@@ -144,6 +177,12 @@ func FlattenMap(data map[string]interface{}, prefix string) map[string]string {
 }
 
 func (e *Executor) ExecuteTask(task types.Task) error {
+	return e.ExecuteTaskContext(context.Background(), task)
+}
+
+// ExecuteTaskContext executes a task until ctx is done. Each attempt is also
+// limited by the task timeout, the remote command being killed when it expires.
+func (e *Executor) ExecuteTaskContext(ctx context.Context, task types.Task) (err error) {
 	writer := e.OutputWriter
 	if writer == nil {
 		writer = os.Stdout
@@ -184,16 +223,6 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 		}
 	}
 
-	// Check for delegation - if this task is delegated to a different host,
-	// skip it unless we're the delegated host
-	if task.DelegateTo != "" && task.DelegateTo != e.Host.Name && task.DelegateTo != "localhost" {
-		e.mu.Lock()
-		fmt.Fprintf(writer, "  ↷ Skipped (delegated to: %s)\n", task.DelegateTo)
-		e.CompletedTasks[task.Name] = true
-		e.mu.Unlock()
-		return nil
-	}
-
 	// If task is delegated to localhost, treat it as a local_action
 	if task.DelegateTo == "localhost" && task.Command != "" {
 		// Convert to local_action if delegated to localhost
@@ -201,26 +230,19 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 		task.Command = ""
 	}
 
-	// Check if this is a run_once task that's already been executed
+	// Only the first host of the play and group runs a run_once task, the
+	// others wait for it and share its result
+	var runOnce *types.RunOnceResult
 	if task.RunOnce {
-		taskKey := task.Name
-		types.RunOnceTasks.RLock()
-		executed := types.RunOnceTasks.Executed[taskKey]
-		types.RunOnceTasks.RUnlock()
-
-		if executed {
-			e.mu.Lock()
-			fmt.Fprintf(writer, "  ↷ Skipped (run_once already executed)\n")
-			e.CompletedTasks[task.Name] = true
-			e.mu.Unlock()
-			return nil
+		result, first := claimRunOnce(e.runOnceKey(task), e.Host.Name)
+		if !first {
+			return e.shareRunOnce(ctx, task, result)
 		}
-
-		// Mark as executed after checking but before actually running
-		// to prevent race conditions in parallel execution
-		types.RunOnceTasks.Lock()
-		types.RunOnceTasks.Executed[taskKey] = true
-		types.RunOnceTasks.Unlock()
+		runOnce = result
+		defer func() {
+			runOnce.Err = err
+			close(runOnce.Done)
+		}()
 	}
 
 	if len(task.DependsOn) > 0 {
@@ -254,46 +276,93 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 		}
 	}
 
+	task, err = e.renderTask(task)
+	if err != nil {
+		return err
+	}
+
+	retry, err := newRetryPolicy(task)
+	if err != nil {
+		return fmt.Errorf("%w in task '%s'", err, task.Name)
+	}
+	if err := validateAsync(task); err != nil {
+		return fmt.Errorf("%w in task '%s'", err, task.Name)
+	}
+
 	var output string
-	var err error
 
 	if types.ExecOptions.DryRun {
 		e.mu.Lock()
 		fmt.Fprintf(writer, "  🔍 DRY-RUN: Would execute\n")
 
-		// Special handling for delegation
-		if task.DelegateTo != "" && task.DelegateTo != e.Host.Name && task.DelegateTo != "localhost" {
-			fmt.Fprintf(writer, "      Command: %s\n", e.SubstituteVars(task.Command))
-			fmt.Fprintf(writer, "      (would be skipped, delegated to: %s)\n", task.DelegateTo)
-			e.CompletedTasks[task.Name] = true
-			e.mu.Unlock()
-			return nil
-		}
-
 		switch {
 		case task.Command != "" && task.DelegateTo != "":
 			fmt.Fprintf(writer, "      Command: %s (delegated to: %s)\n",
-				e.SubstituteVars(task.Command), task.DelegateTo)
+				task.Command, task.DelegateTo)
 			if task.RunOnce {
 				fmt.Fprintf(writer, "      (run once)\n")
 			}
 		case task.Command != "":
-			fmt.Fprintf(writer, "      Command: %s\n", e.SubstituteVars(task.Command))
+			fmt.Fprintf(writer, "      Command: %s\n", task.Command)
 		case task.Shell != "":
-			fmt.Fprintf(writer, "      Shell: %s\n", e.SubstituteVars(task.Shell))
-		case task.Script != "":
-			fmt.Fprintf(writer, "      Script: %s\n", task.Script)
+			fmt.Fprintf(writer, "      Shell: %s\n", task.Shell)
+			if task.Executable != "" {
+				fmt.Fprintf(writer, "      Executable: %s\n", task.Executable)
+			}
+		case task.Script != nil:
+			fmt.Fprintf(writer, "      Script: %s\n", strings.Join(append([]string{task.Script.Path}, task.Script.Args...), " "))
+			if task.Script.Interpreter != "" {
+				fmt.Fprintf(writer, "      Interpreter: %s\n", task.Script.Interpreter)
+			}
 		case task.LocalAction != "":
-			fmt.Fprintf(writer, "      Local Action: %s\n", e.SubstituteVars(task.LocalAction))
+			fmt.Fprintf(writer, "      Local Action: %s\n", task.LocalAction)
 			if task.RunOnce {
 				fmt.Fprintf(writer, "      (run once)\n")
 			}
 		case task.Copy != nil:
-			fmt.Fprintf(writer, "      Copy: %s → %s\n", task.Copy.Src, e.SubstituteVars(task.Copy.Dest))
+			fmt.Fprintf(writer, "      Copy: %s → %s\n", task.Copy.Src, task.Copy.Dest)
+		case task.Template != nil:
+			fmt.Fprintf(writer, "      Template: %s → %s\n", task.Template.Src, task.Template.Dest)
+		case task.Sync != nil:
+			fmt.Fprintf(writer, "      Sync: %s → %s\n", task.Sync.Src, task.Sync.Dest)
+			if task.Sync.Delete {
+				fmt.Fprintf(writer, "      (deleting remote files missing locally)\n")
+			}
+		case task.Fetch != nil:
+			fmt.Fprintf(writer, "      Fetch: %s → %s\n", task.Fetch.Src, task.Fetch.Dest)
+		case task.WaitFor != nil:
+			fmt.Fprintf(writer, "      Wait for: %s\n", describeWaitFor(task.WaitFor))
+		case task.AsyncStatus != nil:
+			fmt.Fprintf(writer, "      Async status: %s\n", task.AsyncStatus.Jid)
+		case task.Reboot != nil:
+			fmt.Fprintf(writer, "      Reboot: %s\n", describeReboot(task.Reboot))
+		}
+		if task.Async > 0 {
+			fmt.Fprintf(writer, "      Async: %ds (poll: %s)\n", task.Async, asyncPoll(task))
+		}
+		if task.DelegateTo != "" && task.Command == "" {
+			fmt.Fprintf(writer, "      (delegated to: %s)\n", task.DelegateTo)
 		}
 		if task.Sudo {
 			fmt.Fprintf(writer, "      (with sudo)\n")
 		}
+		if env := e.taskEnvironment(task); len(env) > 0 {
+			names := make([]string, 0, len(env))
+			for name := range env {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			fmt.Fprintf(writer, "      Environment: %s\n", strings.Join(names, ", "))
+		}
+		if task.Stdin != "" {
+			fmt.Fprintf(writer, "      Stdin: %d bytes\n", len(task.Stdin))
+		}
+		if task.Chdir != "" {
+			fmt.Fprintf(writer, "      Chdir: %s\n", task.Chdir)
+		}
+		if task.Umask != "" {
+			fmt.Fprintf(writer, "      Umask: %s\n", task.Umask)
+		}
 
 		if len(task.AllowedExitCodes) > 0 {
 			fmt.Fprintf(writer, "      Allowed exit codes: %v\n", task.AllowedExitCodes)
@@ -302,8 +371,8 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 		if len(task.DependsOn) > 0 {
 			fmt.Fprintf(writer, "      Dependencies: %v\n", task.DependsOn)
 		}
-		if task.Retries > 0 {
-			fmt.Fprintf(writer, "      Retries: %d (delay: %ds)\n", task.Retries, task.RetryDelay)
+		if retry.Retries > 0 {
+			fmt.Fprintf(writer, "      Retries: %s\n", retry)
 		}
 		if task.Timeout > 0 {
 			fmt.Fprintf(writer, "      Timeout: %ds\n", task.Timeout)
@@ -313,35 +382,80 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 		return nil
 	}
 
-	// Execute with retry logic
-	retries := task.Retries
-	if retries == 0 && task.UntilSuccess {
-		retries = 60 // Default max retries for until_success
+	// In check mode only copy, template, sync and fetch tasks are evaluated, since
+	// they can report changes without applying them
+	if types.ExecOptions.Check && task.Copy == nil && task.Template == nil && task.Sync == nil && task.Fetch == nil {
+		e.mu.Lock()
+		fmt.Fprintf(writer, "  🔍 CHECK: Would execute (skipped in check mode)\n")
+		e.CompletedTasks[task.Name] = true
+		e.mu.Unlock()
+		return nil
+	}
+
+	if task.Shell != "" {
+		task.Shell = buildShellCommand(task.Shell, task.Executable, task.Pipefail == nil || *task.Pipefail)
+	}
+
+	// Apply the environment, working directory and umask to remote commands
+	for _, cmd := range []*string{&task.Command, &task.Shell} {
+		if *cmd == "" {
+			continue
+		}
+		if *cmd, err = buildRemoteCommand(*cmd, e.taskEnvironment(task), task.Chdir, task.Umask); err != nil {
+			return fmt.Errorf("%w in task '%s'", err, task.Name)
+		}
 	}
-	retryDelay := time.Duration(task.RetryDelay) * time.Second
-	if retryDelay == 0 && retries > 0 {
-		retryDelay = 5 * time.Second // Default retry delay
+	if task.Script != nil {
+		scriptTask := *task.Script
+		scriptTask.Env = mergeEnvironment(e.taskEnvironment(task), scriptTask.Env)
+		if scriptTask.Chdir == "" {
+			scriptTask.Chdir = task.Chdir
+		}
+		task.Script = &scriptTask
 	}
 
-	timeout := time.Duration(task.Timeout) * time.Second
-	var timeoutTimer *time.Timer
-	var timeoutChan <-chan time.Time
-	if timeout > 0 {
-		timeoutTimer = time.NewTimer(timeout)
-		timeoutChan = timeoutTimer.C
-		defer timeoutTimer.Stop()
+	if err := ctx.Err(); err != nil {
+		return contextError(ctx)
 	}
 
+	// Delegated tasks run on the delegate host, with the variables of this host
+	target := e
+	if e.isDelegated(task) {
+		if task.Reboot != nil {
+			return fmt.Errorf("reboot cannot be delegated in task '%s'", task.Name)
+		}
+		if target, err = e.delegateExecutor(task.DelegateTo); err != nil {
+			return fmt.Errorf("%w in task '%s'", err, task.Name)
+		}
+		e.mu.Lock()
+		fmt.Fprintf(writer, "  ↪ Delegated to: %s\n", task.DelegateTo)
+		e.mu.Unlock()
+	}
+	defer func() {
+		target.ctx = nil
+	}()
+
+	// Execute with retry logic
 	attempt := 0
-	maxAttempts := retries + 1
+	maxAttempts := retry.Retries + 1
 
 	for {
 		attempt++
 
+		// Each attempt runs with its own deadline
+		attemptCtx, cancel := attemptContext(ctx, task.Timeout)
+		target.ctx = attemptCtx
+
 		// Execute the task
 		switch {
+		case task.Async > 0:
+			cmd := task.Command
+			if cmd == "" {
+				cmd = task.Shell
+			}
+			output, err = target.executeAsync(cmd, task.Async, asyncPoll(task), task.Sudo)
 		case task.Command != "":
-			output, err = e.executeCommand(task.Command, task.Sudo)
+			output, err = target.executeCommandInput(task.Command, taskStdin(task), task.Sudo)
 			// Check if the exit code is allowed
 			if err != nil && len(task.AllowedExitCodes) > 0 {
 				if types.ExecOptions.Verbose {
@@ -365,7 +479,7 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 				}
 			}
 		case task.Shell != "":
-			output, err = e.executeCommand(task.Shell, task.Sudo)
+			output, err = target.executeCommandInput(task.Shell, taskStdin(task), task.Sudo)
 			// Check if the exit code is allowed
 			if err != nil && len(task.AllowedExitCodes) > 0 {
 				if types.ExecOptions.Verbose {
@@ -388,8 +502,8 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 					err = nil
 				}
 			}
-		case task.Script != "":
-			output, err = e.executeScript(task.Script, task.Sudo)
+		case task.Script != nil:
+			output, err = target.executeScript(task.Script, task.Sudo, task.Umask, task.Name)
 			// Check if the exit code is allowed
 			if err != nil && len(task.AllowedExitCodes) > 0 {
 				if types.ExecOptions.Verbose {
@@ -413,31 +527,7 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 				}
 			}
 		case task.LocalAction != "":
-			output, err = e.executeLocalAction(task.LocalAction)
-			// Check if the exit code is allowed
-			if err != nil && len(task.AllowedExitCodes) > 0 {
-				if types.ExecOptions.Verbose {
-					e.mu.Lock()
-					log.SetOutput(writer)
-					log.Printf("[VERBOSE] [%s] Command failed with error: %v", e.Host.Name, err)
-					log.Printf("[VERBOSE] [%s] Checking against allowed exit codes: %v", e.Host.Name, task.AllowedExitCodes)
-					log.SetOutput(os.Stderr)
-					e.mu.Unlock()
-				}
-
-				if e.isAllowedExitCode(err, task.AllowedExitCodes) {
-					if types.ExecOptions.Verbose {
-						e.mu.Lock()
-						log.SetOutput(writer)
-						log.Printf("[VERBOSE] [%s] Exit code is in allowed list, treating as success", e.Host.Name)
-						log.SetOutput(os.Stderr)
-						e.mu.Unlock()
-					}
-					err = nil
-				}
-			}
-		case task.Command != "" && task.DelegateTo != "":
-			output, err = e.executeDelegated(task.Command, task.DelegateTo)
+			output, err = target.executeLocalAction(task.LocalAction)
 			// Check if the exit code is allowed
 			if err != nil && len(task.AllowedExitCodes) > 0 {
 				if types.ExecOptions.Verbose {
@@ -461,12 +551,24 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 				}
 			}
 		case task.Copy != nil:
-			output, err = e.executeCopy(task.Copy)
-		case task.WaitFor != "":
-			output, err = e.executeWaitFor(task.WaitFor)
+			output, err = target.executeCopy(task.Copy, task.Sudo)
+		case task.Template != nil:
+			output, err = target.executeTemplate(task.Template, task.Sudo, task.Name)
+		case task.Sync != nil:
+			output, err = target.executeSync(task.Sync, task.Sudo)
+		case task.Fetch != nil:
+			output, err = target.executeFetch(task.Fetch, task.Sudo)
+		case task.WaitFor != nil:
+			output, err = target.executeWaitFor(task.WaitFor, task.Sudo)
+		case task.AsyncStatus != nil:
+			output, err = target.executeAsyncStatus(task.AsyncStatus)
+		case task.Reboot != nil:
+			output, err = target.executeReboot(task.Reboot, task.Sudo)
 		default:
+			cancel()
 			return fmt.Errorf("no executable task type defined")
 		}
+		cancel()
 
 		// Success!
 		if err == nil {
@@ -478,24 +580,19 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 			break
 		}
 
-		// Check timeout
-		if timeoutChan != nil {
-			select {
-			case <-timeoutChan:
-				e.mu.Lock()
-				fmt.Fprintf(writer, "  ✗ Timeout after %d seconds (attempted %d times)\n", task.Timeout, attempt)
-				e.mu.Unlock()
-				return fmt.Errorf("timeout after %d seconds: %w", task.Timeout, err)
-			default:
-			}
+		if attemptCtx.Err() != nil && ctx.Err() == nil {
+			e.mu.Lock()
+			fmt.Fprintf(writer, "  ✗ Attempt %d/%d timed out after %d seconds\n", attempt, maxAttempts, task.Timeout)
+			e.mu.Unlock()
 		}
 
-		// Check if we should retry
-		if attempt >= maxAttempts {
+		// Check if we should retry, unless the host ran out of time
+		if attempt >= maxAttempts || ctx.Err() != nil {
 			break
 		}
 
 		// Log retry attempt
+		retryDelay := retry.delay(attempt)
 		if types.ExecOptions.Verbose {
 			e.mu.Lock()
 			log.SetOutput(writer)
@@ -505,28 +602,27 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 			e.mu.Unlock()
 		} else {
 			e.mu.Lock()
-			fmt.Fprintf(writer, "  ⟳ Attempt %d/%d failed, retrying in %v...\n", attempt, maxAttempts, retryDelay)
+			fmt.Fprintf(writer, "  ⟳ Attempt %d/%d failed, retrying in %v...\n", attempt, maxAttempts, retryDelay.Round(100*time.Millisecond))
 			e.mu.Unlock()
 		}
 
-		// Wait before retry (but check for timeout)
-		if timeoutChan != nil {
-			select {
-			case <-timeoutChan:
-				e.mu.Lock()
-				fmt.Fprintf(writer, "  ✗ Timeout after %d seconds\n", task.Timeout)
-				e.mu.Unlock()
-				return fmt.Errorf("timeout after %d seconds: %w", task.Timeout, err)
-			case <-time.After(retryDelay):
-			}
-		} else {
-			time.Sleep(retryDelay)
+		// Wait before retry (but stop when the host runs out of time)
+		select {
+		case <-ctx.Done():
+			err = fmt.Errorf("%w: %w", contextError(ctx), err)
+		case <-time.After(retryDelay):
+			continue
 		}
+		break
 	}
 
 	if task.Register != "" {
 		e.Registers[task.Register] = output
 		e.Variables[task.Register] = output
+		if runOnce != nil {
+			runOnce.Output = output
+			runOnce.Registered = true
+		}
 		if types.ExecOptions.Verbose {
 			e.mu.Lock()
 			log.SetOutput(writer)
@@ -570,14 +666,20 @@ func (e *Executor) ExecuteTask(task types.Task) error {
 }
 
 func (e *Executor) executeCommand(cmd string, sudo bool) (string, error) {
+	return e.executeCommandInput(cmd, nil, sudo)
+}
+
+// executeCommandInput runs a remote command fed with stdin, when not nil
+func (e *Executor) executeCommandInput(cmd string, stdin io.Reader, sudo bool) (string, error) {
 	writer := e.OutputWriter
 	if writer == nil {
 		writer = os.Stdout
 	}
 
-	cmd = e.SubstituteVars(cmd)
-
-	if sudo {
+	if sudo && stdin != nil {
+		// sudo -S would read a password prompt answer from the task input
+		cmd = "sudo -n " + cmd
+	} else if sudo {
 		cmd = "sudo -S " + cmd
 	}
 
@@ -610,22 +712,35 @@ func (e *Executor) executeCommand(cmd string, sudo bool) (string, error) {
 		return "DRY-RUN: Command would execute", nil
 	}
 
-	session, err := e.client.NewSession()
+	// Record the remote pid so the command can be killed on timeout
+	pidFile := e.remotePidFile()
+	if pidFile != "" {
+		cmd = pidFileCommand(cmd, pidFile)
+	}
+
+	session, err := e.newSession()
 	if err != nil {
 		return "", fmt.Errorf("failed to create session: %w", err)
 	}
 	defer session.Close()
 
+	if stdin != nil {
+		session.Stdin = stdin
+	}
+
 	// Check if we should stream output in real-time
 	if types.ExecOptions.Progress {
-		return e.executeCommandStreaming(session, cmd, writer)
+		return e.executeCommandStreaming(session, cmd, writer, pidFile, sudo)
 	}
 
-	var stdout, stderr bytes.Buffer
+	var stdout, stderr syncBuffer
 	session.Stdout = &stdout
 	session.Stderr = &stderr
 
-	err = session.Run(cmd)
+	if err := session.Start(cmd); err != nil {
+		return "", fmt.Errorf("failed to start command: %w", err)
+	}
+	err = e.waitSession(session, pidFile, sudo)
 	output := stdout.String()
 	if stderr.Len() > 0 {
 		output += "\nSTDERR: " + stderr.String()
@@ -646,8 +761,8 @@ func (e *Executor) executeCommand(cmd string, sudo bool) (string, error) {
 	return output, nil
 }
 
-func (e *Executor) executeCommandStreaming(session *ssh.Session, cmd string, writer io.Writer) (string, error) {
-	var outputBuf bytes.Buffer
+func (e *Executor) executeCommandStreaming(session *ssh.Session, cmd string, writer io.Writer, pidFile string, sudo bool) (string, error) {
+	var outputBuf syncBuffer
 
 	// Create pipes for stdout and stderr
 	stdout, err := session.StdoutPipe()
@@ -724,7 +839,7 @@ func (e *Executor) executeCommandStreaming(session *ssh.Session, cmd string, wri
 	}()
 
 	// Wait for command to complete
-	cmdErr := session.Wait()
+	cmdErr := e.waitSession(session, pidFile, sudo)
 
 	// Wait for all output to be read
 	wg.Wait()
@@ -738,197 +853,215 @@ func (e *Executor) executeCommandStreaming(session *ssh.Session, cmd string, wri
 	return output, nil
 }
 
-func (e *Executor) executeScript(scriptPath string, sudo bool) (string, error) {
-	script, err := os.ReadFile(filepath.Clean(scriptPath))
+// SubstituteVars renders text leniently: undefined variables render as
+// "<no value>" and invalid templates are returned unchanged. It is meant for
+// display and conditions; task fields are rendered with RenderVars.
+func (e *Executor) SubstituteVars(text string) string {
+	tmpl, err := template.New("vars").Funcs(e.templateFuncMap()).Parse(text)
 	if err != nil {
-		return "", fmt.Errorf("failed to read script: %w", err)
+		return text
 	}
 
-	scriptContent := e.SubstituteVars(string(script))
-
-	session, err := e.client.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("failed to create session: %w", err)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, e.templateData(text)); err != nil {
+		return text
 	}
-	defer session.Close()
-
-	tmpFile := fmt.Sprintf("/tmp/script_%d.sh", time.Now().Unix())
-	cmd := fmt.Sprintf("cat > %s && chmod +x %s", tmpFile, tmpFile)
 
-	stdin, err := session.StdinPipe()
-	if err != nil {
-		return "", err
-	}
+	return buf.String()
+}
 
-	if err := session.Start(cmd); err != nil {
-		return "", err
+// RenderVars renders text with the executor variables. In strict mode (the
+// default) a reference to an undefined variable or a failing template is an
+// error instead of silently producing "<no value>".
+func (e *Executor) RenderVars(text string) (string, error) {
+	if types.ExecOptions.NoStrictVars {
+		return e.SubstituteVars(text), nil
 	}
 
-	_, err = io.WriteString(stdin, scriptContent)
+	tmpl, err := template.New("vars").Funcs(e.templateFuncMap()).Option("missingkey=error").Parse(text)
 	if err != nil {
-		return "", fmt.Errorf("failed to write script content into stdin: %w", err)
-	}
-
-	// Close stdin to signal EOF
-	if err := stdin.Close(); err != nil {
-		return "", fmt.Errorf("failed to close stdin: %w", err)
+		return "", fmt.Errorf("invalid template: %w", err)
 	}
 
-	if err := session.Wait(); err != nil {
-		return "", fmt.Errorf("failed to upload script: %w", err)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, e.templateData(text)); err != nil {
+		return "", hostvarsError(text, templateExecError(err))
 	}
 
-	execCmd := tmpFile
-	if sudo {
-		execCmd = "sudo " + tmpFile
-	}
+	return buf.String(), nil
+}
 
-	output, err := e.executeCommand(execCmd, false)
-	if err != nil {
-		return "", fmt.Errorf("failed to execute script: %w", err)
+// templateExecError turns a template execution failure into a readable error,
+// naming the variable when it is undefined
+func templateExecError(err error) error {
+	if m := missingKeyPattern.FindStringSubmatch(err.Error()); m != nil {
+		return fmt.Errorf("undefined variable '%s'", m[1])
 	}
+	return fmt.Errorf("template error: %w", err)
+}
 
-	_, err = e.executeCommand(fmt.Sprintf("rm -f %s", tmpFile), false)
+// renderField renders a task field, naming the field and task on failure
+func (e *Executor) renderField(taskName, field, text string) (string, error) {
+	rendered, err := e.RenderVars(text)
 	if err != nil {
-		return "", fmt.Errorf("failed to cleanup script: %w", err)
+		return "", fmt.Errorf("%w in %s of task '%s'", err, field, taskName)
 	}
-
-	return output, err
+	return rendered, nil
 }
 
-func (e *Executor) executeCopy(copyTask *types.CopyTask) (string, error) {
-	content, err := os.ReadFile(copyTask.Src)
-	if err != nil {
-		return "", fmt.Errorf("failed to read source file: %w", err)
+// renderTask returns a copy of the task with its templated fields rendered
+func (e *Executor) renderTask(task types.Task) (types.Task, error) {
+	var err error
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"shell", &task.Shell},
+		{"stdin", &task.Stdin},
+		{"local_action", &task.LocalAction},
+	}
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+		if *f.value, err = e.renderField(task.Name, f.name, *f.value); err != nil {
+			return task, err
+		}
 	}
 
-	contentStr := e.SubstituteVars(string(content))
-
-	session, err := e.client.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("failed to create session: %w", err)
+	if task.Command != "" {
+		if task.Command, err = e.renderCommand(task.Name, task.Command); err != nil {
+			return task, err
+		}
 	}
-	defer session.Close()
 
-	dest := e.SubstituteVars(copyTask.Dest)
-	cmd := fmt.Sprintf("cat > %s", dest)
+	if task.Chdir != "" {
+		if task.Chdir, err = e.renderField(task.Name, "chdir", task.Chdir); err != nil {
+			return task, err
+		}
+	}
 
-	stdin, err := session.StdinPipe()
-	if err != nil {
-		return "", err
+	// The play environment is rendered along with the task one, which overrides it
+	if taskEnv := e.taskEnvironment(task); len(taskEnv) > 0 {
+		env := make(map[string]string, len(taskEnv))
+		for name, value := range taskEnv {
+			if env[name], err = e.renderField(task.Name, "environment "+name, value); err != nil {
+				return task, err
+			}
+		}
+		task.Environment = env
 	}
 
-	if err := session.Start(cmd); err != nil {
-		return "", err
+	if task.Script != nil {
+		scriptTask, err := e.renderScriptTask(task.Name, *task.Script)
+		if err != nil {
+			return task, err
+		}
+		task.Script = &scriptTask
 	}
 
-	_, err = io.WriteString(stdin, contentStr)
-	if err != nil {
-		return "", fmt.Errorf("failed to write file content into stdin: %w", err)
+	if task.Copy != nil {
+		copyTask := *task.Copy
+		if copyTask.Src, err = e.renderField(task.Name, "copy src", copyTask.Src); err != nil {
+			return task, err
+		}
+		if copyTask.Dest, err = e.renderField(task.Name, "copy dest", copyTask.Dest); err != nil {
+			return task, err
+		}
+		task.Copy = &copyTask
 	}
 
-	// Close stdin to signal EOF
-	if err := stdin.Close(); err != nil {
-		return "", fmt.Errorf("failed to close stdin: %w", err)
+	if task.Template != nil {
+		tmplTask := *task.Template
+		if tmplTask.Src, err = e.renderField(task.Name, "template src", tmplTask.Src); err != nil {
+			return task, err
+		}
+		if tmplTask.Dest, err = e.renderField(task.Name, "template dest", tmplTask.Dest); err != nil {
+			return task, err
+		}
+		task.Template = &tmplTask
 	}
 
-	if err := session.Wait(); err != nil {
-		return "", fmt.Errorf("failed to copy file: %w", err)
+	if task.Sync != nil {
+		syncTask := *task.Sync
+		if syncTask.Src, err = e.renderField(task.Name, "sync src", syncTask.Src); err != nil {
+			return task, err
+		}
+		if syncTask.Dest, err = e.renderField(task.Name, "sync dest", syncTask.Dest); err != nil {
+			return task, err
+		}
+		task.Sync = &syncTask
 	}
 
-	if copyTask.Mode != "" {
-		_, err = e.executeCommand(fmt.Sprintf("chmod %s %s", copyTask.Mode, dest), false)
+	if task.WaitFor != nil {
+		waitTask, err := e.renderWaitForTask(task.Name, *task.WaitFor)
 		if err != nil {
-			return "", err
+			return task, err
 		}
+		task.WaitFor = &waitTask
 	}
 
-	return fmt.Sprintf("Copied %s to %s", copyTask.Src, dest), nil
-}
-
-func (e *Executor) executeWaitFor(condition string) (string, error) {
-	parts := strings.SplitN(condition, ":", 2)
-	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid wait_for format: %s (expected type:value)", condition)
-	}
-
-	waitType := parts[0]
-	waitValue := parts[1]
-
-	maxRetries := 30
-	retryDelay := 2 * time.Second
-
-	for i := 0; i < maxRetries; i++ {
-		var checkCmd string
-		switch waitType {
-		case "port":
-			checkCmd = fmt.Sprintf("nc -z localhost %s", waitValue)
-		case "service":
-			checkCmd = fmt.Sprintf("systemctl is-active %s", waitValue)
-		case "file":
-			checkCmd = fmt.Sprintf("test -f %s", waitValue)
-		case "http":
-			checkCmd = fmt.Sprintf("curl -sf %s", waitValue)
-		default:
-			return "", fmt.Errorf("unknown wait_for type: %s", waitType)
+	if task.Fetch != nil {
+		fetchTask := *task.Fetch
+		if fetchTask.Src, err = e.renderField(task.Name, "fetch src", fetchTask.Src); err != nil {
+			return task, err
+		}
+		if fetchTask.Dest, err = e.renderField(task.Name, "fetch dest", fetchTask.Dest); err != nil {
+			return task, err
 		}
+		task.Fetch = &fetchTask
+	}
 
-		_, err := e.executeCommand(checkCmd, false)
-		if err == nil {
-			return fmt.Sprintf("Condition met: %s", condition), nil
+	if task.Reboot != nil && task.Reboot.TestCommand != "" {
+		rebootTask := *task.Reboot
+		if rebootTask.TestCommand, err = e.renderField(task.Name, "reboot test_command", rebootTask.TestCommand); err != nil {
+			return task, err
 		}
+		task.Reboot = &rebootTask
+	}
 
-		if i < maxRetries-1 {
-			time.Sleep(retryDelay)
+	if task.AsyncStatus != nil {
+		statusTask := *task.AsyncStatus
+		if statusTask.Jid, err = e.renderField(task.Name, "async_status jid", statusTask.Jid); err != nil {
+			return task, err
 		}
+		task.AsyncStatus = &statusTask
 	}
 
-	return "", fmt.Errorf("timeout waiting for: %s", condition)
+	return task, nil
 }
 
-func (e *Executor) SubstituteVars(text string) string {
+func (e *Executor) templateFuncMap() template.FuncMap {
 	// Create a template with helper functions
-	funcMap := template.FuncMap{
-		"fact": func(path string) string {
-			// Allow accessing facts with dot notation: {{ fact "puppet_facts.os.family" }}
-			parts := strings.Split(path, ".")
-			if len(parts) < 1 {
-				return ""
-			}
+	funcMap := templateFuncs()
+	funcMap["fact"] = func(path string) string {
+		// Allow accessing facts with dot notation: {{ fact "puppet_facts.os.family" }}
+		parts := strings.Split(path, ".")
+		if len(parts) < 1 {
+			return ""
+		}
 
-			// Navigate through the nested structure
-			current, exists := e.Variables[parts[0]]
-			if !exists {
-				return ""
-			}
+		// Navigate through the nested structure
+		current, exists := e.Variables[parts[0]]
+		if !exists {
+			return ""
+		}
 
-			for i := 1; i < len(parts); i++ {
-				if m, ok := current.(map[string]interface{}); ok {
-					var exists bool
-					current, exists = m[parts[i]]
-					if !exists {
-						return ""
-					}
-				} else {
+		for i := 1; i < len(parts); i++ {
+			if m, ok := current.(map[string]interface{}); ok {
+				var exists bool
+				current, exists = m[parts[i]]
+				if !exists {
 					return ""
 				}
+			} else {
+				return ""
 			}
+		}
 
-			return fmt.Sprintf("%v", current)
-		},
-	}
-
-	tmpl, err := template.New("vars").Funcs(funcMap).Parse(text)
-	if err != nil {
-		return text
-	}
-
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, e.Variables); err != nil {
-		return text
+		return fmt.Sprintf("%v", current)
 	}
-
-	return buf.String()
+	return funcMap
 }
 
 func (e *Executor) evaluateCondition(condition string) bool {
@@ -1057,8 +1190,6 @@ func (e *Executor) printOutput(writer io.Writer, output string) {
 }
 
 func (e *Executor) executeLocalAction(cmd string) (string, error) {
-	cmd = e.SubstituteVars(cmd)
-
 	if types.ExecOptions.Verbose {
 		e.mu.Lock()
 		log.SetOutput(e.OutputWriter)
@@ -1073,7 +1204,14 @@ func (e *Executor) executeLocalAction(cmd string) (string, error) {
 		return "", fmt.Errorf("empty command")
 	}
 
-	command := exec.Command("/bin/sh", "-c", cmd)
+	// The command runs in its own process group so a timeout kills
+	// everything it started
+	command := exec.CommandContext(e.taskContext(), "/bin/sh", "-c", cmd)
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	command.Cancel = func() error {
+		return killLocalProcessGroup(command.Process.Pid)
+	}
+	command.WaitDelay = killGracePeriod
 
 	// Capture output
 	var stdout, stderr bytes.Buffer
@@ -1086,6 +1224,9 @@ func (e *Executor) executeLocalAction(cmd string) (string, error) {
 		output += "\nSTDERR: " + stderr.String()
 	}
 
+	if ctx := e.taskContext(); ctx.Err() != nil {
+		return output, fmt.Errorf("%w, local command killed", contextError(ctx))
+	}
 	if err != nil {
 		return output, fmt.Errorf("local command failed: %w", err)
 	}
@@ -1093,21 +1234,9 @@ func (e *Executor) executeLocalAction(cmd string) (string, error) {
 	return output, nil
 }
 
-func (e *Executor) executeDelegated(cmd string, delegateHost string) (string, error) {
-	// If delegated to localhost, just run it locally
-	if delegateHost == "localhost" || delegateHost == "127.0.0.1" {
-		return e.executeLocalAction(cmd)
-	}
-
-	// Otherwise, for delegation to happen correctly, the task has to be
-	// executed by the proper host's executor. This function should never
-	// actually be called since we filter at a higher level.
-	return "", fmt.Errorf("delegation to %s should be handled by skipping execution on non-delegate hosts", delegateHost)
-}
-
 func ResetRunOnceTracking() {
 	types.RunOnceTasks.Lock()
-	types.RunOnceTasks.Executed = make(map[string]bool)
+	types.RunOnceTasks.Results = make(map[string]*types.RunOnceResult)
 	types.RunOnceTasks.Unlock()
 }
 
@@ -1116,16 +1245,69 @@ func NewExecutor(host types.Host, groupName string) (*Executor, error) {
 		log.Printf("[VERBOSE] Connecting to Host: %s", host.Name)
 	}
 
+	// The inventory variables are copied, other hosts read them through hostvars
+	vars := make(map[string]interface{})
+	if host.Vars != nil {
+		for k, v := range host.Vars {
+			vars[k] = v
+		}
+	}
+
+	if types.ExecOptions.DryRun {
+		if types.ExecOptions.Verbose {
+			log.Printf("[VERBOSE] [%s] DRY-RUN: Skipping actual SSH connection", host.Name)
+		}
+
+		return &Executor{
+			Host:           host,
+			Variables:      vars,
+			Registers:      make(map[string]string),
+			CompletedTasks: make(map[string]bool),
+			GroupName:      groupName,
+			OutputWriter:   os.Stdout,
+			StartTime:      time.Now(),
+		}, nil
+	}
+
+	conn, err := dialConnection(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if types.ExecOptions.Verbose {
+		log.Printf("[VERBOSE] [%s] Successfully connected", host.Name)
+	}
+
+	return &Executor{
+		Host:           host,
+		conn:           conn,
+		Variables:      vars,
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		GroupName:      groupName,
+		OutputWriter:   os.Stdout,
+		StartTime:      time.Now(),
+	}, nil
+}
+
+// sshClientConfig returns the SSH client configuration of a host, and the
+// address to dial
+func sshClientConfig(host types.Host) (*ssh.ClientConfig, string, error) {
 	// Get host key callback for verification
-	hostKeyCallback, err := getHostKeyCallback(host.StrictHostKeyCheck)
+	hostKeyCallback, knownKeyAlgorithms, err := getHostKeyCallback(host)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load host keys: %w", err)
+		return nil, "", fmt.Errorf("failed to load host keys: %w", err)
+	}
+
+	timeout := time.Duration(host.ConnectTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
 	}
 
 	config := &ssh.ClientConfig{
 		User:            host.User,
 		HostKeyCallback: hostKeyCallback,
-		Timeout:         10 * time.Second,
+		Timeout:         timeout,
 	}
 
 	var authMethods []ssh.AuthMethod
@@ -1133,14 +1315,17 @@ func NewExecutor(host types.Host, groupName string) (*Executor, error) {
 	// Determine which UseAgent to use (host-specific or default)
 	useAgent := host.UseAgent
 
-	if useAgent || (host.KeyFile == "" && host.Password == "" && os.Getenv("SSH_AUTH_SOCK") != "") {
+	// identities_only restricts keys to the configured ones, the agent is
+	// only used when asked for explicitly
+	implicitAgent := !host.IdentitiesOnly && host.KeyFile == "" && host.Password == "" && os.Getenv("SSH_AUTH_SOCK") != ""
+	if useAgent || implicitAgent {
 		if agentAuth := getSSHAgent(); agentAuth != nil {
 			authMethods = append(authMethods, agentAuth)
 			if types.ExecOptions.Verbose {
 				log.Printf("[VERBOSE] [%s] Using ssh-agent for authentication", host.Name)
 			}
 		} else if useAgent {
-			return nil, fmt.Errorf("use_agent is true but ssh-agent is not available")
+			return nil, "", fmt.Errorf("use_agent is true but ssh-agent is not available")
 		}
 	}
 
@@ -1153,36 +1338,9 @@ func NewExecutor(host types.Host, groupName string) (*Executor, error) {
 			}
 		}
 
-		if types.ExecOptions.Verbose {
-			log.Printf("[VERBOSE] [%s] Reading key file: %s", host.Name, keyPath)
-		}
-
-		key, err := os.ReadFile(filepath.Clean(keyPath))
+		signer, err := loadSigner(host, keyPath)
 		if err != nil {
-			return nil, fmt.Errorf("unable to read private key: %w", err)
-		}
-
-		var signer ssh.Signer
-		if host.KeyPassword != "" {
-			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(host.KeyPassword))
-			if err != nil {
-				return nil, fmt.Errorf("unable to parse private key with passphrase: %w", err)
-			}
-		} else {
-			signer, err = ssh.ParsePrivateKey(key)
-			if err != nil {
-				fmt.Printf("Private key for %s appears to be passphrase protected.\n", host.Name)
-				fmt.Printf("Enter passphrase for %s: ", host.KeyFile)
-				var passphrase string
-				_, err = fmt.Scanln(&passphrase)
-				if err != nil {
-					return nil, fmt.Errorf("unable to read stdin for private key passphrase: %w", err)
-				}
-				signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
-				if err != nil {
-					return nil, fmt.Errorf("unable to parse private key with passphrase: %w", err)
-				}
-			}
+			return nil, "", err
 		}
 
 		authMethods = append(authMethods, ssh.PublicKeys(signer))
@@ -1199,7 +1357,7 @@ func NewExecutor(host types.Host, groupName string) (*Executor, error) {
 	}
 
 	if len(authMethods) == 0 {
-		return nil, fmt.Errorf("no authentication method provided (try: use_agent: true, key_file, or password)")
+		return nil, "", fmt.Errorf("no authentication method provided (try: use_agent: true, key_file, or password)")
 	}
 
 	config.Auth = authMethods
@@ -1214,55 +1372,68 @@ func NewExecutor(host types.Host, groupName string) (*Executor, error) {
 		target = host.Hostname
 	}
 	if target == "" {
-		return nil, fmt.Errorf("no address or hostname provided")
+		return nil, "", fmt.Errorf("no address or hostname provided")
 	}
 
 	if types.ExecOptions.Verbose {
 		log.Printf("[VERBOSE] [%s] Dialing %s:%d", host.Name, target, port)
 	}
 
-	if types.ExecOptions.DryRun {
-		if types.ExecOptions.Verbose {
-			log.Printf("[VERBOSE] [%s] DRY-RUN: Skipping actual SSH connection", host.Name)
-		}
-		vars := make(map[string]interface{})
-		if host.Vars != nil {
-			for k, v := range host.Vars {
-				vars[k] = v
-			}
-		}
+	address := fmt.Sprintf("%s:%d", target, port)
+	if knownKeyAlgorithms != nil {
+		config.HostKeyAlgorithms = knownKeyAlgorithms(address)
+	}
 
-		return &Executor{
-			Host:           host,
-			client:         nil,
-			Variables:      vars,
-			Registers:      make(map[string]string),
-			CompletedTasks: make(map[string]bool),
-			GroupName:      groupName,
-			OutputWriter:   os.Stdout,
-			StartTime:      time.Now(),
-		}, nil
+	return config, address, nil
+}
+
+// loadSigner returns the private key of a host, read and decrypted on its
+// first use only. A passphrase missing from key_password is asked on stdin.
+func loadSigner(host types.Host, keyPath string) (ssh.Signer, error) {
+	keyPath = filepath.Clean(keyPath)
+
+	// Held while asking for a passphrase, so that the prompts of the hosts
+	// sharing a key do not mix
+	keySigners.Lock()
+	defer keySigners.Unlock()
+	if signer, ok := keySigners.signers[keyPath]; ok {
+		return signer, nil
+	}
+
+	if types.ExecOptions.Verbose {
+		log.Printf("[VERBOSE] [%s] Reading key file: %s", host.Name, keyPath)
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", target, port), config)
+	key, err := os.ReadFile(keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial: %w", err)
+		return nil, fmt.Errorf("unable to read private key: %w", err)
 	}
 
-	if types.ExecOptions.Verbose {
-		log.Printf("[VERBOSE] [%s] Successfully connected", host.Name)
+	var signer ssh.Signer
+	if host.KeyPassword != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(host.KeyPassword))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse private key with passphrase: %w", err)
+		}
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+		if err != nil {
+			fmt.Printf("Private key for %s appears to be passphrase protected.\n", host.Name)
+			fmt.Printf("Enter passphrase for %s: ", host.KeyFile)
+			var passphrase string
+			_, err = fmt.Scanln(&passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read stdin for private key passphrase: %w", err)
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse private key with passphrase: %w", err)
+			}
+		}
 	}
 
-	return &Executor{
-		Host:           host,
-		client:         client,
-		Variables:      host.Vars,
-		Registers:      make(map[string]string),
-		CompletedTasks: make(map[string]bool),
-		GroupName:      groupName,
-		OutputWriter:   os.Stdout,
-		StartTime:      time.Now(),
-	}, nil
+	keySigners.signers[keyPath] = signer
+	return signer, nil
 }
 
 func getSSHAgent() ssh.AuthMethod {
@@ -1288,77 +1459,21 @@ func getSSHAgent() ssh.AuthMethod {
 }
 
 func (e *Executor) Close() error {
-	if e.client != nil {
-		return e.client.Close()
+	// Delegate connections are shared, only their transfer state is released
+	for _, delegate := range e.delegates {
+		delegate.closeTransfers()
 	}
-	return nil
+	e.closeTransfers()
+	return e.conn.Close()
 }
 
-func getHostKeyCallback(strictHostKeyCheck *bool) (ssh.HostKeyCallback, error) {
-	// Determine the actual value to use (default to true if nil)
-	strict := true
-	if strictHostKeyCheck != nil {
-		strict = *strictHostKeyCheck
-	}
-
-	// If strict host key checking is disabled, use insecure callback
-	// This is useful for testing environments but should be avoided in production
-	if !strict {
-		if types.ExecOptions.Verbose {
-			log.Printf("[VERBOSE] WARNING: types.Host key verification is disabled (strict_host_key_check: false)")
-		}
-		return ssh.InsecureIgnoreHostKey(), nil //gosec:disable G106
-	}
-
-	// Try to load known_hosts file
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, fmt.Errorf("unable to get home directory: %w", err)
+// closeTransfers removes the remote temporary directory and closes the SFTP
+// session
+func (e *Executor) closeTransfers() {
+	e.removeRemoteTempDir()
+	if e.sftpClient != nil {
+		_ = e.sftpClient.Close()
+		e.sftpClient = nil
 	}
-
-	knownHostsPath := filepath.Join(homeDir, ".ssh", "known_hosts")
-
-	// Check if known_hosts exists
-	if _, err := os.Stat(knownHostsPath); os.IsNotExist(err) {
-		// Create .ssh directory if it doesn't exist
-		sshDir := filepath.Join(homeDir, ".ssh")
-		if err := os.MkdirAll(sshDir, 0700); err != nil {
-			return nil, fmt.Errorf("unable to create .ssh directory: %w", err)
-		}
-
-		// Create empty known_hosts file
-		if _, err := os.Create(filepath.Clean(knownHostsPath)); err != nil {
-			return nil, fmt.Errorf("unable to create known_hosts file: %w", err)
-		}
-
-		if types.ExecOptions.Verbose {
-			log.Printf("[VERBOSE] Created new known_hosts file at: %s", knownHostsPath)
-		}
-	}
-
-	// Load known_hosts
-	hostKeyCallback, err := knownhosts.New(knownHostsPath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to load known_hosts: %w", err)
-	}
-
-	// Wrap the callback to provide better error messages
-	return ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		err := hostKeyCallback(hostname, remote, key)
-		if err != nil {
-			// Extract hostname without port for ssh-keyscan command
-			host, _, splitErr := net.SplitHostPort(hostname)
-			if splitErr != nil {
-				// If splitting fails, use the original hostname
-				host = hostname
-			}
-
-			// Check if this is a host key mismatch or unknown host
-			if keyErr, ok := err.(*knownhosts.KeyError); ok && len(keyErr.Want) > 0 {
-				return fmt.Errorf("host key verification failed for %s: %w\nThe host key has changed. This could indicate a security breach.\nIf you trust this host, remove the old key from %s", hostname, err, knownHostsPath)
-			}
-			return fmt.Errorf("host key verification failed for %s: %w\nTo add this host, run: ssh-keyscan -H %s >> %s", hostname, err, host, knownHostsPath)
-		}
-		return nil
-	}), nil
 }
+
@@ -75,7 +75,7 @@ func TestExecutor_ExecuteScriptTaskDryRun(t *testing.T) {
 
 	task := types.Task{
 		Name:   "Script types.Task",
-		Script: scriptPath,
+		Script: &types.ScriptTask{Path: scriptPath},
 		Sudo:   true,
 	}
 
@@ -109,7 +109,7 @@ func TestExecutor_ExecuteWaitForTaskDryRun(t *testing.T) {
 
 	task := types.Task{
 		Name:    "Wait For Port",
-		WaitFor: "port:8080",
+		WaitFor: &types.WaitForTask{Condition: "port:8080"},
 	}
 
 	err := executor.ExecuteTask(task)
@@ -494,7 +494,7 @@ func TestExecutor_ExecuteTaskAllTypes(t *testing.T) {
 		},
 		{
 			name: "script",
-			task: types.Task{Name: "script", Script: scriptPath},
+			task: types.Task{Name: "script", Script: &types.ScriptTask{Path: scriptPath}},
 		},
 		{
 			name: "copy",
@@ -502,7 +502,7 @@ func TestExecutor_ExecuteTaskAllTypes(t *testing.T) {
 		},
 		{
 			name: "wait_for",
-			task: types.Task{Name: "wait", WaitFor: "port:8080"},
+			task: types.Task{Name: "wait", WaitFor: &types.WaitForTask{Condition: "port:8080"}},
 		},
 	}
 
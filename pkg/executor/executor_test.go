@@ -169,7 +169,7 @@ func TestExecutor_ExecuteTaskDryRun(t *testing.T) {
 			name: "script task",
 			task: types.Task{
 				Name:   "Run Script",
-				Script: "/path/to/script.sh",
+				Script: &types.ScriptTask{Path: "/path/to/script.sh"},
 			},
 			expectedOut: "Script",
 		},
@@ -526,15 +526,15 @@ func TestExecutor_DelegateTo(t *testing.T) {
 		DelegateTo: "host2",
 	}
 
-	// Execute on host1 (should be skipped)
+	// Execute on host1 (should run on host2 on behalf of host1)
 	err := executor1.ExecuteTask(delegatedTask)
 	if err != nil {
 		t.Errorf("ExecuteTask() error = %v", err)
 	}
 
 	output1Str := output1.String()
-	if !strings.Contains(output1Str, "Skipped") || !strings.Contains(output1Str, "delegated to") {
-		t.Errorf("Output should indicate task was skipped due to delegation, got: %q", output1Str)
+	if strings.Contains(output1Str, "Skipped") || !strings.Contains(output1Str, "(delegated to: host2)") {
+		t.Errorf("Output should indicate task would execute on the delegated host, got: %q", output1Str)
 	}
 
 	// Execute on host2 (should run)
@@ -551,3 +551,135 @@ func TestExecutor_DelegateTo(t *testing.T) {
 		t.Errorf("Output should indicate task would execute on the delegated host, got: %q", output2Str)
 	}
 }
+
+func TestExecutor_RenderVarsStrict(t *testing.T) {
+	executor := &Executor{
+		Variables: map[string]interface{}{
+			"app_port": "8080",
+			"db":       map[string]interface{}{"host": "db1"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		input      string
+		expected   string
+		wantErrMsg string
+	}{
+		{
+			name:     "defined variable",
+			input:    "--port {{ .app_port }}",
+			expected: "--port 8080",
+		},
+		{
+			name:     "nested variable",
+			input:    "{{ .db.host }}",
+			expected: "db1",
+		},
+		{
+			name:       "undefined variable",
+			input:      "--port {{ .app_prot }}",
+			wantErrMsg: "undefined variable 'app_prot'",
+		},
+		{
+			name:       "undefined nested variable",
+			input:      "{{ .db.port }}",
+			wantErrMsg: "undefined variable 'port'",
+		},
+		{
+			name:       "invalid template",
+			input:      "{{ .app_port",
+			wantErrMsg: "invalid template",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := executor.RenderVars(tt.input)
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("RenderVars(%q) error = %v, want error containing %q", tt.input, err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RenderVars(%q) unexpected error: %v", tt.input, err)
+			}
+			if result != tt.expected {
+				t.Errorf("RenderVars(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecutor_RenderVarsLenient(t *testing.T) {
+	types.ExecOptions.NoStrictVars = true
+	defer func() {
+		types.ExecOptions.NoStrictVars = false
+	}()
+
+	executor := &Executor{Variables: map[string]interface{}{}}
+
+	result, err := executor.RenderVars("Value: {{ .undefined }}")
+	if err != nil {
+		t.Fatalf("RenderVars() unexpected error in lenient mode: %v", err)
+	}
+	if result != "Value: <no value>" {
+		t.Errorf("RenderVars() = %q, want %q", result, "Value: <no value>")
+	}
+}
+
+func TestExecutor_ExecuteTaskUndefinedVariable(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      map[string]interface{}{"app_port": "8080"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &bytes.Buffer{},
+	}
+
+	tests := []struct {
+		name     string
+		task     types.Task
+		contains []string
+	}{
+		{
+			name: "command",
+			task: types.Task{
+				Name:    "Start app",
+				Command: "app --port {{ .app_prot }}",
+			},
+			contains: []string{"'app_prot'", "command", "'Start app'"},
+		},
+		{
+			name: "copy dest",
+			task: types.Task{
+				Name: "Install config",
+				Copy: &types.CopyTask{Src: "app.conf", Dest: "/etc/{{ .app_name }}/app.conf"},
+			},
+			contains: []string{"'app_name'", "copy dest", "'Install config'"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := executor.ExecuteTask(tt.task)
+			if err == nil {
+				t.Fatal("ExecuteTask() should fail on an undefined variable")
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q should contain %q", err.Error(), want)
+				}
+			}
+			if executor.CompletedTasks[tt.task.Name] {
+				t.Errorf("task %q should not be marked as completed", tt.task.Name)
+			}
+		})
+	}
+}
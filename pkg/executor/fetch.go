@@ -0,0 +1,255 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+// fetchChecksumScript prints "checksum root path" NUL separated records for
+// the files given as arguments, $0 being the directory they were found in
+const fetchChecksumScript = `for f; do s=$(sha256sum < "$f") || exit 1; printf '%s\0%s\0%s\0' "${s%% *}" "$0" "$f"; done`
+
+// fetchClaims maps the local paths written by fetch tasks to the host and
+// remote file they came from, so hosts running in parallel never overwrite
+// each other's files
+var (
+	fetchClaimsMu sync.Mutex
+	fetchClaims   = make(map[string]string)
+)
+
+// ResetFetchClaims forgets the local paths written by the fetch tasks of a
+// previous run
+func ResetFetchClaims() {
+	fetchClaimsMu.Lock()
+	fetchClaims = make(map[string]string)
+	fetchClaimsMu.Unlock()
+}
+
+// remoteFetchFile is a remote file matched by a fetch task
+type remoteFetchFile struct {
+	Path     string
+	Root     string // directory matched by the source, empty for a file match
+	Checksum string
+	Local    string
+}
+
+// executeFetch downloads the files matching the source into the local
+// destination, verifying their checksums
+func (e *Executor) executeFetch(fetchTask *types.FetchTask, sudo bool) (string, error) {
+	if fetchTask.Src == "" || fetchTask.Dest == "" {
+		return "", fmt.Errorf("fetch requires src and dest")
+	}
+
+	files, err := e.listFetchFiles(fetchTask.Src, sudo)
+	if err != nil {
+		return "", err
+	}
+
+	if len(files) == 0 {
+		if fetchTask.FailOnMissing == nil || *fetchTask.FailOnMissing {
+			return "", fmt.Errorf("no remote file matches '%s'", fetchTask.Src)
+		}
+		return fmt.Sprintf("No remote file matches %s (skipped)", fetchTask.Src), nil
+	}
+
+	// Resolve and claim every local path before downloading anything
+	for i := range files {
+		files[i].Local = fetchLocalPath(fetchTask.Dest, e.Host.Name, files[i], fetchTask.Flat, len(files) == 1)
+		if err := claimFetchPath(files[i].Local, e.Host.Name+":"+files[i].Path); err != nil {
+			return "", err
+		}
+	}
+
+	var fetched []remoteFetchFile
+	for _, file := range files {
+		if sum, err := fileChecksum(file.Local); err == nil && sum == file.Checksum {
+			continue
+		}
+		fetched = append(fetched, file)
+	}
+
+	if !types.ExecOptions.Check {
+		for _, file := range fetched {
+			if err := e.fetchFile(file, sudo); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return formatFetchReport(fetchTask, files, fetched), nil
+}
+
+// listFetchFiles expands the source on the remote host and returns the
+// matched files with their checksums. Directories are walked recursively.
+func (e *Executor) listFetchFiles(src string, sudo bool) ([]remoteFetchFile, error) {
+	script, err := fetchListingScript(src)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := e.runWithStdin("sh -c "+utils.ShellQuote(script), nil, sudo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", src, err)
+	}
+
+	return parseFetchListing(output), nil
+}
+
+// fetchListingScript returns the shell script listing the files matching src
+func fetchListingScript(src string) (string, error) {
+	pattern, err := globQuote(src)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`c=%s; for p in %s; do [ -e "$p" ] || continue; if [ -d "$p" ]; then find "$p" -type f -exec sh -c "$c" "$p" {} + || exit 1; else sh -c "$c" "" "$p" || exit 1; fi; done`,
+		utils.ShellQuote(fetchChecksumScript), pattern), nil
+}
+
+// parseFetchListing parses the records printed by fetchChecksumScript,
+// ignoring files matched more than once
+func parseFetchListing(output string) []remoteFetchFile {
+	fields := strings.Split(output, "\x00")
+
+	seen := make(map[string]bool)
+	var files []remoteFetchFile
+	for i := 0; i+2 < len(fields); i += 3 {
+		file := remoteFetchFile{Checksum: fields[i], Root: fields[i+1], Path: fields[i+2]}
+		if file.Path == "" || seen[file.Path] {
+			continue
+		}
+		seen[file.Path] = true
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// globQuote escapes a path for the shell, leaving glob characters active. A
+// leading ~/ is expanded to the remote home directory.
+func globQuote(s string) (string, error) {
+	if strings.ContainsAny(s, "\n\x00") {
+		return "", fmt.Errorf("invalid fetch source %q", s)
+	}
+
+	var b strings.Builder
+	if strings.HasPrefix(s, "~/") {
+		b.WriteString(`"$HOME"/`)
+		s = s[2:]
+	}
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("*?[]/._-", r),
+			r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+// fetchLocalPath returns where a remote file is stored. By default files are
+// stored under dest/<host>/<remote path>. With flat, files are stored directly
+// in dest, relative to the matched directory, and a single file can be
+// fetched to dest itself unless dest ends with a slash or is a directory.
+func fetchLocalPath(dest, host string, file remoteFetchFile, flat, single bool) string {
+	if !flat {
+		return filepath.Join(dest, host, filepath.FromSlash(path.Clean("/"+file.Path)))
+	}
+
+	if file.Root == "" {
+		if single && !strings.HasSuffix(dest, "/") {
+			if info, err := os.Stat(dest); err != nil || !info.IsDir() {
+				return filepath.Clean(dest)
+			}
+		}
+		return filepath.Join(dest, path.Base(file.Path))
+	}
+
+	rel := strings.TrimPrefix(file.Path, strings.TrimSuffix(file.Root, "/")+"/")
+	return filepath.Join(dest, filepath.FromSlash(path.Clean("/"+rel)))
+}
+
+// claimFetchPath records that a local path is written with the given remote
+// file and fails when it is already used for another one
+func claimFetchPath(local, owner string) error {
+	abs, err := filepath.Abs(local)
+	if err != nil {
+		return err
+	}
+
+	fetchClaimsMu.Lock()
+	defer fetchClaimsMu.Unlock()
+
+	if existing, ok := fetchClaims[abs]; ok && existing != owner {
+		return fmt.Errorf("fetch destination %s is already used for %s, not overwriting it with %s (use a per-host dest or disable flat)", local, existing, owner)
+	}
+	fetchClaims[abs] = owner
+	return nil
+}
+
+// fetchFile downloads a remote file next to its local path, verifies its
+// checksum, then renames it into place
+func (e *Executor) fetchFile(file remoteFetchFile, sudo bool) error {
+	dir := filepath.Dir(file.Local)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".sshot.*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", file.Local, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if err := e.readRemoteFile(file.Path, io.MultiWriter(tmp, hash), sudo); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to fetch %s: %w", file.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", file.Local, err)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != file.Checksum {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", file.Path, file.Checksum, sum)
+	}
+
+	if err := os.Rename(tmp.Name(), file.Local); err != nil {
+		return fmt.Errorf("failed to write %s: %w", file.Local, err)
+	}
+	return nil
+}
+
+// formatFetchReport lists the fetched files
+func formatFetchReport(fetchTask *types.FetchTask, files, fetched []remoteFetchFile) string {
+	if len(fetched) == 0 {
+		return fmt.Sprintf("%d file(s) from %s are up to date in %s (unchanged)", len(files), fetchTask.Src, fetchTask.Dest)
+	}
+
+	var b strings.Builder
+	verb := "Fetched"
+	if types.ExecOptions.Check {
+		verb = "Would fetch"
+	}
+	fmt.Fprintf(&b, "%s %s to %s (changed): %d fetched, %d unchanged\n", verb, fetchTask.Src, fetchTask.Dest,
+		len(fetched), len(files)-len(fetched))
+	for _, file := range fetched {
+		fmt.Fprintf(&b, "  fetched  %s → %s\n", file.Path, file.Local)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,232 @@
+package executor
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestFetchListingScript(t *testing.T) {
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum is not available")
+	}
+
+	root := t.TempDir()
+	logs := filepath.Join(root, "my logs")
+	if err := os.MkdirAll(filepath.Join(logs, "app"), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for name, content := range map[string]string{
+		"syslog":       "system\n",
+		"kern.log":     "kernel\n",
+		"app/api.log":  "api\n",
+		"app/api.json": "{}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(logs, name), []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		src      string
+		expected []string
+		roots    []string
+	}{
+		{"single file", filepath.Join(logs, "syslog"), []string{"syslog"}, []string{""}},
+		{"glob", filepath.Join(logs, "*.log"), []string{"kern.log"}, []string{""}},
+		{"directory", filepath.Join(logs, "app"), []string{"app/api.json", "app/api.log"}, []string{logs + "/app", logs + "/app"}},
+		{"glob matching a directory", filepath.Join(logs, "a*"), []string{"app/api.json", "app/api.log"}, []string{logs + "/app", logs + "/app"}},
+		{"missing file", filepath.Join(logs, "missing"), nil, nil},
+		{"glob without match", filepath.Join(logs, "*.gz"), nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := fetchListingScript(tt.src)
+			if err != nil {
+				t.Fatalf("fetchListingScript() error = %v", err)
+			}
+			output, err := exec.Command("/bin/sh", "-c", script).Output()
+			if err != nil {
+				t.Fatalf("listing script failed: %v\n%s", err, script)
+			}
+
+			files := parseFetchListing(string(output))
+			if len(files) != len(tt.expected) {
+				t.Fatalf("got %d files (%+v), want %v", len(files), files, tt.expected)
+			}
+			for i, file := range files {
+				if file.Path != filepath.Join(logs, tt.expected[i]) {
+					t.Errorf("file %d = %q, want %q", i, file.Path, filepath.Join(logs, tt.expected[i]))
+				}
+				if file.Root != tt.roots[i] {
+					t.Errorf("file %d root = %q, want %q", i, file.Root, tt.roots[i])
+				}
+				sum, _ := fileChecksum(file.Path)
+				if file.Checksum != sum {
+					t.Errorf("file %d checksum = %q, want %q", i, file.Checksum, sum)
+				}
+			}
+		})
+	}
+}
+
+func TestGlobQuote(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"/var/log/*.log", "/var/log/*.log"},
+		{"/srv/my app/log[0-9]", `/srv/my\ app/log[0-9]`},
+		{"~/.bash_history", `"$HOME"/.bash_history`},
+		{"/tmp/$(reboot)", `/tmp/\$\(reboot\)`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			result, err := globQuote(tt.src)
+			if err != nil {
+				t.Fatalf("globQuote() error = %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("globQuote(%q) = %q, want %q", tt.src, result, tt.expected)
+			}
+		})
+	}
+
+	if _, err := globQuote("/tmp/a\nb"); err == nil {
+		t.Error("globQuote() should reject newlines")
+	}
+}
+
+func TestFetchLocalPath(t *testing.T) {
+	existingDir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		dest     string
+		file     remoteFetchFile
+		flat     bool
+		single   bool
+		expected string
+	}{
+		{"per host", "out", remoteFetchFile{Path: "/var/log/syslog"}, false, true, "out/web1/var/log/syslog"},
+		{"relative remote path", "out", remoteFetchFile{Path: "app.log"}, false, true, "out/web1/app.log"},
+		{"parent references stay below dest", "out", remoteFetchFile{Path: "../../etc/passwd"}, false, true, "out/web1/etc/passwd"},
+		{"flat single file", "out/web.conf", remoteFetchFile{Path: "/etc/web.conf"}, true, true, "out/web.conf"},
+		{"flat single file into directory", "out/", remoteFetchFile{Path: "/etc/web.conf"}, true, true, "out/web.conf"},
+		{"flat single file into existing directory", existingDir, remoteFetchFile{Path: "/etc/web.conf"}, true, true, filepath.Join(existingDir, "web.conf")},
+		{"flat glob match", "out", remoteFetchFile{Path: "/var/log/kern.log"}, true, false, "out/kern.log"},
+		{"flat directory", "out", remoteFetchFile{Path: "/var/log/app/sub/api.log", Root: "/var/log/app"}, true, false, "out/sub/api.log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := fetchLocalPath(tt.dest, "web1", tt.file, tt.flat, tt.single)
+			if result != filepath.FromSlash(tt.expected) {
+				t.Errorf("fetchLocalPath() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestClaimFetchPath(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "app.conf")
+
+	if err := claimFetchPath(local, "web1:/etc/app.conf"); err != nil {
+		t.Fatalf("claimFetchPath() error = %v", err)
+	}
+	// The same file can be fetched again
+	if err := claimFetchPath(local, "web1:/etc/app.conf"); err != nil {
+		t.Errorf("claimFetchPath() should accept the same owner, got %v", err)
+	}
+	// Another host must not overwrite it
+	err := claimFetchPath(local, "web2:/etc/app.conf")
+	if err == nil || !strings.Contains(err.Error(), "already used for web1:/etc/app.conf") {
+		t.Errorf("claimFetchPath() error = %v, want a collision error", err)
+	}
+
+	// A new run starts without claims
+	ResetFetchClaims()
+	if err := claimFetchPath(local, "web2:/etc/app.conf"); err != nil {
+		t.Errorf("claimFetchPath() after a reset error = %v", err)
+	}
+}
+
+func TestExecutor_ExecuteFetchTaskDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      map[string]interface{}{"app": "api"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	task := types.Task{
+		Name: "Collect logs",
+		Fetch: &types.FetchTask{
+			Src:  "/var/log/{{ .app }}/*.log",
+			Dest: "collected/",
+		},
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+
+	if !strings.Contains(output.String(), "Fetch: /var/log/api/*.log → collected/") {
+		t.Errorf("Output should describe the fetch task, got: %q", output.String())
+	}
+}
+
+func TestExecutor_FetchFileSFTP(t *testing.T) {
+	tmpDir := t.TempDir()
+	remote := filepath.Join(tmpDir, "remote.log")
+	if err := os.WriteFile(remote, []byte("line 1\nline 2\n"), 0600); err != nil {
+		t.Fatalf("Failed to write remote file: %v", err)
+	}
+	sum, err := fileChecksum(remote)
+	if err != nil {
+		t.Fatalf("fileChecksum() error = %v", err)
+	}
+
+	executor := &Executor{
+		Host:         types.Host{Name: "testhost"},
+		OutputWriter: &bytes.Buffer{},
+		sftpClient:   newLocalSFTPClient(t),
+	}
+
+	local := filepath.Join(tmpDir, "out", "testhost", "remote.log")
+	if err := executor.fetchFile(remoteFetchFile{Path: remote, Checksum: sum, Local: local}, false); err != nil {
+		t.Fatalf("fetchFile() error = %v", err)
+	}
+	content, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatalf("Failed to read fetched file: %v", err)
+	}
+	if string(content) != "line 1\nline 2\n" {
+		t.Errorf("fetched content = %q", string(content))
+	}
+
+	// A checksum mismatch leaves the previous file untouched
+	err = executor.fetchFile(remoteFetchFile{Path: remote, Checksum: "0000", Local: local}, false)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("fetchFile() error = %v, want checksum mismatch", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(local))
+	if len(entries) != 1 {
+		t.Errorf("temporary files were left behind: %v", entries)
+	}
+}
@@ -0,0 +1,471 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+// maxDiffSize is the largest file shown as a diff, larger files are summarized
+const maxDiffSize = 1 << 20
+
+// fileOptions controls how a file is installed on the remote host
+type fileOptions struct {
+	Mode     string
+	Owner    string
+	Group    string
+	Backup   bool
+	Validate string
+}
+
+// executeCopy uploads a local file byte for byte, streaming it from disk
+func (e *Executor) executeCopy(copyTask *types.CopyTask, sudo bool) (string, error) {
+	src, err := localFileSource(copyTask.Src)
+	if err != nil {
+		return "", err
+	}
+
+	opts := fileOptions{
+		Mode:     copyTask.Mode,
+		Owner:    copyTask.Owner,
+		Group:    copyTask.Group,
+		Backup:   copyTask.Backup,
+		Validate: copyTask.Validate,
+	}
+
+	result, err := e.installFile(src, copyTask.Dest, opts, sudo)
+	if err != nil {
+		return "", err
+	}
+
+	return e.installMessage("Copied", copyTask.Src, copyTask.Dest, result), nil
+}
+
+// executeTemplate renders a local template with the executor variables and
+// installs the result
+func (e *Executor) executeTemplate(tmplTask *types.TemplateTask, sudo bool, taskName string) (string, error) {
+	content, err := e.renderTemplateFile(tmplTask.Src, tmplTask.Partials)
+	if err != nil {
+		return "", fmt.Errorf("%w in template '%s' of task '%s'", err, tmplTask.Src, taskName)
+	}
+
+	opts := fileOptions{
+		Mode:     tmplTask.Mode,
+		Owner:    tmplTask.Owner,
+		Group:    tmplTask.Group,
+		Backup:   tmplTask.Backup,
+		Validate: tmplTask.Validate,
+	}
+
+	result, err := e.installFile(memorySource(tmplTask.Src, content), tmplTask.Dest, opts, sudo)
+	if err != nil {
+		return "", err
+	}
+
+	return e.installMessage("Rendered", tmplTask.Src, tmplTask.Dest, result), nil
+}
+
+// installMessage prints the diff, if any, and describes the outcome of an install
+func (e *Executor) installMessage(verb, src, dest string, result installResult) string {
+	if result.Diff != "" {
+		e.printDiff(result.Diff)
+	}
+
+	if !result.Changed {
+		return fmt.Sprintf("%s is up to date (unchanged)", dest)
+	}
+	if types.ExecOptions.Check {
+		return fmt.Sprintf("Would update %s from %s (changed)", dest, src)
+	}
+
+	msg := fmt.Sprintf("%s %s to %s (changed)", verb, src, dest)
+	if result.Backup != "" {
+		msg += fmt.Sprintf(" (backup: %s)", result.Backup)
+	}
+	return msg
+}
+
+// printDiff writes a colored unified diff to the executor output
+func (e *Executor) printDiff(diff string) {
+	writer := e.OutputWriter
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		color := ""
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"):
+			color = utils.ColorBold
+		case strings.HasPrefix(line, "+"):
+			color = utils.ColorGreen
+		case strings.HasPrefix(line, "-"):
+			color = utils.ColorRed
+		case strings.HasPrefix(line, "@@"):
+			color = utils.ColorCyan
+		}
+		if color != "" {
+			fmt.Fprintf(writer, "    %s%s%s\n", utils.Color(color), line, utils.Color(utils.ColorReset))
+		} else {
+			fmt.Fprintf(writer, "    %s\n", line)
+		}
+	}
+}
+
+// renderTemplateFile renders a template file. Partials are glob patterns of
+// additional template files whose definitions can be used with
+// {{ template "name" . }} or {{ include "name" . }}. Files next to the main
+// template can also be included by their relative path.
+func (e *Executor) renderTemplateFile(src string, partials []string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Clean(src))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+
+	baseDir := filepath.Dir(src)
+
+	var tmpl *template.Template
+	funcMap := e.templateFuncMap()
+	funcMap["include"] = func(name string, data interface{}) (string, error) {
+		if tmpl.Lookup(name) == nil {
+			partial, err := os.ReadFile(filepath.Clean(filepath.Join(baseDir, name)))
+			if err != nil {
+				return "", fmt.Errorf("include %q: %w", name, err)
+			}
+			if _, err := tmpl.New(name).Parse(string(partial)); err != nil {
+				return "", fmt.Errorf("include %q: %w", name, err)
+			}
+		}
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+
+	tmpl = template.New(filepath.Base(src)).Funcs(funcMap)
+	if !types.ExecOptions.NoStrictVars {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+
+	if _, err := tmpl.Parse(string(data)); err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+
+	for _, pattern := range partials {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partials pattern %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			partial, err := os.ReadFile(filepath.Clean(match))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read partial: %w", err)
+			}
+			if _, err := tmpl.New(filepath.Base(match)).Parse(string(partial)); err != nil {
+				return nil, fmt.Errorf("invalid partial %s: %w", match, err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, e.templateData(string(data))); err != nil {
+		return nil, hostvarsError(string(data), templateExecError(err))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// installResult describes what installFile did
+type installResult struct {
+	Changed bool
+	Backup  string
+	Diff    string
+}
+
+// remoteFileState is the state of a remote file as seen by probeRemoteFile
+type remoteFileState struct {
+	Exists   bool
+	Size     int64
+	Mode     string
+	Owner    string
+	Group    string
+	Checksum string
+}
+
+// installFile compares a source with the remote file and, when they differ,
+// uploads it to a temporary file, optionally validates it, then atomically
+// moves it into place with the requested ownership and mode. In check mode
+// nothing is modified.
+func (e *Executor) installFile(src fileSource, dest string, opts fileOptions, sudo bool) (installResult, error) {
+	var result installResult
+
+	state, err := e.probeRemoteFile(dest, sudo)
+	if err != nil {
+		return result, err
+	}
+
+	checksum, err := src.checksum()
+	if err != nil {
+		return result, err
+	}
+	contentChanged := !state.Exists || state.Checksum != checksum
+	attrsChanged := state.Exists && attributesDiffer(state, opts)
+	result.Changed = contentChanged || attrsChanged
+
+	if types.ExecOptions.Verbose {
+		e.mu.Lock()
+		log.SetOutput(e.OutputWriter)
+		log.Printf("[VERBOSE] [%s] %s: content changed=%v, attributes changed=%v", e.Host.Name, dest, contentChanged, attrsChanged)
+		log.SetOutput(os.Stderr)
+		e.mu.Unlock()
+	}
+
+	if types.ExecOptions.Diff && contentChanged {
+		result.Diff, err = e.fileDiff(dest, state, src, sudo)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if types.ExecOptions.Check || !result.Changed {
+		return result, nil
+	}
+
+	if !contentChanged {
+		// Only ownership or mode differ, fix them in place
+		script := buildAttributesScript(dest, opts)
+		if _, err := e.runWithStdin("sh -c "+utils.ShellQuote(script), nil, sudo); err != nil {
+			return result, fmt.Errorf("failed to update attributes of %s: %w", dest, err)
+		}
+		return result, nil
+	}
+
+	tmpFile, err := e.uploadTemp(src)
+	if err != nil {
+		return result, err
+	}
+	defer e.runCleanup("rm -f " + utils.ShellQuote(tmpFile))
+
+	if opts.Validate != "" {
+		validateCmd := strings.ReplaceAll(opts.Validate, "%s", utils.ShellQuote(tmpFile))
+		if output, _, err := e.runCapture(validateCmd, nil, sudo); err != nil {
+			return result, fmt.Errorf("validation failed (%s): %w\n%s", validateCmd, err, strings.TrimSpace(output))
+		}
+	}
+
+	backupSuffix := ""
+	if opts.Backup {
+		backupSuffix = "." + time.Now().Format("2006-01-02@15:04:05") + "~"
+	}
+
+	script := buildInstallScript(tmpFile, dest, opts, backupSuffix, src.ModTime)
+	output, err := e.runWithStdin("sh -c "+utils.ShellQuote(script), nil, sudo)
+	if err != nil {
+		return result, fmt.Errorf("failed to install %s: %w", dest, err)
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "backup:") {
+			result.Backup = strings.TrimPrefix(line, "backup:")
+		}
+	}
+	return result, nil
+}
+
+// probeRemoteFile returns the size, mode, ownership and checksum of a remote file
+func (e *Executor) probeRemoteFile(dest string, sudo bool) (remoteFileState, error) {
+	var state remoteFileState
+
+	script := fmt.Sprintf(`d=%s; if [ -f "$d" ]; then stat -c '%%s %%a %%U %%G' "$d" && s=$(sha256sum "$d") && echo "${s%%%% *}"; fi`, remotePath(dest))
+	output, err := e.runOutput("sh -c "+utils.ShellQuote(script), sudo)
+	if err != nil {
+		return state, fmt.Errorf("failed to inspect %s: %w", dest, err)
+	}
+
+	lines := strings.Split(output, "\n")
+	if len(lines) < 2 || strings.TrimSpace(lines[0]) == "" {
+		return state, nil
+	}
+
+	fields := strings.Fields(lines[0])
+	if len(fields) != 4 {
+		return state, nil
+	}
+	state.Exists = true
+	state.Size, _ = strconv.ParseInt(fields[0], 10, 64)
+	state.Mode, state.Owner, state.Group = fields[1], fields[2], fields[3]
+	state.Checksum = strings.TrimSpace(lines[1])
+	return state, nil
+}
+
+// attributesDiffer reports whether the requested mode or ownership differ from
+// the remote file. Symbolic modes cannot be compared and are only applied
+// along with content changes.
+func attributesDiffer(state remoteFileState, opts fileOptions) bool {
+	if opts.Mode != "" {
+		want, err := strconv.ParseUint(opts.Mode, 8, 32)
+		have, haveErr := strconv.ParseUint(state.Mode, 8, 32)
+		if err == nil && haveErr == nil && want != have {
+			return true
+		}
+	}
+	if opts.Owner != "" && opts.Owner != state.Owner {
+		return true
+	}
+	if opts.Group != "" && opts.Group != state.Group {
+		return true
+	}
+	return false
+}
+
+// fileDiff returns a unified diff between the remote file and a source. Large
+// or binary files are summarized instead.
+func (e *Executor) fileDiff(dest string, state remoteFileState, src fileSource, sudo bool) (string, error) {
+	if state.Size > maxDiffSize || src.Size > maxDiffSize {
+		return fmt.Sprintf("Files differ: %s (%d bytes → %d bytes, not shown)\n", dest, state.Size, src.Size), nil
+	}
+
+	content, err := src.readAll()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s for diff: %w", src.Name, err)
+	}
+	if isBinary(content) {
+		return fmt.Sprintf("Files differ: %s (%d bytes → %d bytes, not shown)\n", dest, state.Size, len(content)), nil
+	}
+
+	var old string
+	if state.Exists {
+		output, err := e.runOutput("cat "+remotePath(dest), sudo)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s for diff: %w", dest, err)
+		}
+		if isBinary([]byte(output)) {
+			return fmt.Sprintf("Files differ: %s (%d bytes → %d bytes, not shown)\n", dest, state.Size, len(content)), nil
+		}
+		old = output
+	}
+
+	return utils.UnifiedDiff(dest+" (remote)", dest+" (new)", old, string(content)), nil
+}
+
+// isBinary uses the same heuristic as git: a NUL byte in the first 8000 bytes
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// buildAttributesScript returns a shell script applying mode and ownership to
+// an existing file
+func buildAttributesScript(dest string, opts fileOptions) string {
+	var b strings.Builder
+	b.WriteString("set -e\n")
+	fmt.Fprintf(&b, "d=%s\n", remotePath(dest))
+	if opts.Mode != "" {
+		fmt.Fprintf(&b, "chmod %s \"$d\"\n", utils.ShellQuote(opts.Mode))
+	}
+	writeOwnership(&b, opts, "$d")
+	return b.String()
+}
+
+func writeOwnership(b *strings.Builder, opts fileOptions, target string) {
+	switch {
+	case opts.Owner != "" && opts.Group != "":
+		fmt.Fprintf(b, "chown %s \"%s\"\n", utils.ShellQuote(opts.Owner+":"+opts.Group), target)
+	case opts.Owner != "":
+		fmt.Fprintf(b, "chown %s \"%s\"\n", utils.ShellQuote(opts.Owner), target)
+	case opts.Group != "":
+		fmt.Fprintf(b, "chgrp %s \"%s\"\n", utils.ShellQuote(opts.Group), target)
+	}
+}
+
+// runWithStdin runs a remote command fed with stdin and returns its stdout
+func (e *Executor) runWithStdin(cmd string, stdin io.Reader, sudo bool) (string, error) {
+	stdout, _, err := e.runCapture(cmd, stdin, sudo)
+	return stdout, err
+}
+
+// runOutput runs an internal command whose stdout is parsed. Nothing is shown
+// to the user, and anything written to stderr, such as a permission denied
+// or a sudo warning, is an error instead of being mistaken for the output.
+func (e *Executor) runOutput(cmd string, sudo bool) (string, error) {
+	stdout, stderr, err := e.runCapture(cmd, nil, sudo)
+	if err == nil && strings.TrimSpace(stderr) != "" {
+		err = fmt.Errorf("unexpected error output: %s", strings.TrimSpace(stderr))
+	}
+	return stdout, err
+}
+
+// runCapture runs a remote command fed with stdin and returns its stdout and
+// stderr. A failure includes the stderr.
+func (e *Executor) runCapture(cmd string, stdin io.Reader, sudo bool) (string, string, error) {
+	if sudo {
+		cmd = "sudo -S " + cmd
+	}
+
+	session, err := e.newSession()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr syncBuffer
+	session.Stdin = stdin
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	if err := session.Start(cmd); err != nil {
+		return "", "", fmt.Errorf("failed to start command: %w", err)
+	}
+	if err := e.waitSession(session, "", sudo); err != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+// buildInstallScript returns the shell script moving an uploaded file into
+// place. The file is staged next to the destination so the final rename is
+// atomic, and the existing mode is kept when no mode is requested. A non-zero
+// modTime is set as the modification time of the installed file.
+func buildInstallScript(tmpFile, dest string, opts fileOptions, backupSuffix string, modTime time.Time) string {
+	var b strings.Builder
+	b.WriteString("set -e\n")
+	fmt.Fprintf(&b, "d=%s\n", remotePath(dest))
+	b.WriteString(`s=$(mktemp "$(dirname "$d")/.sshot.XXXXXX")` + "\n")
+	b.WriteString(`trap 'rm -f "$s"' EXIT` + "\n")
+	fmt.Fprintf(&b, "cat %s > \"$s\"\n", utils.ShellQuote(tmpFile))
+
+	if opts.Mode != "" {
+		fmt.Fprintf(&b, "chmod %s \"$s\"\n", utils.ShellQuote(opts.Mode))
+	} else {
+		b.WriteString(`if [ -e "$d" ]; then chmod "$(stat -c %a "$d")" "$s"; else chmod 0644 "$s"; fi` + "\n")
+	}
+
+	writeOwnership(&b, opts, "$s")
+
+	if !modTime.IsZero() {
+		fmt.Fprintf(&b, "touch -m -d @%d \"$s\"\n", modTime.Unix())
+	}
+
+	if backupSuffix != "" {
+		fmt.Fprintf(&b, "if [ -e \"$d\" ]; then cp -p \"$d\" \"$d\"%s; echo \"backup:$d\"%s; fi\n",
+			utils.ShellQuote(backupSuffix), utils.ShellQuote(backupSuffix))
+	}
+
+	b.WriteString(`mv -f "$s" "$d"` + "\n")
+	return b.String()
+}
@@ -0,0 +1,394 @@
+package executor
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestExecutor_RenderTemplateFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	main := writeFile("nginx.conf.tmpl", `server {
+  listen {{ .port }};
+{{ include "snippets/location.tmpl" . | indent 2 }}
+{{ template "footer.tmpl" . }}
+}
+`)
+	writeFile("snippets/location.tmpl", "location / { root {{ .root }}; }")
+	writeFile("partials/footer.tmpl", "# managed for {{ .env | upper }}")
+
+	executor := &Executor{
+		Variables: map[string]interface{}{
+			"port": 8080,
+			"root": "/srv/www",
+			"env":  "prod",
+		},
+	}
+
+	content, err := executor.renderTemplateFile(main, []string{filepath.Join(tmpDir, "partials", "*.tmpl")})
+	if err != nil {
+		t.Fatalf("renderTemplateFile() error = %v", err)
+	}
+
+	expected := `server {
+  listen 8080;
+  location / { root /srv/www; }
+# managed for PROD
+}
+`
+	if string(content) != expected {
+		t.Errorf("renderTemplateFile() = %q, want %q", string(content), expected)
+	}
+
+	// Undefined variables are reported in strict mode
+	broken := writeFile("broken.tmpl", "{{ .missing_var }}")
+	_, err = executor.renderTemplateFile(broken, nil)
+	if err == nil || !strings.Contains(err.Error(), "undefined variable 'missing_var'") {
+		t.Errorf("renderTemplateFile() error = %v, want undefined variable error", err)
+	}
+}
+
+func TestBuildInstallScript(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "upload")
+	dest := filepath.Join(tmpDir, "my dir", "app.conf")
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(src, []byte("new content\n{{ literal }}\n"), 0600); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	if err := os.WriteFile(dest, []byte("old content\n"), 0600); err != nil {
+		t.Fatalf("Failed to write destination: %v", err)
+	}
+
+	mtime := time.Unix(1700000000, 0)
+	script := buildInstallScript(src, dest, fileOptions{Mode: "0640", Backup: true}, ".bak~", mtime)
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("install script failed: %v\n%s", err, script)
+	}
+
+	content, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Failed to read destination: %v", err)
+	}
+	if string(content) != "new content\n{{ literal }}\n" {
+		t.Errorf("destination content = %q, want the uploaded bytes unchanged", string(content))
+	}
+
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("Failed to stat destination: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("destination mode = %o, want 640", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("destination mtime = %v, want %v", info.ModTime(), mtime)
+	}
+
+	backup, err := os.ReadFile(dest + ".bak~")
+	if err != nil {
+		t.Fatalf("backup was not created: %v", err)
+	}
+	if string(backup) != "old content\n" {
+		t.Errorf("backup content = %q, want the previous content", string(backup))
+	}
+	if !strings.Contains(stdout.String(), "backup:"+dest+".bak~") {
+		t.Errorf("install script should report the backup path, got %q", stdout.String())
+	}
+
+	// No staging files should be left behind
+	entries, _ := os.ReadDir(filepath.Dir(dest))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".sshot.") {
+			t.Errorf("staging file %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestBuildInstallScript_HomeDest(t *testing.T) {
+	home := t.TempDir()
+	src := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(src, []byte("alias ll='ls -l'\n"), 0600); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+
+	// A dest under ~ is installed in the home directory, as the shell expands it
+	for _, script := range []string{
+		buildInstallScript(src, "~/.bashrc", fileOptions{Mode: "0644"}, "", time.Time{}),
+		buildAttributesScript("~/.bashrc", fileOptions{Mode: "0600"}),
+	} {
+		cmd := exec.Command("/bin/sh", "-c", script)
+		cmd.Env = append(os.Environ(), "HOME="+home)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("script failed: %v\n%s\n%s", err, output, script)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(home, ".bashrc"))
+	if err != nil {
+		t.Fatalf("~/.bashrc was not installed in the home directory: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("~/.bashrc mode = %o, want 600", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(home, "~")); !os.IsNotExist(err) {
+		t.Error("a literal ~ directory was created")
+	}
+
+	for p, want := range map[string]string{"~": ".", "~/.bashrc": ".bashrc", "/etc/motd": "/etc/motd"} {
+		if got := sftpPath(p); got != want {
+			t.Errorf("sftpPath(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func TestBuildInstallScriptOwnership(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     fileOptions
+		contains string
+	}{
+		{"owner and group", fileOptions{Owner: "www-data", Group: "adm"}, `chown www-data:adm "$s"`},
+		{"owner only", fileOptions{Owner: "www-data"}, `chown www-data "$s"`},
+		{"group only", fileOptions{Group: "adm"}, `chgrp adm "$s"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := buildInstallScript("/tmp/upload", "/etc/app.conf", tt.opts, "", time.Time{})
+			if !strings.Contains(script, tt.contains) {
+				t.Errorf("install script should contain %q, got:\n%s", tt.contains, script)
+			}
+		})
+	}
+}
+
+func TestExecutor_ExecuteTemplateTaskDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      map[string]interface{}{"app": "api"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	task := types.Task{
+		Name: "Render config",
+		Template: &types.TemplateTask{
+			Src:      "templates/app.conf.tmpl",
+			Dest:     "/etc/{{ .app }}/app.conf",
+			Validate: "app --check %s",
+		},
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+
+	if !strings.Contains(output.String(), "Template: templates/app.conf.tmpl → /etc/api/app.conf") {
+		t.Errorf("Output should describe the template task, got: %q", output.String())
+	}
+}
+
+func TestAttributesDiffer(t *testing.T) {
+	state := remoteFileState{Exists: true, Mode: "644", Owner: "root", Group: "root"}
+
+	tests := []struct {
+		name     string
+		opts     fileOptions
+		expected bool
+	}{
+		{"no attributes requested", fileOptions{}, false},
+		{"same mode with leading zero", fileOptions{Mode: "0644"}, false},
+		{"different mode", fileOptions{Mode: "0600"}, true},
+		{"symbolic mode is not compared", fileOptions{Mode: "u+x"}, false},
+		{"same owner", fileOptions{Owner: "root"}, false},
+		{"different owner", fileOptions{Owner: "www-data"}, true},
+		{"different group", fileOptions{Group: "adm"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := attributesDiffer(state, tt.opts); result != tt.expected {
+				t.Errorf("attributesDiffer() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	if isBinary([]byte("plain text\nwith {{ braces }}\n")) {
+		t.Error("text content should not be detected as binary")
+	}
+	if !isBinary([]byte{0x7f, 'E', 'L', 'F', 0x00, 0x01}) {
+		t.Error("content with NUL bytes should be detected as binary")
+	}
+}
+
+func TestExecutor_ExecuteTaskCheckMode(t *testing.T) {
+	types.ExecOptions.Check = true
+	defer func() {
+		types.ExecOptions.Check = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	task := types.Task{
+		Name:    "Restart service",
+		Command: "systemctl restart app",
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+	if !strings.Contains(output.String(), "skipped in check mode") {
+		t.Errorf("Commands should be skipped in check mode, got: %q", output.String())
+	}
+	if !executor.CompletedTasks[task.Name] {
+		t.Error("Skipped task should be marked as completed")
+	}
+}
+
+func TestExecutor_ProbeRemoteFileQuiet(t *testing.T) {
+	server, host := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		switch {
+		case strings.Contains(cmd, "sha256sum"):
+			return "12 644 root root\nabc123\n", 0
+		case strings.HasPrefix(cmd, "cat "):
+			return "secret=1\n", 0
+		}
+		return "", 0
+	})
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	output := &bytes.Buffer{}
+	exec.OutputWriter = output
+
+	types.ExecOptions.Progress = true
+	defer func() { types.ExecOptions.Progress = false }()
+
+	// Probes are not streamed as task output
+	state, err := exec.probeRemoteFile("/etc/app.conf", false)
+	if err != nil {
+		t.Fatalf("probeRemoteFile() error = %v", err)
+	}
+	if want := (remoteFileState{Exists: true, Size: 12, Mode: "644", Owner: "root", Group: "root", Checksum: "abc123"}); state != want {
+		t.Errorf("probeRemoteFile() = %+v, want %+v", state, want)
+	}
+	diff, err := exec.fileDiff("/etc/app.conf", state, fileSource{Name: "app.conf", Content: []byte("secret=2\n"), Size: 9}, false)
+	if err != nil {
+		t.Fatalf("fileDiff() error = %v", err)
+	}
+	if !strings.Contains(diff, "-secret=1") || !strings.Contains(diff, "+secret=2") {
+		t.Errorf("fileDiff() = %q, want the remote content replaced", diff)
+	}
+	if output.Len() > 0 {
+		t.Errorf("output = %q, want the probes kept quiet", output.String())
+	}
+
+	// Error output is a failure, not content
+	server.mu.Lock()
+	server.stderr = func(string) string { return "sha256sum: /etc/app.conf: Permission denied\n" }
+	server.mu.Unlock()
+	if _, err := exec.probeRemoteFile("/etc/app.conf", false); err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Errorf("probeRemoteFile() error = %v, want the error output", err)
+	}
+	if _, err := exec.fileDiff("/etc/app.conf", state, fileSource{Name: "app.conf", Content: []byte("secret=2\n"), Size: 9}, false); err == nil {
+		t.Error("fileDiff() with error output succeeded")
+	}
+}
+
+func TestExecutor_InstallFileQuiet(t *testing.T) {
+	var mu sync.Mutex
+	var cmds []string
+	_, host := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		mu.Lock()
+		cmds = append(cmds, cmd)
+		mu.Unlock()
+		switch {
+		case strings.Contains(cmd, "mktemp -d"):
+			return "/tmp/sshot-test\n", 0
+		case strings.Contains(cmd, "mv -f"):
+			return "internal step output\n", 0
+		}
+		return "", 0
+	})
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	output := &bytes.Buffer{}
+	exec.OutputWriter = output
+
+	types.ExecOptions.Progress = true
+	defer func() { types.ExecOptions.Progress = false }()
+
+	src := fileSource{Name: "app.conf", Content: []byte("key=value\n"), Size: 10}
+	result, err := exec.installFile(src, "/etc/app.conf", fileOptions{Mode: "0644", Validate: "check-config %s"}, false)
+	if err != nil {
+		t.Fatalf("installFile() error = %v", err)
+	}
+	if !result.Changed {
+		t.Error("installFile() of a new file reported no change")
+	}
+
+	// The internal steps ran, without being streamed as task output
+	mu.Lock()
+	defer mu.Unlock()
+	for _, want := range []string{"check-config", "mv -f"} {
+		found := false
+		for _, cmd := range cmds {
+			found = found || strings.Contains(cmd, want)
+		}
+		if !found {
+			t.Errorf("no command ran %q", want)
+		}
+	}
+	if strings.Contains(output.String(), "│") {
+		t.Errorf("output = %q, want the internal steps kept quiet", output.String())
+	}
+}
@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"io"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// Fork returns an executor running a task alongside the other tasks of the
+// host, on its own sessions of the same connection. It works on copies of the
+// variables, registers and completed tasks, and writes to w so the output of
+// the task is kept together. Join merges its results back.
+func (e *Executor) Fork(w io.Writer) *Executor {
+	fork := &Executor{
+		Host:           e.Host,
+		conn:           e.conn,
+		Variables:      make(map[string]interface{}, len(e.Variables)),
+		Environment:    e.Environment,
+		Registers:      make(map[string]string, len(e.Registers)),
+		CompletedTasks: make(map[string]bool, len(e.CompletedTasks)),
+		GroupName:      e.GroupName,
+		OutputWriter:   w,
+		StartTime:      e.StartTime,
+	}
+	for k, v := range e.Variables {
+		fork.Variables[k] = v
+	}
+	for k, v := range e.Registers {
+		fork.Registers[k] = v
+	}
+	for k, v := range e.CompletedTasks {
+		fork.CompletedTasks[k] = v
+	}
+	return fork
+}
+
+// Join merges the variables and register set by a task run on a fork, and
+// its completion, then releases the transfer state of the fork. The
+// connection is left open for the other tasks.
+func (e *Executor) Join(task types.Task, fork *Executor) {
+	for k := range task.Vars {
+		e.Variables[k] = fork.Variables[k]
+	}
+	if output, ok := fork.Registers[task.Register]; ok && task.Register != "" {
+		e.Registers[task.Register] = output
+		e.Variables[task.Register] = output
+	}
+	if fork.CompletedTasks[task.Name] {
+		e.CompletedTasks[task.Name] = true
+	}
+
+	for _, delegate := range fork.delegates {
+		delegate.closeTransfers()
+	}
+	fork.closeTransfers()
+}
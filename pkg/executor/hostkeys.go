@@ -0,0 +1,282 @@
+package executor
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// knownHostsMu serializes the updates of known_hosts files between the hosts
+// of a run, the file lock between sshot processes
+var knownHostsMu sync.Mutex
+
+// hostKeyPolicy returns the host key policy of a host. Without
+// host_key_policy, strict_host_key_check: false turns verification off.
+func hostKeyPolicy(host types.Host) string {
+	if host.HostKeyPolicy != "" {
+		return host.HostKeyPolicy
+	}
+	if host.StrictHostKeyCheck != nil && !*host.StrictHostKeyCheck {
+		return types.HostKeyPolicyOff
+	}
+	return types.HostKeyPolicyStrict
+}
+
+// knownHostsFiles returns the known_hosts files of a host, ~/.ssh/known_hosts
+// when it has none
+func knownHostsFiles(host types.Host) ([]string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get home directory: %w", err)
+	}
+	if len(host.KnownHostsFile) == 0 {
+		return []string{filepath.Join(homeDir, ".ssh", "known_hosts")}, nil
+	}
+
+	files := make([]string, 0, len(host.KnownHostsFile))
+	for _, file := range host.KnownHostsFile {
+		if strings.HasPrefix(file, "~/") {
+			file = filepath.Join(homeDir, file[2:])
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// getHostKeyCallback returns the callback verifying the key of a host, against
+// its pinned host_key or its known_hosts files, and a function returning the
+// algorithms of the keys known for an address so the server presents one of
+// them. The function is nil when any key is accepted.
+func getHostKeyCallback(host types.Host) (ssh.HostKeyCallback, func(address string) []string, error) {
+	policy := hostKeyPolicy(host)
+
+	// If host key checking is disabled, use insecure callback
+	// This is useful for testing environments but should be avoided in production
+	if policy == types.HostKeyPolicyOff {
+		if types.ExecOptions.Verbose {
+			log.Printf("[VERBOSE] [%s] WARNING: host key verification is disabled", host.Name)
+		}
+		return ssh.InsecureIgnoreHostKey(), nil, nil //gosec:disable G106
+	}
+
+	if len(host.HostKey) > 0 {
+		return pinnedHostKeyCallback(host)
+	}
+
+	files, err := knownHostsFiles(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The first file is created as it is the one new keys are added to, the
+	// others are skipped when missing as ssh does
+	existing := make([]string, 0, len(files))
+	for i, file := range files {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if i > 0 {
+				continue
+			}
+			if err := createKnownHostsFile(file); err != nil {
+				return nil, nil, err
+			}
+		}
+		existing = append(existing, file)
+	}
+
+	// Load known_hosts
+	hostKeyCallback, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load known_hosts: %w", err)
+	}
+
+	// Wrap the callback to provide better error messages
+	callback := ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := hostKeyCallback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		// Extract hostname without port for ssh-keyscan command
+		hostOnly, _, splitErr := net.SplitHostPort(hostname)
+		if splitErr != nil {
+			// If splitting fails, use the original hostname
+			hostOnly = hostname
+		}
+
+		// Check if this is a host key mismatch or unknown host
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return fmt.Errorf("host key verification failed for %s: %w", hostname, err)
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key verification failed for %s: %w\nThe host key has changed. This could indicate a security breach.\nIf you trust this host, remove the old key from %s", hostname, err, keyErr.Want[0].Filename)
+		}
+		if policy == types.HostKeyPolicyAcceptNew {
+			if err := addKnownHost(files[0], hostname, remote, key); err != nil {
+				return fmt.Errorf("host key verification failed for %s: %w", hostname, err)
+			}
+			if types.ExecOptions.Verbose {
+				log.Printf("[VERBOSE] [%s] Added %s host key of %s to %s", host.Name, key.Type(), hostname, files[0])
+			}
+			return nil
+		}
+		return fmt.Errorf("host key verification failed for %s: %w\nTo add this host, run: ssh-keyscan -H %s >> %s", hostname, err, hostOnly, files[0])
+	})
+
+	return callback, func(address string) []string {
+		return keyAlgorithms(knownKeys(hostKeyCallback, address))
+	}, nil
+}
+
+// pinnedHostKeyCallback only accepts the host_key of a host, given in the
+// authorized_keys format
+func pinnedHostKeyCallback(host types.Host) (ssh.HostKeyCallback, func(address string) []string, error) {
+	pinned := make([]ssh.PublicKey, 0, len(host.HostKey))
+	for _, line := range host.HostKey {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid host_key of host '%s': %w", host.Name, err)
+		}
+		pinned = append(pinned, key)
+	}
+
+	callback := ssh.HostKeyCallback(func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		for _, want := range pinned {
+			if bytes.Equal(key.Marshal(), want.Marshal()) {
+				return nil
+			}
+		}
+
+		// A KeyError tells the failure cannot be fixed by retrying
+		keyErr := &knownhosts.KeyError{}
+		for _, want := range pinned {
+			keyErr.Want = append(keyErr.Want, knownhosts.KnownKey{Key: want})
+		}
+		return fmt.Errorf("host key verification failed for %s: the %s key does not match the host_key of the inventory: %w", hostname, key.Type(), keyErr)
+	})
+
+	return callback, func(string) []string { return keyAlgorithms(pinned) }, nil
+}
+
+// createKnownHostsFile creates an empty known_hosts file and its directory
+func createKnownHostsFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("unable to create known_hosts directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create known_hosts file: %w", err)
+	}
+	if types.ExecOptions.Verbose {
+		log.Printf("[VERBOSE] Created new known_hosts file at: %s", path)
+	}
+	return f.Close()
+}
+
+// addKnownHost appends the hashed key of a host to a known_hosts file, under a
+// lock so that hosts connecting in parallel, from this run or another one, do
+// not add it twice
+func addKnownHost(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(filepath.Clean(path), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open known_hosts file: %w", err)
+	}
+	defer f.Close()
+
+	fd := int(f.Fd()) //nolint:gosec // file descriptors fit in an int
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("unable to lock known_hosts file: %w", err)
+	}
+	defer func() { _ = syscall.Flock(fd, syscall.LOCK_UN) }()
+
+	// The key may have been added since the file was loaded
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("unable to read known_hosts file: %w", err)
+	}
+	if check, err := knownhosts.New(path); err == nil {
+		err = check(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+			return fmt.Errorf("%w\nThe host key was added with another value to %s", err, path)
+		}
+	}
+
+	line := knownhosts.Line([]string{knownhosts.HashHostname(knownhosts.Normalize(hostname))}, key) + "\n"
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		line = "\n" + line
+	}
+	if _, err := f.WriteString(line); err != nil {
+		return fmt.Errorf("unable to write known_hosts file: %w", err)
+	}
+	return nil
+}
+
+// knownKeys returns the keys a known_hosts callback knows for an address, by
+// checking a key no host has
+func knownKeys(callback ssh.HostKeyCallback, address string) []ssh.PublicKey {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+
+	// The remote address is only known once connected, an IP address given
+	// as is also matches the entries of the IP
+	remote := &net.TCPAddr{IP: net.IPv4zero}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			remote.IP = ip
+		}
+	}
+
+	var keyErr *knownhosts.KeyError
+	if err := callback(address, remote, probe); !errors.As(err, &keyErr) {
+		return nil
+	}
+	keys := make([]ssh.PublicKey, 0, len(keyErr.Want))
+	for _, known := range keyErr.Want {
+		keys = append(keys, known.Key)
+	}
+	return keys
+}
+
+// keyAlgorithms returns the host key algorithms matching keys, so that the
+// negotiation picks a key type that can be verified
+func keyAlgorithms(keys []ssh.PublicKey) []string {
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		names := []string{key.Type()}
+		if key.Type() == ssh.KeyAlgoRSA {
+			names = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				algorithms = append(algorithms, name)
+			}
+		}
+	}
+	return algorithms
+}
@@ -0,0 +1,231 @@
+package executor
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// newPublicKey returns a random ed25519 public key
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+	return key
+}
+
+// knownHostsHost returns the host of the test server with host key checking
+// against a known_hosts file of its own
+func knownHostsHost(t *testing.T, host types.Host, policy string) (types.Host, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	host.StrictHostKeyCheck = nil
+	host.HostKeyPolicy = policy
+	host.KnownHostsFile = types.StringList{path}
+	return host, path
+}
+
+func TestHostKeyPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		host types.Host
+		want string
+	}{
+		{"default", types.Host{}, types.HostKeyPolicyStrict},
+		{"strict check", types.Host{StrictHostKeyCheck: types.BoolPtr(true)}, types.HostKeyPolicyStrict},
+		{"strict check disabled", types.Host{StrictHostKeyCheck: types.BoolPtr(false)}, types.HostKeyPolicyOff},
+		{"policy wins", types.Host{StrictHostKeyCheck: types.BoolPtr(false), HostKeyPolicy: types.HostKeyPolicyAcceptNew}, types.HostKeyPolicyAcceptNew},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hostKeyPolicy(tt.host); got != tt.want {
+				t.Errorf("hostKeyPolicy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	rsaKey, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to create public key: %v", err)
+	}
+	edKey := newPublicKey(t)
+
+	got := keyAlgorithms([]ssh.PublicKey{edKey, rsaKey, newPublicKey(t)})
+	want := []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("keyAlgorithms() = %v, want %v", got, want)
+	}
+}
+
+func TestDialHost_HostKeyStrict(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+	host, path := knownHostsHost(t, host, "")
+	host.ConnectRetries = 2
+
+	// An unknown host is rejected right away
+	_, err := dialHost(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "ssh-keyscan -H 127.0.0.1 >> "+path) {
+		t.Errorf("dialHost() error = %v, want an unknown host key", err)
+	}
+	if n := server.connections(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+
+	// A known host is accepted, and its key type preferred
+	address := knownhosts.Normalize(net.JoinHostPort(host.Address, strconv.Itoa(host.Port)))
+	line := knownhosts.Line([]string{address}, server.hostKey) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	client, err := dialHost(context.Background(), host)
+	if err != nil {
+		t.Fatalf("dialHost() error = %v", err)
+	}
+	_ = client.Close()
+
+	config, _, err := sshClientConfig(host)
+	if err != nil {
+		t.Fatalf("sshClientConfig() error = %v", err)
+	}
+	if want := []string{ssh.KeyAlgoED25519}; !reflect.DeepEqual(config.HostKeyAlgorithms, want) {
+		t.Errorf("HostKeyAlgorithms = %v, want %v", config.HostKeyAlgorithms, want)
+	}
+}
+
+func TestDialHost_HostKeyAcceptNew(t *testing.T) {
+	_, host := newTestSSHServer(t, echoHandler)
+	host, path := knownHostsHost(t, host, types.HostKeyPolicyAcceptNew)
+
+	client, err := dialHost(context.Background(), host)
+	if err != nil {
+		t.Fatalf("dialHost() error = %v", err)
+	}
+	_ = client.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read known_hosts: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], "|1|") {
+		t.Errorf("known_hosts = %q, want one hashed entry", content)
+	}
+
+	// The added key is then enough for strict checking
+	host.HostKeyPolicy = types.HostKeyPolicyStrict
+	if client, err = dialHost(context.Background(), host); err != nil {
+		t.Fatalf("dialHost() with the added key error = %v", err)
+	}
+	_ = client.Close()
+}
+
+func TestDialHost_HostKeyChanged(t *testing.T) {
+	_, host := newTestSSHServer(t, echoHandler)
+	host, path := knownHostsHost(t, host, types.HostKeyPolicyAcceptNew)
+
+	address := knownhosts.Normalize(net.JoinHostPort(host.Address, strconv.Itoa(host.Port)))
+	line := knownhosts.Line([]string{address}, newPublicKey(t)) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+
+	// accept-new does not replace a changed key
+	_, err := dialHost(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "The host key has changed") {
+		t.Errorf("dialHost() error = %v, want a changed host key", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != line {
+		t.Errorf("known_hosts = %q, want it unchanged", content)
+	}
+}
+
+func TestDialHost_HostKeyPinned(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+	host, path := knownHostsHost(t, host, types.HostKeyPolicyAcceptNew)
+	host.HostKey = types.StringList{string(ssh.MarshalAuthorizedKey(newPublicKey(t))), string(ssh.MarshalAuthorizedKey(server.hostKey))}
+
+	client, err := dialHost(context.Background(), host)
+	if err != nil {
+		t.Fatalf("dialHost() error = %v", err)
+	}
+	_ = client.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("known_hosts was used for a host with a pinned key")
+	}
+
+	// Another pinned key is rejected, even with accept-new
+	host.HostKey = types.StringList{string(ssh.MarshalAuthorizedKey(newPublicKey(t)))}
+	_, err = dialHost(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "does not match the host_key of the inventory") {
+		t.Errorf("dialHost() error = %v, want a pinned key mismatch", err)
+	}
+
+	host.HostKey = types.StringList{"not a key"}
+	if _, _, err := sshClientConfig(host); err == nil || !strings.Contains(err.Error(), "invalid host_key of host 'test'") {
+		t.Errorf("sshClientConfig() error = %v, want an invalid host_key", err)
+	}
+}
+
+func TestAddKnownHost_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	// A file without a final newline keeps its last entry intact
+	if err := os.WriteFile(path, []byte(knownhosts.Line([]string{"other"}, newPublicKey(t))), 0600); err != nil {
+		t.Fatalf("Failed to write known_hosts: %v", err)
+	}
+	key := newPublicKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := addKnownHost(path, "web1:22", remote, key); err != nil {
+				t.Errorf("addKnownHost() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read known_hosts: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 2 {
+		t.Errorf("known_hosts has %d entries, want 2:\n%s", len(lines), content)
+	}
+
+	check, err := knownhosts.New(path)
+	if err != nil {
+		t.Fatalf("knownhosts.New() error = %v", err)
+	}
+	if err := check("web1:22", remote, key); err != nil {
+		t.Errorf("the added key is not accepted: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package executor
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fgouteroux/sshot/pkg/config"
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// hostVars holds the variables each host publishes for the templates of the
+// other hosts. A snapshot is replaced as a whole and never modified, so it can
+// be read while its host keeps running.
+var hostVars = struct {
+	sync.RWMutex
+	published map[string]map[string]interface{}
+}{published: make(map[string]map[string]interface{})}
+
+// hostvarsRefPattern extracts the host names referenced literally in a
+// template, as .hostvars.name or index .hostvars "name"
+var hostvarsRefPattern = regexp.MustCompile(`\.hostvars\.([A-Za-z0-9_]+)|index\s+\$?\.hostvars\s+"([^"]+)"`)
+
+// ResetHostVars forgets the variables published by the hosts
+func ResetHostVars() {
+	hostVars.Lock()
+	hostVars.published = make(map[string]map[string]interface{})
+	hostVars.Unlock()
+}
+
+// PublishVars makes a snapshot of the host variables, facts and registers
+// visible to the other hosts through hostvars. The playbook publishes them once
+// facts are gathered and after each task.
+func (e *Executor) PublishVars() {
+	snapshot := make(map[string]interface{}, len(e.Variables)+1)
+	for k, v := range e.Variables {
+		snapshot[k] = v
+	}
+	snapshot["inventory_hostname"] = e.Host.Name
+
+	hostVars.Lock()
+	hostVars.published[e.Host.Name] = snapshot
+	hostVars.Unlock()
+}
+
+// templateData returns the data templates are rendered with: the host
+// variables and the read-only magic variables, which take precedence.
+// hostvars is only built for templates referencing it.
+func (e *Executor) templateData(text string) map[string]interface{} {
+	data := make(map[string]interface{}, len(e.Variables)+5)
+	for k, v := range e.Variables {
+		data[k] = v
+	}
+
+	groups, playHosts := inventoryGroups()
+	groupNames := []string{}
+	for _, name := range sortedKeys(groups) {
+		if name == "all" {
+			continue
+		}
+		for _, host := range groups[name] {
+			if host == e.Host.Name {
+				groupNames = append(groupNames, name)
+				break
+			}
+		}
+	}
+
+	data["inventory_hostname"] = e.Host.Name
+	data["group_names"] = groupNames
+	data["groups"] = groups
+	data["play_hosts"] = playHosts
+	if strings.Contains(text, "hostvars") {
+		data["hostvars"] = hostvarsData()
+	}
+	return data
+}
+
+// inventoryGroups returns the host names of each inventory group, all hosts
+// being in the "all" group, and the hosts of the play in execution order
+func inventoryGroups() (map[string][]string, []string) {
+	groups := map[string][]string{"all": {}}
+	cfg, ok := config.Cache.Get()
+	if !ok {
+		return groups, []string{}
+	}
+
+	for _, host := range cfg.Inventory.Hosts {
+		groups["all"] = append(groups["all"], host.Name)
+	}
+	for _, group := range cfg.Inventory.Groups {
+		names := make([]string, 0, len(group.Hosts))
+		for _, host := range group.Hosts {
+			names = append(names, host.Name)
+		}
+		groups[group.Name] = names
+		groups["all"] = append(groups["all"], names...)
+	}
+
+	playHosts := make([]string, len(groups["all"]))
+	copy(playHosts, groups["all"])
+	return groups, playHosts
+}
+
+// hostvarsData returns the variables of every inventory host: the published
+// snapshot of the hosts that gathered facts, the inventory variables of the
+// others
+func hostvarsData() map[string]interface{} {
+	data := make(map[string]interface{})
+	if cfg, ok := config.Cache.Get(); ok {
+		for _, host := range inventoryHosts(cfg) {
+			vars := make(map[string]interface{}, len(host.Vars)+1)
+			for k, v := range host.Vars {
+				vars[k] = v
+			}
+			vars["inventory_hostname"] = host.Name
+			data[host.Name] = vars
+		}
+	}
+
+	hostVars.RLock()
+	for name, snapshot := range hostVars.published {
+		data[name] = snapshot
+	}
+	hostVars.RUnlock()
+	return data
+}
+
+// inventoryHosts returns every host of the inventory, grouped or not
+func inventoryHosts(cfg *types.Config) []types.Host {
+	hosts := append([]types.Host{}, cfg.Inventory.Hosts...)
+	for _, group := range cfg.Inventory.Groups {
+		hosts = append(hosts, group.Hosts...)
+	}
+	return hosts
+}
+
+// hostvarsError explains a failure of a template referencing hostvars of
+// hosts that have not gathered facts yet: their hostvars only hold their
+// inventory variables. The hosts named in the template are reported, or every
+// such host when the template does not name them.
+func hostvarsError(text string, err error) error {
+	if !strings.Contains(text, "hostvars") {
+		return err
+	}
+
+	cfg, ok := config.Cache.Get()
+	if !ok {
+		return err
+	}
+
+	hostVars.RLock()
+	defer hostVars.RUnlock()
+
+	pending := make(map[string]bool)
+	for _, host := range inventoryHosts(cfg) {
+		if _, ok := hostVars.published[host.Name]; !ok {
+			pending[host.Name] = false
+		}
+	}
+
+	named := false
+	for _, m := range hostvarsRefPattern.FindAllStringSubmatch(text, -1) {
+		named = true
+		if _, ok := pending[m[1]+m[2]]; ok {
+			pending[m[1]+m[2]] = true
+		}
+	}
+
+	var hosts []string
+	for _, name := range sortedKeys(pending) {
+		if pending[name] || !named {
+			hosts = append(hosts, name)
+		}
+	}
+	if len(hosts) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%w (hostvars not available yet for %s: facts not gathered)", err, strings.Join(hosts, ", "))
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
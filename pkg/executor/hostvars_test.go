@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fgouteroux/sshot/pkg/config"
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// setHostvarsInventory caches an inventory with web and db groups
+func setHostvarsInventory(t *testing.T) {
+	t.Helper()
+	config.Cache.Set(&types.Config{
+		Inventory: types.Inventory{
+			Hosts: []types.Host{{Name: "bastion"}},
+			Groups: []types.Group{
+				{Name: "web", Hosts: []types.Host{
+					{Name: "web1", Vars: map[string]interface{}{"port": 8080}},
+					{Name: "web2", Vars: map[string]interface{}{"port": 8081}},
+				}},
+				{Name: "db", Hosts: []types.Host{{Name: "db1"}}},
+			},
+		},
+	})
+	t.Cleanup(func() {
+		config.Cache.Set(nil)
+		ResetHostVars()
+	})
+}
+
+func TestExecutor_MagicVariables(t *testing.T) {
+	setHostvarsInventory(t)
+
+	executor := &Executor{
+		Host:      types.Host{Name: "web2"},
+		Variables: map[string]interface{}{"inventory_hostname": "overridden"},
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{ .inventory_hostname }}", "web2"},
+		{"{{ .group_names }}", "[web]"},
+		{`{{ join "," (index .groups "web") }}`, "web1,web2"},
+		{"{{ .groups.all }}", "[bastion web1 web2 db1]"},
+		{"{{ .play_hosts }}", "[bastion web1 web2 db1]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			result, err := executor.RenderVars(tt.template)
+			if err != nil {
+				t.Fatalf("RenderVars() error = %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("RenderVars() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecutor_Hostvars(t *testing.T) {
+	setHostvarsInventory(t)
+
+	db := &Executor{
+		Host:      types.Host{Name: "db1"},
+		Variables: map[string]interface{}{"db_facts": map[string]interface{}{"ip": "10.0.0.5"}},
+	}
+	web := &Executor{
+		Host:      types.Host{Name: "web1"},
+		Variables: map[string]interface{}{"port": 8080},
+	}
+
+	// db1 has not gathered facts yet
+	_, err := web.RenderVars("{{ .hostvars.db1.db_facts.ip }}")
+	if err == nil || err.Error() != "undefined variable 'db_facts' (hostvars not available yet for db1: facts not gathered)" {
+		t.Errorf("RenderVars() error = %v, want a hostvars not available error", err)
+	}
+
+	db.PublishVars()
+	result, err := web.RenderVars(`primary: {{ (index .hostvars "db1").db_facts.ip }}`)
+	if err != nil {
+		t.Fatalf("RenderVars() error = %v", err)
+	}
+	if result != "primary: 10.0.0.5" {
+		t.Errorf("RenderVars() = %q, want %q", result, "primary: 10.0.0.5")
+	}
+
+	// Hosts that have not published their variables expose their inventory ones
+	backends := "{{ range .groups.web }}server {{ . }} {{ (index $.hostvars .).port }};{{ end }}"
+	result, err = web.RenderVars(backends)
+	if err != nil {
+		t.Fatalf("RenderVars() error = %v", err)
+	}
+	if result != "server web1 8080;server web2 8081;" {
+		t.Errorf("RenderVars() = %q", result)
+	}
+
+	// Registers are visible once published
+	web.Variables["status"] = "drained"
+	if _, err := db.RenderVars("{{ .hostvars.web1.status }}"); err == nil ||
+		!strings.Contains(err.Error(), "hostvars not available yet for web1") {
+		t.Errorf("RenderVars() error = %v, want a hostvars not available error", err)
+	}
+	web.PublishVars()
+	if result, err := db.RenderVars("{{ .hostvars.web1.status }}"); err != nil || result != "drained" {
+		t.Errorf("RenderVars() = %q, %v, want drained", result, err)
+	}
+
+	// Without literal host names every host without variables is reported
+	_, err = web.RenderVars("{{ range .play_hosts }}{{ (index $.hostvars .).db_facts.ip }}{{ end }}")
+	if err == nil || !strings.Contains(err.Error(), "hostvars not available yet for bastion, web2: facts not gathered") {
+		t.Errorf("RenderVars() error = %v, want the hosts without variables", err)
+	}
+}
@@ -0,0 +1,265 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+const (
+	// defaultRebootTimeout is the time a host has to go down and come back
+	// when reboot_timeout is unset
+	defaultRebootTimeout = 600
+
+	// defaultRebootTestCommand tells that the host is ready once it answers
+	defaultRebootTestCommand = "whoami"
+
+	// rebootProbeInterval is the interval between the checks of the connection
+	// going down and the attempts to reconnect
+	rebootProbeInterval = 2 * time.Second
+
+	// rebootProbeTimeout is the time the host has to answer a keepalive
+	// before the connection is considered lost
+	rebootProbeTimeout = 5 * time.Second
+)
+
+// bootIDCommand prints an identifier that changes at each boot
+const bootIDCommand = "cat /proc/sys/kernel/random/boot_id 2>/dev/null || sysctl -n kern.boottime"
+
+// rebootCommand reboots the host, with reboot when shutdown is missing
+const rebootCommand = "sh -c 'if command -v shutdown >/dev/null 2>&1; then shutdown -r now; else reboot; fi'"
+
+// describeReboot returns a readable description of a reboot task
+func describeReboot(reboot *types.RebootTask) string {
+	timeout := reboot.RebootTimeout
+	if timeout == 0 {
+		timeout = defaultRebootTimeout
+	}
+	desc := fmt.Sprintf("wait up to %ds", timeout)
+	if reboot.PreRebootDelay > 0 {
+		desc += fmt.Sprintf(", %ds before", reboot.PreRebootDelay)
+	}
+	if reboot.PostRebootDelay > 0 {
+		desc += fmt.Sprintf(", %ds after", reboot.PostRebootDelay)
+	}
+	if reboot.TestCommand != "" {
+		desc += ", test: " + reboot.TestCommand
+	}
+	return desc
+}
+
+// executeReboot reboots the host and waits until it answers with a new boot id
+// and the test command succeeds. The new connection replaces the lost one, so
+// the next tasks run on the rebooted host.
+func (e *Executor) executeReboot(reboot *types.RebootTask, sudo bool) (string, error) {
+	writer := e.OutputWriter
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	timeout := reboot.RebootTimeout
+	if timeout == 0 {
+		timeout = defaultRebootTimeout
+	}
+	testCommand := reboot.TestCommand
+	if testCommand == "" {
+		testCommand = defaultRebootTestCommand
+	}
+
+	bootID, err := e.runWithStdin(bootIDCommand, nil, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to read boot id: %w", err)
+	}
+	bootID = strings.TrimSpace(bootID)
+
+	ctx := e.taskContext()
+	if err := sleepContext(ctx, time.Duration(reboot.PreRebootDelay)*time.Second); err != nil {
+		return "", err
+	}
+
+	// The remote temporary directory and the SFTP session do not survive
+	e.closeTransfers()
+
+	e.mu.Lock()
+	fmt.Fprintf(writer, "  ↻ Rebooting %s\n", e.Host.Name)
+	e.mu.Unlock()
+	start := time.Now()
+
+	// The connection usually drops before the command returns, only an exit
+	// status tells the reboot failed
+	if _, err := e.runWithStdin(rebootCommand, nil, sudo); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && exitErr.Signal() == "" {
+			return "", fmt.Errorf("failed to reboot: %w", err)
+		}
+		if ctx.Err() != nil {
+			return "", contextError(ctx)
+		}
+	}
+
+	rebootCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	timedOut := func(err error) error {
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
+		return fmt.Errorf("host did not come back within %d seconds: %w", timeout, err)
+	}
+
+	if err := waitDisconnect(rebootCtx, e.conn.Client()); err != nil {
+		return "", timedOut(err)
+	}
+	e.logVerbose("Connection lost after %s", time.Since(start).Round(time.Second))
+
+	client, err := e.waitRebooted(rebootCtx, bootID, testCommand, sudo)
+	if err != nil {
+		return "", timedOut(err)
+	}
+	e.conn.replace(client)
+
+	e.mu.Lock()
+	fmt.Fprintf(writer, "  ✓ Host back after %s\n", utils.FormatDuration(time.Since(start)))
+	e.mu.Unlock()
+
+	if err := sleepContext(ctx, time.Duration(reboot.PostRebootDelay)*time.Second); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// waitDisconnect waits until the connection is closed or the host stops
+// answering keepalives
+func waitDisconnect(ctx context.Context, client *ssh.Client) error {
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-ctx.Done():
+			return errors.New("the connection was not lost")
+		case <-time.After(rebootProbeInterval):
+		}
+
+		if !clientAlive(client, rebootProbeTimeout) {
+			return nil
+		}
+	}
+}
+
+// clientAlive reports whether the server answers a keepalive within timeout
+func clientAlive(client *ssh.Client, timeout time.Duration) bool {
+	answered := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// waitRebooted dials the host until it answers with a boot id other than
+// bootID and the test command succeeds
+func (e *Executor) waitRebooted(ctx context.Context, bootID, testCommand string, sudo bool) (*ssh.Client, error) {
+	config, address, err := sshClientConfig(e.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	attempt := 0
+	for {
+		attempt++
+		client, err := dialJumps(ctx, e.Host, address, config)
+		if err == nil {
+			if err = checkRebooted(ctx, client, bootID, testCommand, sudo); err == nil {
+				return client, nil
+			}
+			_ = client.Close()
+		}
+		e.logVerbose("Reconnection attempt %d failed: %v", attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(rebootProbeInterval):
+		}
+	}
+}
+
+// checkRebooted checks that the host booted again and runs the test command,
+// on a new client that is only swapped in once the host is ready
+func checkRebooted(ctx context.Context, client *ssh.Client, bootID, testCommand string, sudo bool) error {
+	current, err := probeCommand(ctx, client, bootIDCommand)
+	if err != nil {
+		return fmt.Errorf("failed to read boot id: %w", err)
+	}
+	if strings.TrimSpace(current) == bootID {
+		return errors.New("boot id unchanged, the host has not rebooted")
+	}
+
+	if sudo {
+		testCommand = "sudo -S " + testCommand
+	}
+	if _, err := probeCommand(ctx, client, testCommand); err != nil {
+		return fmt.Errorf("test command failed: %w", err)
+	}
+	return nil
+}
+
+// probeCommand runs a command and returns its output, giving up when ctx is
+// done
+func probeCommand(ctx context.Context, client *ssh.Client, cmd string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	type result struct {
+		output []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := session.Output(cmd)
+		done <- result{output, err}
+	}()
+
+	select {
+	case r := <-done:
+		return string(r.output), r.err
+	case <-ctx.Done():
+		return "", contextError(ctx)
+	}
+}
+
+// sleepContext waits for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return contextError(ctx)
+	case <-time.After(d):
+		return nil
+	}
+}
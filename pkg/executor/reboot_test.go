@@ -0,0 +1,205 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestDescribeReboot(t *testing.T) {
+	tests := []struct {
+		reboot types.RebootTask
+		want   string
+	}{
+		{types.RebootTask{}, "wait up to 600s"},
+		{types.RebootTask{RebootTimeout: 300, PreRebootDelay: 5, PostRebootDelay: 30}, "wait up to 300s, 5s before, 30s after"},
+		{types.RebootTask{TestCommand: "systemctl is-system-running"}, "wait up to 600s, test: systemctl is-system-running"},
+	}
+
+	for _, tt := range tests {
+		if got := describeReboot(&tt.reboot); got != tt.want {
+			t.Errorf("describeReboot(%+v) = %q, want %q", tt.reboot, got, tt.want)
+		}
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	if err := sleepContext(context.Background(), 0); err != nil {
+		t.Errorf("sleepContext(0) error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := sleepContext(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepContext() error = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("sleepContext() did not return when the context was canceled")
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// The listener accepts connections but never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	config := &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: 200 * time.Millisecond}
+	start := time.Now()
+	if _, err := dialContext(context.Background(), listener.Addr().String(), config); err == nil {
+		t.Error("dialContext() succeeded without a handshake")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("dialContext() did not apply the timeout to the handshake")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dialContext(ctx, listener.Addr().String(), config); !errors.Is(err, context.Canceled) {
+		t.Errorf("dialContext() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestExecutor_RebootDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() { types.ExecOptions.DryRun = false }()
+
+	output := &bytes.Buffer{}
+	exec := &Executor{
+		Host:           types.Host{Name: "test"},
+		Variables:      map[string]interface{}{"service": "nginx"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   output,
+	}
+
+	task := types.Task{
+		Name:   "Reboot",
+		Reboot: &types.RebootTask{RebootTimeout: 300, TestCommand: "systemctl is-active {{ .service }}"},
+		Sudo:   true,
+	}
+	if err := exec.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+
+	if want := "Reboot: wait up to 300s, test: systemctl is-active nginx"; !strings.Contains(output.String(), want) {
+		t.Errorf("output = %q, want %q", output.String(), want)
+	}
+}
+
+func TestExecutor_RebootDelegated(t *testing.T) {
+	exec := &Executor{
+		Host:           types.Host{Name: "test"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &bytes.Buffer{},
+	}
+
+	err := exec.ExecuteTask(types.Task{Name: "Reboot", Reboot: &types.RebootTask{}, DelegateTo: "other"})
+	if err == nil || !strings.Contains(err.Error(), "reboot cannot be delegated in task 'Reboot'") {
+		t.Errorf("ExecuteTask() error = %v, want a delegation error", err)
+	}
+}
+
+func TestExecutor_Reboot(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		bootID  = "boot-1"
+		server  *testSSHServer
+		ranTest bool
+	)
+	server, host := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch cmd {
+		case bootIDCommand:
+			return bootID + "\n", 0
+		case rebootCommand:
+			// The host goes down once the command returned
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				mu.Lock()
+				bootID = "boot-2"
+				mu.Unlock()
+				server.drop()
+			}()
+			return "", 0
+		case "systemctl is-system-running":
+			ranTest = true
+			return "running\n", 0
+		}
+		return "", 127
+	})
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	output := &bytes.Buffer{}
+	exec.OutputWriter = output
+
+	before := exec.conn.Client()
+	if _, err := exec.executeReboot(&types.RebootTask{RebootTimeout: 30, TestCommand: "systemctl is-system-running"}, false); err != nil {
+		t.Fatalf("executeReboot() error = %v", err)
+	}
+
+	if exec.conn.Client() == before {
+		t.Error("the connection was not replaced")
+	}
+	mu.Lock()
+	if !ranTest {
+		t.Error("the test command did not run")
+	}
+	mu.Unlock()
+	if !strings.Contains(output.String(), "Host back after") {
+		t.Errorf("output = %q, want the host back", output.String())
+	}
+
+	// The next tasks run on the new connection
+	if _, err := exec.executeCommand(bootIDCommand, false); err != nil {
+		t.Errorf("executeCommand() after reboot error = %v", err)
+	}
+}
+
+func TestExecutor_RebootCommandFails(t *testing.T) {
+	_, host := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		if cmd == bootIDCommand {
+			return "boot-1\n", 0
+		}
+		return "", 1
+	})
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	exec.OutputWriter = &bytes.Buffer{}
+
+	if _, err := exec.executeReboot(&types.RebootTask{}, false); err == nil || !strings.Contains(err.Error(), "failed to reboot") {
+		t.Errorf("executeReboot() error = %v, want a reboot failure", err)
+	}
+}
@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+const (
+	// defaultRetryDelay is the delay between attempts when retry_delay is unset
+	defaultRetryDelay = 5 * time.Second
+
+	// defaultUntilSuccessRetries is the number of retries of an until_success
+	// task without retries
+	defaultUntilSuccessRetries = 60
+
+	// maxRetryDelay saturates growing delays so they do not overflow, leaving
+	// room for the jitter
+	maxRetryDelay = time.Duration(math.MaxInt64 / 2)
+)
+
+// retryPolicy computes the number of attempts of a task and the delays
+// between them
+type retryPolicy struct {
+	Retries  int
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Backoff  string
+	Jitter   float64
+}
+
+// newRetryPolicy returns the retry policy of a task
+func newRetryPolicy(task types.Task) (retryPolicy, error) {
+	policy := retryPolicy{
+		Retries:  task.Retries,
+		Delay:    time.Duration(task.RetryDelay) * time.Second,
+		MaxDelay: time.Duration(task.RetryMaxDelay) * time.Second,
+		Backoff:  task.RetryBackoff,
+		Jitter:   task.RetryJitter,
+	}
+
+	if policy.Retries == 0 && task.UntilSuccess {
+		policy.Retries = defaultUntilSuccessRetries
+	}
+	if policy.Delay == 0 && policy.Retries > 0 {
+		policy.Delay = defaultRetryDelay
+	}
+
+	switch policy.Backoff {
+	case "":
+		policy.Backoff = "fixed"
+	case "fixed", "linear", "exponential":
+	default:
+		return policy, fmt.Errorf("invalid retry_backoff '%s' (expected fixed, linear or exponential)", policy.Backoff)
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return policy, fmt.Errorf("invalid retry_jitter %v (expected a fraction between 0 and 1)", policy.Jitter)
+	}
+	if policy.MaxDelay < 0 {
+		return policy, fmt.Errorf("invalid retry_max_delay %d", task.RetryMaxDelay)
+	}
+
+	return policy, nil
+}
+
+// baseDelay returns the delay before the given retry, 1 being the first one,
+// before jitter is applied
+func (p retryPolicy) baseDelay(retry int) time.Duration {
+	delay := p.Delay
+	switch p.Backoff {
+	case "linear":
+		if p.Delay > 0 && time.Duration(retry) > maxRetryDelay/p.Delay {
+			delay = maxRetryDelay
+		} else {
+			delay = p.Delay * time.Duration(retry)
+		}
+	case "exponential":
+		for i := 1; i < retry && (p.MaxDelay == 0 || delay < p.MaxDelay); i++ {
+			if delay > maxRetryDelay/2 {
+				delay = maxRetryDelay
+				break
+			}
+			delay *= 2
+		}
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// delay returns the delay before the given retry. The jitter spreads it
+// randomly by up to the jitter fraction either way, so hosts failing together
+// do not retry together.
+func (p retryPolicy) delay(retry int) time.Duration {
+	delay := p.baseDelay(retry)
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// String describes the policy for dry-run output
+func (p retryPolicy) String() string {
+	desc := fmt.Sprintf("%d (delay: %s, %s backoff", p.Retries, p.Delay, p.Backoff)
+	if p.MaxDelay > 0 {
+		desc += fmt.Sprintf(", max delay: %s", p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		desc += fmt.Sprintf(", jitter: %.0f%%", p.Jitter*100)
+	}
+	return desc + ")"
+}
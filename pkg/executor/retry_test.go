@@ -0,0 +1,212 @@
+package executor
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		task     types.Task
+		expected retryPolicy
+		wantErr  string
+	}{
+		{
+			name:     "no retries",
+			task:     types.Task{},
+			expected: retryPolicy{Backoff: "fixed"},
+		},
+		{
+			name:     "default delay",
+			task:     types.Task{Retries: 3},
+			expected: retryPolicy{Retries: 3, Delay: 5 * time.Second, Backoff: "fixed"},
+		},
+		{
+			name:     "until success",
+			task:     types.Task{UntilSuccess: true, RetryDelay: 2},
+			expected: retryPolicy{Retries: 60, Delay: 2 * time.Second, Backoff: "fixed"},
+		},
+		{
+			name: "exponential with max delay and jitter",
+			task: types.Task{Retries: 5, RetryDelay: 1, RetryBackoff: "exponential", RetryMaxDelay: 30, RetryJitter: 0.2},
+			expected: retryPolicy{Retries: 5, Delay: time.Second, MaxDelay: 30 * time.Second,
+				Backoff: "exponential", Jitter: 0.2},
+		},
+		{
+			name:    "unknown backoff",
+			task:    types.Task{Retries: 1, RetryBackoff: "quadratic"},
+			wantErr: "invalid retry_backoff 'quadratic'",
+		},
+		{
+			name:    "jitter out of range",
+			task:    types.Task{Retries: 1, RetryJitter: 1.5},
+			wantErr: "invalid retry_jitter 1.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newRetryPolicy(tt.task)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newRetryPolicy() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newRetryPolicy() error = %v", err)
+			}
+			if policy != tt.expected {
+				t.Errorf("newRetryPolicy() = %+v, want %+v", policy, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_BaseDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   retryPolicy
+		expected []time.Duration
+	}{
+		{
+			name:     "fixed",
+			policy:   retryPolicy{Delay: 5 * time.Second, Backoff: "fixed"},
+			expected: []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:     "linear",
+			policy:   retryPolicy{Delay: 2 * time.Second, Backoff: "linear"},
+			expected: []time.Duration{2 * time.Second, 4 * time.Second, 6 * time.Second},
+		},
+		{
+			name:     "exponential",
+			policy:   retryPolicy{Delay: time.Second, Backoff: "exponential"},
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:     "exponential capped",
+			policy:   retryPolicy{Delay: time.Second, Backoff: "exponential", MaxDelay: 5 * time.Second},
+			expected: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:     "linear capped",
+			policy:   retryPolicy{Delay: 10 * time.Second, Backoff: "linear", MaxDelay: 15 * time.Second},
+			expected: []time.Duration{10 * time.Second, 15 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, expected := range tt.expected {
+				if delay := tt.policy.baseDelay(i + 1); delay != expected {
+					t.Errorf("baseDelay(%d) = %s, want %s", i+1, delay, expected)
+				}
+			}
+		})
+	}
+
+	// Large retry counts must not overflow
+	policy := retryPolicy{Delay: time.Second, Backoff: "exponential", MaxDelay: time.Minute}
+	if delay := policy.baseDelay(200); delay != time.Minute {
+		t.Errorf("baseDelay(200) = %s, want 1m", delay)
+	}
+
+	// Without max delay, the delay saturates instead of wrapping around
+	for _, tt := range []struct {
+		policy retryPolicy
+		retry  int
+	}{
+		{retryPolicy{Delay: 5 * time.Second, Backoff: "exponential", Jitter: 1}, defaultUntilSuccessRetries},
+		{retryPolicy{Delay: 5 * time.Second, Backoff: "exponential", Jitter: 1}, math.MaxInt},
+		{retryPolicy{Delay: 5 * time.Second, Backoff: "linear", Jitter: 1}, math.MaxInt},
+	} {
+		if delay := tt.policy.baseDelay(tt.retry); delay != maxRetryDelay {
+			t.Errorf("%s baseDelay(%d) = %s, want %s", tt.policy.Backoff, tt.retry, delay, maxRetryDelay)
+		}
+		if delay := tt.policy.delay(tt.retry); delay <= 0 {
+			t.Errorf("%s delay(%d) = %s, want a positive delay", tt.policy.Backoff, tt.retry, delay)
+		}
+	}
+}
+
+func TestRetryPolicy_DelayJitter(t *testing.T) {
+	policy := retryPolicy{Delay: 10 * time.Second, Backoff: "fixed", Jitter: 0.5}
+
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		delay := policy.delay(1)
+		if delay < 5*time.Second || delay > 15*time.Second {
+			t.Fatalf("delay() = %s, want between 5s and 15s", delay)
+		}
+		seen[delay] = true
+	}
+	if len(seen) < 2 {
+		t.Error("delay() should vary with jitter")
+	}
+}
+
+func TestExecutor_RetryPolicyDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	task := types.Task{
+		Name:          "Wait for API",
+		Command:       "curl -sf http://localhost/health",
+		UntilSuccess:  true,
+		RetryBackoff:  "exponential",
+		RetryMaxDelay: 60,
+		RetryJitter:   0.1,
+	}
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+	expected := "Retries: 60 (delay: 5s, exponential backoff, max delay: 1m0s, jitter: 10%)"
+	if !strings.Contains(output.String(), expected) {
+		t.Errorf("Output should contain %q, got: %q", expected, output.String())
+	}
+
+	task.RetryBackoff = "random"
+	if err := executor.ExecuteTask(task); err == nil || !strings.Contains(err.Error(), "in task 'Wait for API'") {
+		t.Errorf("ExecuteTask() error = %v, want an invalid retry_backoff error", err)
+	}
+}
+
+func TestWaitForTimings(t *testing.T) {
+	timeout, delay, sleep, err := waitForTimings(&types.WaitForTask{Condition: "port:80"})
+	if err != nil {
+		t.Fatalf("waitForTimings() error = %v", err)
+	}
+	if timeout != 60*time.Second || delay != 0 || sleep != 2*time.Second {
+		t.Errorf("waitForTimings() = %s, %s, %s, want the defaults", timeout, delay, sleep)
+	}
+
+	timeout, delay, sleep, err = waitForTimings(&types.WaitForTask{Condition: "port:80", Timeout: 300, Delay: 10, Sleep: 5})
+	if err != nil {
+		t.Fatalf("waitForTimings() error = %v", err)
+	}
+	if timeout != 300*time.Second || delay != 10*time.Second || sleep != 5*time.Second {
+		t.Errorf("waitForTimings() = %s, %s, %s", timeout, delay, sleep)
+	}
+
+	if _, _, _, err := waitForTimings(&types.WaitForTask{Condition: "port:80", Sleep: -1}); err == nil {
+		t.Error("waitForTimings() should reject negative values")
+	}
+}
@@ -0,0 +1,72 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/fgouteroux/sshot/pkg/config"
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// runOnceKey scopes a run_once task to its play and group, so that plays and
+// groups with tasks of the same name each run their own
+func (e *Executor) runOnceKey(task types.Task) string {
+	play := ""
+	if cfg, ok := config.Cache.Get(); ok {
+		play = cfg.Playbook.Name
+	}
+	return fmt.Sprintf("%s/%s/%s", play, e.GroupName, task.Name)
+}
+
+// claimRunOnce returns the result of a run_once task, and whether the caller
+// is the first host to reach it and must run it. Checking and claiming happen
+// under the same lock so exactly one host runs the task.
+func claimRunOnce(key, host string) (*types.RunOnceResult, bool) {
+	types.RunOnceTasks.Lock()
+	defer types.RunOnceTasks.Unlock()
+
+	if result, ok := types.RunOnceTasks.Results[key]; ok {
+		return result, false
+	}
+	result := &types.RunOnceResult{Host: host, Done: make(chan struct{})}
+	types.RunOnceTasks.Results[key] = result
+	return result, true
+}
+
+// shareRunOnce waits for the host running a run_once task to finish, then
+// registers its output on this host. A failure of the task fails every host
+// sharing it.
+func (e *Executor) shareRunOnce(ctx context.Context, task types.Task, result *types.RunOnceResult) error {
+	writer := e.OutputWriter
+	if writer == nil {
+		writer = os.Stdout
+	}
+
+	select {
+	case <-result.Done:
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+
+	if result.Err != nil {
+		return fmt.Errorf("run_once task '%s' failed on %s: %w", task.Name, result.Host, result.Err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if task.Register != "" && result.Registered {
+		e.Registers[task.Register] = result.Output
+		e.Variables[task.Register] = result.Output
+		if types.ExecOptions.Verbose {
+			log.SetOutput(writer)
+			log.Printf("[VERBOSE] [%s] Registered output of %s to: %s", e.Host.Name, result.Host, task.Register)
+			log.SetOutput(os.Stderr)
+		}
+	}
+	fmt.Fprintf(writer, "  ↷ Skipped (run_once executed on %s)\n", result.Host)
+	e.CompletedTasks[task.Name] = true
+	return nil
+}
@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+// newRunOnceExecutor returns an executor of a host of the given group
+func newRunOnceExecutor(name, group string) *Executor {
+	return &Executor{
+		Host:           types.Host{Name: name},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		GroupName:      group,
+		OutputWriter:   &bytes.Buffer{},
+	}
+}
+
+func TestExecutor_RunOnceSharesRegister(t *testing.T) {
+	ResetRunOnceTracking()
+	defer ResetRunOnceTracking()
+
+	task := types.Task{
+		Name:        "Generate token",
+		LocalAction: "echo token-$$",
+		RunOnce:     true,
+		Register:    "token",
+	}
+
+	executors := make([]*Executor, 5)
+	for i := range executors {
+		executors[i] = newRunOnceExecutor(fmt.Sprintf("web%d", i+1), "web")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(executors))
+	for i, executor := range executors {
+		wg.Add(1)
+		go func(i int, executor *Executor) {
+			defer wg.Done()
+			errs[i] = executor.ExecuteTask(task)
+		}(i, executor)
+	}
+	wg.Wait()
+
+	ran := 0
+	for i, executor := range executors {
+		if errs[i] != nil {
+			t.Fatalf("ExecuteTask() on %s error = %v", executor.Host.Name, errs[i])
+		}
+		output := executor.OutputWriter.(*bytes.Buffer).String()
+		if !strings.Contains(output, "Skipped (run_once executed on") {
+			ran++
+		}
+		if !executor.CompletedTasks[task.Name] {
+			t.Errorf("task should be completed on %s", executor.Host.Name)
+		}
+	}
+	if ran != 1 {
+		t.Errorf("run_once task ran on %d hosts, want 1", ran)
+	}
+
+	token := executors[0].Registers["token"]
+	if !strings.HasPrefix(token, "token-") {
+		t.Fatalf("Registers[token] = %q, want the task output", token)
+	}
+	for _, executor := range executors[1:] {
+		if executor.Registers["token"] != token || executor.Variables["token"] != token {
+			t.Errorf("token of %s = %q, want %q", executor.Host.Name, executor.Registers["token"], token)
+		}
+	}
+}
+
+func TestExecutor_RunOnceScopedByGroup(t *testing.T) {
+	ResetRunOnceTracking()
+	defer ResetRunOnceTracking()
+
+	task := types.Task{Name: "Announce", LocalAction: "echo once", RunOnce: true}
+
+	web1 := newRunOnceExecutor("web1", "web")
+	web2 := newRunOnceExecutor("web2", "web")
+	db1 := newRunOnceExecutor("db1", "db")
+
+	for _, executor := range []*Executor{web1, web2, db1} {
+		if err := executor.ExecuteTask(task); err != nil {
+			t.Fatalf("ExecuteTask() on %s error = %v", executor.Host.Name, err)
+		}
+	}
+
+	if output := web2.OutputWriter.(*bytes.Buffer).String(); !strings.Contains(output, "Skipped (run_once executed on web1)") {
+		t.Errorf("web2 should share the result of web1, got: %q", output)
+	}
+	if output := db1.OutputWriter.(*bytes.Buffer).String(); strings.Contains(output, "Skipped") {
+		t.Errorf("db1 should run the task of its own group, got: %q", output)
+	}
+}
+
+func TestExecutor_RunOnceFailureIsShared(t *testing.T) {
+	ResetRunOnceTracking()
+	defer ResetRunOnceTracking()
+
+	task := types.Task{Name: "Migrate", LocalAction: "exit 3", RunOnce: true}
+
+	if err := newRunOnceExecutor("app1", "").ExecuteTask(task); err == nil {
+		t.Fatal("ExecuteTask() should fail on the host running the task")
+	}
+	err := newRunOnceExecutor("app2", "").ExecuteTask(task)
+	if err == nil || !strings.Contains(err.Error(), "run_once task 'Migrate' failed on app1") {
+		t.Errorf("ExecuteTask() error = %v, want the failure of app1", err)
+	}
+}
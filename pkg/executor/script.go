@@ -0,0 +1,216 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+// envNamePattern matches valid environment variable names
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// umaskPattern matches octal umask values
+var umaskPattern = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// executeScript uploads a local script to the remote temporary directory and
+// runs it, either directly or with an interpreter
+func (e *Executor) executeScript(scriptTask *types.ScriptTask, sudo bool, umask, taskName string) (string, error) {
+	if scriptTask.Path == "" {
+		return "", fmt.Errorf("script requires a path")
+	}
+
+	skip, err := e.scriptSkipReason(scriptTask, sudo)
+	if err != nil || skip != "" {
+		return skip, err
+	}
+
+	content, err := os.ReadFile(filepath.Clean(scriptTask.Path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read script: %w", err)
+	}
+
+	if scriptTask.Template {
+		rendered, err := e.renderField(taskName, "script content", string(content))
+		if err != nil {
+			return "", err
+		}
+		content = []byte(rendered)
+	}
+
+	tmpFile, err := e.uploadTemp(memorySource(scriptTask.Path, content))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload script: %w", err)
+	}
+	defer e.runCleanup("rm -f " + utils.ShellQuote(tmpFile))
+
+	var argv []string
+	if scriptTask.Interpreter != "" {
+		for _, field := range strings.Fields(scriptTask.Interpreter) {
+			argv = append(argv, utils.ShellQuote(field))
+		}
+	} else if _, err := e.runWithStdin("chmod 700 "+utils.ShellQuote(tmpFile), nil, false); err != nil {
+		return "", fmt.Errorf("failed to upload script: %w", err)
+	}
+	argv = append(argv, utils.ShellQuote(tmpFile))
+	for _, arg := range scriptTask.Args {
+		argv = append(argv, utils.ShellQuote(arg))
+	}
+
+	cmd, err := buildRemoteCommand(strings.Join(argv, " "), scriptTask.Env, scriptTask.Chdir, umask)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := e.executeCommand(cmd, sudo)
+	if err != nil {
+		return output, fmt.Errorf("failed to execute script: %w", err)
+	}
+	return output, nil
+}
+
+// scriptSkipReason checks the creates and removes paths of a script task and
+// returns why it should not run, if it should not
+func (e *Executor) scriptSkipReason(scriptTask *types.ScriptTask, sudo bool) (string, error) {
+	if scriptTask.Creates == "" && scriptTask.Removes == "" {
+		return "", nil
+	}
+
+	var checks []string
+	if scriptTask.Creates != "" {
+		checks = append(checks, fmt.Sprintf("if [ -e %s ]; then echo creates; fi", remotePath(scriptTask.Creates)))
+	}
+	if scriptTask.Removes != "" {
+		checks = append(checks, fmt.Sprintf("if [ ! -e %s ]; then echo removes; fi", remotePath(scriptTask.Removes)))
+	}
+
+	output, err := e.runWithStdin("sh -c "+utils.ShellQuote(strings.Join(checks, "; ")), nil, sudo)
+	if err != nil {
+		return "", fmt.Errorf("failed to check creates/removes paths: %w", err)
+	}
+
+	switch {
+	case strings.Contains(output, "creates"):
+		return fmt.Sprintf("Skipped, %s exists", scriptTask.Creates), nil
+	case strings.Contains(output, "removes"):
+		return fmt.Sprintf("Skipped, %s does not exist", scriptTask.Removes), nil
+	}
+	return "", nil
+}
+
+// renderScriptTask renders the templated fields of a script task
+func (e *Executor) renderScriptTask(taskName string, scriptTask types.ScriptTask) (types.ScriptTask, error) {
+	var err error
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"script path", &scriptTask.Path},
+		{"script interpreter", &scriptTask.Interpreter},
+		{"script chdir", &scriptTask.Chdir},
+		{"script creates", &scriptTask.Creates},
+		{"script removes", &scriptTask.Removes},
+	}
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+		if *f.value, err = e.renderField(taskName, f.name, *f.value); err != nil {
+			return scriptTask, err
+		}
+	}
+
+	if len(scriptTask.Args) > 0 {
+		args := make([]string, len(scriptTask.Args))
+		for i, arg := range scriptTask.Args {
+			if args[i], err = e.renderField(taskName, "script args", arg); err != nil {
+				return scriptTask, err
+			}
+		}
+		scriptTask.Args = args
+	}
+
+	if len(scriptTask.Env) > 0 {
+		env := make(map[string]string, len(scriptTask.Env))
+		for name, value := range scriptTask.Env {
+			if env[name], err = e.renderField(taskName, "script env "+name, value); err != nil {
+				return scriptTask, err
+			}
+		}
+		scriptTask.Env = env
+	}
+
+	return scriptTask, nil
+}
+
+// buildRemoteCommand wraps a command so it runs in chdir with the given
+// environment and umask. The wrapper is a single sh -c so it also applies
+// under sudo, which would otherwise reset the environment.
+func buildRemoteCommand(cmd string, env map[string]string, chdir, umask string) (string, error) {
+	if len(env) == 0 && chdir == "" && umask == "" {
+		return cmd, nil
+	}
+
+	var parts []string
+	if umask != "" {
+		if !umaskPattern.MatchString(umask) {
+			return "", fmt.Errorf("invalid umask '%s' (expected an octal value such as 0027)", umask)
+		}
+		parts = append(parts, "umask "+umask)
+	}
+	if chdir != "" {
+		parts = append(parts, "cd "+remotePath(chdir))
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		if !envNamePattern.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable name '%s'", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("export %s=%s", name, utils.ShellQuote(env[name])))
+	}
+
+	parts = append(parts, cmd)
+	return "sh -c " + utils.ShellQuote(strings.Join(parts, " && ")), nil
+}
+
+// taskEnvironment returns the play environment overridden by the task one
+func (e *Executor) taskEnvironment(task types.Task) map[string]string {
+	return mergeEnvironment(e.Environment, task.Environment)
+}
+
+// mergeEnvironment returns base overridden by override
+func mergeEnvironment(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+	if len(override) == 0 {
+		return base
+	}
+	merged := make(map[string]string, len(base)+len(override))
+	for name, value := range base {
+		merged[name] = value
+	}
+	for name, value := range override {
+		merged[name] = value
+	}
+	return merged
+}
+
+// remotePath quotes a remote path for the shell, expanding a leading ~ to the
+// home directory of the remote user
+func remotePath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return `"$HOME"` + utils.ShellQuote(strings.TrimPrefix(p, "~"))
+	}
+	return utils.ShellQuote(p)
+}
@@ -0,0 +1,182 @@
+package executor
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestBuildRemoteCommand(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "work dir")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	cmd, err := buildRemoteCommand(`echo "$PWD|$GREETING|$EMPTY"`, map[string]string{
+		"GREETING": "it's $HOME",
+		"EMPTY":    "",
+	}, dir, "")
+	if err != nil {
+		t.Fatalf("buildRemoteCommand() error = %v", err)
+	}
+
+	output, err := exec.Command("/bin/sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatalf("command failed: %v\n%s", err, cmd)
+	}
+	if expected := dir + "|it's $HOME|\n"; string(output) != expected {
+		t.Errorf("output = %q, want %q", string(output), expected)
+	}
+
+	// Without environment or directory the command is unchanged
+	if cmd, _ := buildRemoteCommand("uptime", nil, "", ""); cmd != "uptime" {
+		t.Errorf("buildRemoteCommand() = %q, want the command unchanged", cmd)
+	}
+
+	if _, err := buildRemoteCommand("uptime", map[string]string{"BAD-NAME": "x"}, "", ""); err == nil {
+		t.Error("buildRemoteCommand() should reject invalid variable names")
+	}
+}
+
+func TestRemotePath(t *testing.T) {
+	tests := map[string]string{
+		"/srv/app":     "/srv/app",
+		"/srv/my app":  "'/srv/my app'",
+		"~":            `"$HOME"''`,
+		"~/.cache/app": `"$HOME"/.cache/app`,
+		"~other/file":  "'~other/file'",
+	}
+	for p, expected := range tests {
+		if result := remotePath(p); result != expected {
+			t.Errorf("remotePath(%q) = %q, want %q", p, result, expected)
+		}
+	}
+}
+
+func TestExecutor_RenderScriptTask(t *testing.T) {
+	executor := &Executor{
+		Variables: map[string]interface{}{"env": "prod", "dir": "/srv/app"},
+	}
+
+	script, err := executor.renderScriptTask("Migrate", types.ScriptTask{
+		Path:    "scripts/migrate.sh",
+		Args:    []string{"--env", "{{ .env }}"},
+		Env:     map[string]string{"APP_ENV": "{{ .env }}"},
+		Chdir:   "{{ .dir }}",
+		Creates: "{{ .dir }}/.migrated",
+	})
+	if err != nil {
+		t.Fatalf("renderScriptTask() error = %v", err)
+	}
+	if script.Args[1] != "prod" || script.Env["APP_ENV"] != "prod" || script.Chdir != "/srv/app" || script.Creates != "/srv/app/.migrated" {
+		t.Errorf("renderScriptTask() = %+v", script)
+	}
+
+	_, err = executor.renderScriptTask("Migrate", types.ScriptTask{Path: "x.sh", Args: []string{"{{ .missing }}"}})
+	if err == nil || !strings.Contains(err.Error(), "in script args of task 'Migrate'") {
+		t.Errorf("renderScriptTask() error = %v, want an error naming the field", err)
+	}
+}
+
+func TestExecutor_ExecuteScriptTaskArgsDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      map[string]interface{}{"env": "staging"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	task := types.Task{
+		Name: "Migrate",
+		Script: &types.ScriptTask{
+			Path:        "scripts/migrate.py",
+			Interpreter: "python3",
+			Args:        []string{"--env", "{{ .env }}"},
+		},
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+	if !strings.Contains(output.String(), "Script: scripts/migrate.py --env staging") {
+		t.Errorf("Output should describe the script and its arguments, got: %q", output.String())
+	}
+	if !strings.Contains(output.String(), "Interpreter: python3") {
+		t.Errorf("Output should show the interpreter, got: %q", output.String())
+	}
+}
+
+func TestBuildRemoteCommandUmask(t *testing.T) {
+	dir := t.TempDir()
+
+	cmd, err := buildRemoteCommand("touch created && stat -c %a created", nil, dir, "0027")
+	if err != nil {
+		t.Fatalf("buildRemoteCommand() error = %v", err)
+	}
+	output, err := exec.Command("/bin/sh", "-c", cmd).Output()
+	if err != nil {
+		t.Fatalf("command failed: %v\n%s", err, cmd)
+	}
+	if strings.TrimSpace(string(output)) != "640" {
+		t.Errorf("file mode = %s, want 640 with umask 0027", strings.TrimSpace(string(output)))
+	}
+
+	if _, err := buildRemoteCommand("true", nil, "", "0999; reboot"); err == nil {
+		t.Error("buildRemoteCommand() should reject invalid umask values")
+	}
+}
+
+func TestExecutor_TaskEnvironment(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      map[string]interface{}{"env": "prod"},
+		Environment:    map[string]string{"LANG": "C", "APP_ENV": "dev"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	task := types.Task{
+		Name:        "Deploy",
+		Command:     "deploy",
+		Environment: map[string]string{"APP_ENV": "{{ .env }}"},
+		Chdir:       "/srv/app",
+		Umask:       "0022",
+	}
+
+	rendered, err := executor.renderTask(task)
+	if err != nil {
+		t.Fatalf("renderTask() error = %v", err)
+	}
+	env := executor.taskEnvironment(rendered)
+	if env["APP_ENV"] != "prod" || env["LANG"] != "C" {
+		t.Errorf("taskEnvironment() = %v, want the task value to override the play one", env)
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+	for _, expected := range []string{"Environment: APP_ENV, LANG", "Chdir: /srv/app", "Umask: 0022"} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Output should contain %q, got: %q", expected, output.String())
+		}
+	}
+}
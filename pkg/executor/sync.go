@@ -0,0 +1,396 @@
+package executor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+// syncEntry describes a file, directory or symlink of a synchronized tree
+type syncEntry struct {
+	Kind     byte // 'f' file, 'd' directory, 'l' symlink
+	Size     int64
+	ModTime  int64
+	Mode     os.FileMode
+	Target   string
+	Checksum string
+	Path     string // local path, only set for local entries
+}
+
+// syncPlan lists the operations needed to bring the remote tree up to date
+type syncPlan struct {
+	Dirs     []string
+	Files    []string
+	Links    []string
+	Chmods   []string
+	Deletes  []string
+	Replaced map[string]bool
+}
+
+func (p syncPlan) empty() bool {
+	return len(p.Dirs) == 0 && len(p.Files) == 0 && len(p.Links) == 0 && len(p.Chmods) == 0 && len(p.Deletes) == 0
+}
+
+// executeSync pushes a local directory tree to the remote host, transferring
+// only changed files
+func (e *Executor) executeSync(syncTask *types.SyncTask, sudo bool) (string, error) {
+	compare := syncTask.Compare
+	if compare == "" {
+		compare = "mtime"
+	}
+	if compare != "size" && compare != "mtime" && compare != "checksum" {
+		return "", fmt.Errorf("invalid sync compare mode: %s (expected size, mtime or checksum)", compare)
+	}
+
+	local, err := walkLocalTree(syncTask.Src, syncTask.Exclude, compare == "checksum")
+	if err != nil {
+		return "", err
+	}
+
+	remote, err := e.listRemoteTree(syncTask.Dest, compare == "checksum", sudo)
+	if err != nil {
+		return "", err
+	}
+
+	plan := planSync(local, remote, compare, syncTask.Exclude, syncTask.Delete)
+
+	if !types.ExecOptions.Check && !plan.empty() {
+		if err := e.applySync(syncTask.Dest, local, plan, sudo); err != nil {
+			return "", err
+		}
+	}
+
+	return formatSyncReport(syncTask, plan), nil
+}
+
+// walkLocalTree collects the entries below root, keyed by slash separated
+// relative path
+func walkLocalTree(root string, exclude []string, checksums bool) (map[string]syncEntry, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("sync source %s is not a directory", root)
+	}
+
+	entries := make(map[string]syncEntry)
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if isExcluded(rel, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := syncEntry{Mode: info.Mode().Perm(), ModTime: info.ModTime().Unix(), Path: p}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Kind = 'l'
+			if entry.Target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.IsDir():
+			entry.Kind = 'd'
+		case info.Mode().IsRegular():
+			entry.Kind = 'f'
+			entry.Size = info.Size()
+			if checksums {
+				if entry.Checksum, err = fileChecksum(p); err != nil {
+					return err
+				}
+			}
+		default:
+			// Sockets, devices and pipes are not synchronized
+			return nil
+		}
+
+		entries[rel] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+
+	return entries, nil
+}
+
+// isExcluded matches a relative path against exclude globs. A pattern matches
+// the full relative path or any single path component, so "*.log" excludes
+// log files at any depth and "cache" excludes every directory named cache.
+func isExcluded(rel string, exclude []string) bool {
+	for _, pattern := range exclude {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		for _, part := range strings.Split(rel, "/") {
+			if ok, _ := path.Match(pattern, part); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// listRemoteTree lists the entries below dest on the remote host
+func (e *Executor) listRemoteTree(dest string, checksums bool, sudo bool) (map[string]syncEntry, error) {
+	output, err := e.runOutput("sh -c "+utils.ShellQuote(remoteListingScript(dest, checksums)), sudo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", dest, err)
+	}
+
+	entries, sums := parseRemoteListing(output)
+	for rel, sum := range sums {
+		if entry, ok := entries[rel]; ok {
+			entry.Checksum = sum
+			entries[rel] = entry
+		}
+	}
+	return entries, nil
+}
+
+// remoteListingScript lists a tree with GNU find, as NUL separated
+// "type size mtime mode path" and link target pairs, optionally followed by
+// sha256 checksums of the files
+func remoteListingScript(dest string, checksums bool) string {
+	script := fmt.Sprintf(`d=%s; [ -d "$d" ] || exit 0; find "$d" -mindepth 1 -printf '%%y %%s %%T@ %%m %%P\0%%l\0'`, remotePath(dest))
+	if checksums {
+		script += ` && printf '\0SUMS\0' && cd "$d" && find . -type f -exec sha256sum {} +`
+	}
+	return script
+}
+
+// parseRemoteListing parses the output of the find/sha256sum listing
+func parseRemoteListing(output string) (map[string]syncEntry, map[string]string) {
+	entries := make(map[string]syncEntry)
+	sums := make(map[string]string)
+
+	listing, sumsOutput, _ := strings.Cut(output, "\x00SUMS\x00")
+	fields := strings.Split(listing, "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		parts := strings.SplitN(fields[i], " ", 5)
+		if len(parts) != 5 {
+			continue
+		}
+		size, _ := strconv.ParseInt(parts[1], 10, 64)
+		mtime, _ := strconv.ParseFloat(parts[2], 64)
+		mode, _ := strconv.ParseUint(parts[3], 8, 32)
+		entry := syncEntry{
+			Kind:    parts[0][0],
+			Size:    size,
+			ModTime: int64(mtime),
+			Mode:    os.FileMode(mode),
+			Target:  fields[i+1],
+		}
+		entries[parts[4]] = entry
+	}
+
+	for _, line := range strings.Split(sumsOutput, "\n") {
+		sum, name, ok := strings.Cut(line, "  ")
+		if ok {
+			sums[strings.TrimPrefix(name, "./")] = sum
+		}
+	}
+
+	return entries, sums
+}
+
+// planSync compares the local and remote trees
+func planSync(local, remote map[string]syncEntry, compare string, exclude []string, deleteExtra bool) syncPlan {
+	plan := syncPlan{Replaced: make(map[string]bool)}
+
+	paths := make([]string, 0, len(local))
+	for rel := range local {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		l := local[rel]
+		r, exists := remote[rel]
+		if exists && r.Kind != l.Kind {
+			// A file became a directory or the other way round
+			plan.Replaced[rel] = true
+			exists = false
+		}
+
+		switch l.Kind {
+		case 'd':
+			if !exists {
+				plan.Dirs = append(plan.Dirs, rel)
+			} else if r.Mode != l.Mode {
+				plan.Chmods = append(plan.Chmods, rel)
+			}
+		case 'l':
+			if !exists || r.Target != l.Target {
+				plan.Links = append(plan.Links, rel)
+			}
+		case 'f':
+			if !exists || fileDiffers(l, r, compare) {
+				plan.Files = append(plan.Files, rel)
+			} else if r.Mode != l.Mode {
+				plan.Chmods = append(plan.Chmods, rel)
+			}
+		}
+	}
+
+	if deleteExtra {
+		var extras []string
+		for rel := range remote {
+			if _, ok := local[rel]; !ok && !isExcluded(rel, exclude) {
+				extras = append(extras, rel)
+			}
+		}
+		sort.Strings(extras)
+		// Removing a directory removes its content, so only keep the topmost paths
+		for _, rel := range extras {
+			if n := len(plan.Deletes); n > 0 && strings.HasPrefix(rel, plan.Deletes[n-1]+"/") {
+				continue
+			}
+			plan.Deletes = append(plan.Deletes, rel)
+		}
+	}
+
+	return plan
+}
+
+func fileDiffers(local, remote syncEntry, compare string) bool {
+	switch compare {
+	case "size":
+		return local.Size != remote.Size
+	case "checksum":
+		return local.Checksum != remote.Checksum
+	default:
+		return local.Size != remote.Size || local.ModTime != remote.ModTime
+	}
+}
+
+// applySync runs the plan: removals, directories and links first, then files,
+// then modes
+func (e *Executor) applySync(dest string, local map[string]syncEntry, plan syncPlan, sudo bool) error {
+	var b strings.Builder
+	b.WriteString("set -e\n")
+	fmt.Fprintf(&b, "d=%s\n", remotePath(dest))
+	b.WriteString(`mkdir -p "$d"` + "\n")
+	for _, rel := range plan.Deletes {
+		fmt.Fprintf(&b, "rm -rf \"$d\"/%s\n", utils.ShellQuote(rel))
+	}
+	for rel := range plan.Replaced {
+		fmt.Fprintf(&b, "rm -rf \"$d\"/%s\n", utils.ShellQuote(rel))
+	}
+	for _, rel := range plan.Dirs {
+		fmt.Fprintf(&b, "mkdir -p \"$d\"/%s\n", utils.ShellQuote(rel))
+	}
+	for _, rel := range plan.Links {
+		fmt.Fprintf(&b, "ln -sfn %s \"$d\"/%s\n", utils.ShellQuote(local[rel].Target), utils.ShellQuote(rel))
+	}
+
+	if _, err := e.runOutput("sh -c "+utils.ShellQuote(b.String()), sudo); err != nil {
+		return fmt.Errorf("failed to prepare %s: %w", dest, err)
+	}
+
+	for _, rel := range plan.Files {
+		entry := local[rel]
+		src := fileSource{Name: rel, Path: entry.Path, Size: entry.Size, ModTime: time.Unix(entry.ModTime, 0)}
+		if err := e.putFile(src, path.Join(dest, rel), entry.Mode, sudo); err != nil {
+			return err
+		}
+	}
+
+	// Modes are applied last, deepest first, so restrictive directory modes
+	// don't block the upload of their content
+	modes := append(append([]string(nil), plan.Dirs...), plan.Chmods...)
+	if len(modes) == 0 {
+		return nil
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(modes)))
+
+	b.Reset()
+	b.WriteString("set -e\n")
+	fmt.Fprintf(&b, "d=%s\n", remotePath(dest))
+	for _, rel := range modes {
+		fmt.Fprintf(&b, "chmod %o \"$d\"/%s\n", local[rel].Mode, utils.ShellQuote(rel))
+	}
+	if _, err := e.runOutput("sh -c "+utils.ShellQuote(b.String()), sudo); err != nil {
+		return fmt.Errorf("failed to set modes in %s: %w", dest, err)
+	}
+
+	return nil
+}
+
+// formatSyncReport lists the changed paths
+func formatSyncReport(syncTask *types.SyncTask, plan syncPlan) string {
+	if plan.empty() {
+		return fmt.Sprintf("%s is up to date (unchanged)", syncTask.Dest)
+	}
+
+	var b bytes.Buffer
+	verb := "Synced"
+	if types.ExecOptions.Check {
+		verb = "Would sync"
+	}
+	fmt.Fprintf(&b, "%s %s to %s (changed): %d updated, %d deleted\n", verb, syncTask.Src, syncTask.Dest,
+		len(plan.Dirs)+len(plan.Files)+len(plan.Links)+len(plan.Chmods), len(plan.Deletes))
+
+	var lines []string
+	for _, rel := range plan.Dirs {
+		lines = append(lines, "created  "+rel+"/")
+	}
+	for _, rel := range plan.Files {
+		lines = append(lines, "updated  "+rel)
+	}
+	for _, rel := range plan.Links {
+		lines = append(lines, "linked   "+rel)
+	}
+	for _, rel := range plan.Chmods {
+		lines = append(lines, "chmod    "+rel)
+	}
+	for _, rel := range plan.Deletes {
+		lines = append(lines, "deleted  "+rel)
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i][9:] < lines[j][9:] })
+	b.WriteString(strings.Join(lines, "\n"))
+	return b.String()
+}
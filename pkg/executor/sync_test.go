@@ -0,0 +1,236 @@
+package executor
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestIsExcluded(t *testing.T) {
+	exclude := []string{"*.log", ".git", "cache/", "assets/*.map"}
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"index.html", false},
+		{"app.log", true},
+		{"logs/deep/app.log", true},
+		{".git", true},
+		{".git/config", true},
+		{"cache", true},
+		{"tmp/cache/file", true},
+		{"assets/app.map", true},
+		{"assets/app.js", false},
+		{"other/app.map", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if result := isExcluded(tt.path, exclude); result != tt.expected {
+				t.Errorf("isExcluded(%q) = %v, want %v", tt.path, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	local := map[string]syncEntry{
+		"css":          {Kind: 'd', Mode: 0755},
+		"css/site.css": {Kind: 'f', Size: 10, ModTime: 100, Mode: 0644},
+		"index.html":   {Kind: 'f', Size: 20, ModTime: 200, Mode: 0644},
+		"run.sh":       {Kind: 'f', Size: 5, ModTime: 50, Mode: 0755},
+		"current":      {Kind: 'l', Target: "releases/v2"},
+		"new":          {Kind: 'd', Mode: 0755},
+	}
+	remote := map[string]syncEntry{
+		"css":          {Kind: 'd', Mode: 0755},
+		"css/site.css": {Kind: 'f', Size: 10, ModTime: 100, Mode: 0644},
+		"index.html":   {Kind: 'f', Size: 20, ModTime: 150, Mode: 0644},
+		"run.sh":       {Kind: 'f', Size: 5, ModTime: 50, Mode: 0644},
+		"current":      {Kind: 'l', Target: "releases/v1"},
+		"old":          {Kind: 'd', Mode: 0755},
+		"old/page":     {Kind: 'f', Size: 1, Mode: 0644},
+		"debug.log":    {Kind: 'f', Size: 1, Mode: 0644},
+	}
+
+	plan := planSync(local, remote, "mtime", []string{"*.log"}, true)
+
+	if !reflect.DeepEqual(plan.Dirs, []string{"new"}) {
+		t.Errorf("Dirs = %v, want [new]", plan.Dirs)
+	}
+	if !reflect.DeepEqual(plan.Files, []string{"index.html"}) {
+		t.Errorf("Files = %v, want [index.html]", plan.Files)
+	}
+	if !reflect.DeepEqual(plan.Links, []string{"current"}) {
+		t.Errorf("Links = %v, want [current]", plan.Links)
+	}
+	if !reflect.DeepEqual(plan.Chmods, []string{"run.sh"}) {
+		t.Errorf("Chmods = %v, want [run.sh]", plan.Chmods)
+	}
+	// old/page is removed along with old, excluded files are kept
+	if !reflect.DeepEqual(plan.Deletes, []string{"old"}) {
+		t.Errorf("Deletes = %v, want [old]", plan.Deletes)
+	}
+
+	// With size comparison the mtime change is ignored
+	plan = planSync(local, remote, "size", nil, false)
+	if len(plan.Files) != 0 {
+		t.Errorf("Files = %v, want none with size comparison", plan.Files)
+	}
+	if len(plan.Deletes) != 0 {
+		t.Errorf("Deletes = %v, want none without delete", plan.Deletes)
+	}
+}
+
+func TestRemoteListingScript(t *testing.T) {
+	if _, err := exec.LookPath("find"); err != nil {
+		t.Skip("find is not available")
+	}
+	if out, err := exec.Command("find", "--version").CombinedOutput(); err != nil || !strings.Contains(string(out), "GNU") {
+		t.Skip("GNU find is required")
+	}
+
+	root := t.TempDir()
+	src := filepath.Join(root, "site")
+	if err := os.MkdirAll(filepath.Join(src, "my css"), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "my css", "site.css"), []byte("body {}"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Symlink("my css/site.css", filepath.Join(src, "link")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(filepath.Join(src, "my css", "site.css"), mtime, mtime); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+
+	output, err := exec.Command("/bin/sh", "-c", remoteListingScript(src, true)).Output()
+	if err != nil {
+		t.Fatalf("listing script failed: %v", err)
+	}
+
+	remote, sums := parseRemoteListing(string(output))
+	local, err := walkLocalTree(src, nil, true)
+	if err != nil {
+		t.Fatalf("walkLocalTree() error = %v", err)
+	}
+
+	for rel, sum := range sums {
+		entry := remote[rel]
+		entry.Checksum = sum
+		remote[rel] = entry
+	}
+
+	for rel, l := range local {
+		r, ok := remote[rel]
+		if !ok {
+			t.Errorf("remote listing is missing %q", rel)
+			continue
+		}
+		if r.Kind != l.Kind {
+			t.Errorf("%s: kind = %c, want %c", rel, r.Kind, l.Kind)
+		}
+		if l.Kind == 'f' && (r.Size != l.Size || r.ModTime != l.ModTime || r.Checksum != l.Checksum || r.Mode != l.Mode) {
+			t.Errorf("%s: remote %+v does not match local %+v", rel, r, l)
+		}
+		if l.Kind == 'l' && r.Target != l.Target {
+			t.Errorf("%s: target = %q, want %q", rel, r.Target, l.Target)
+		}
+	}
+
+	plan := planSync(local, remote, "checksum", nil, true)
+	if !plan.empty() {
+		t.Errorf("identical trees should produce an empty plan, got %+v", plan)
+	}
+
+	// A missing destination is an empty tree
+	output, err = exec.Command("/bin/sh", "-c", remoteListingScript(filepath.Join(root, "missing"), false)).Output()
+	if err != nil {
+		t.Fatalf("listing script failed on a missing directory: %v", err)
+	}
+	if entries, _ := parseRemoteListing(string(output)); len(entries) != 0 {
+		t.Errorf("missing directory should list no entries, got %v", entries)
+	}
+}
+
+func TestExecutor_ExecuteSyncTaskDryRun(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      map[string]interface{}{"site": "blog"},
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &strings.Builder{},
+	}
+
+	task := types.Task{
+		Name: "Deploy site",
+		Sync: &types.SyncTask{
+			Src:    "public/",
+			Dest:   "/var/www/{{ .site }}",
+			Delete: true,
+		},
+	}
+
+	if err := executor.ExecuteTask(task); err != nil {
+		t.Fatalf("ExecuteTask() error = %v", err)
+	}
+
+	output := executor.OutputWriter.(*strings.Builder).String()
+	if !strings.Contains(output, "Sync: public/ → /var/www/blog") {
+		t.Errorf("Output should describe the sync task, got: %q", output)
+	}
+	if !strings.Contains(output, "deleting remote files") {
+		t.Errorf("Output should mention deletion, got: %q", output)
+	}
+}
+
+func TestExecutor_ListRemoteTreeQuiet(t *testing.T) {
+	server, host := newTestSSHServer(t, func(string) (string, uint32) {
+		return "f 5 1700000000.0 644 app.conf\x00\x00d 4096 1700000000.0 755 conf.d\x00\x00", 0
+	})
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	output := &bytes.Buffer{}
+	exec.OutputWriter = output
+
+	types.ExecOptions.Progress = true
+	defer func() { types.ExecOptions.Progress = false }()
+
+	entries, err := exec.listRemoteTree("/srv/app", false, false)
+	if err != nil {
+		t.Fatalf("listRemoteTree() error = %v", err)
+	}
+	if len(entries) != 2 || entries["app.conf"].Size != 5 || entries["conf.d"].Kind != 'd' {
+		t.Errorf("listRemoteTree() = %+v, want app.conf and conf.d", entries)
+	}
+	if output.Len() > 0 {
+		t.Errorf("output = %q, want the listing kept quiet", output.String())
+	}
+
+	// An unreadable directory fails the listing instead of adding entries
+	server.mu.Lock()
+	server.stderr = func(string) string { return "find: '/srv/app/private': Permission denied\n" }
+	server.mu.Unlock()
+	if _, err := exec.listRemoteTree("/srv/app", false, false); err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Errorf("listRemoteTree() error = %v, want the error output", err)
+	}
+}
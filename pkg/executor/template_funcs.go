@@ -0,0 +1,261 @@
+package executor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// passwordChars is the alphabet used by the randomPassword template function
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.+!#%"
+
+// templateFuncs returns the helper functions available in every template.
+// Functions taking the value as their last argument can be used in pipelines,
+// e.g. {{ .name | upper }} or {{ .path | replace "/" "_" }}.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"default": func(def interface{}, given ...interface{}) interface{} {
+			if len(given) == 0 || isEmptyValue(given[0]) {
+				return def
+			}
+			return given[0]
+		},
+		"upper": func(v interface{}) string { return strings.ToUpper(toString(v)) },
+		"lower": func(v interface{}) string { return strings.ToLower(toString(v)) },
+		"trim":  func(v interface{}) string { return strings.TrimSpace(toString(v)) },
+		"replace": func(old, new string, v interface{}) string {
+			return strings.ReplaceAll(toString(v), old, new)
+		},
+		"regexReplace": func(pattern, repl string, v interface{}) (string, error) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return "", fmt.Errorf("invalid regex %q: %w", pattern, err)
+			}
+			return re.ReplaceAllString(toString(v), repl), nil
+		},
+		"split": func(sep string, v interface{}) []string { return strings.Split(toString(v), sep) },
+		"join":  func(sep string, v interface{}) string { return strings.Join(toStringSlice(v), sep) },
+		"toJson": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			return string(data), nil
+		},
+		"toYaml": func(v interface{}) (string, error) {
+			data, err := yaml.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSuffix(string(data), "\n"), nil
+		},
+		"fromJson": func(v interface{}) (interface{}, error) {
+			var out interface{}
+			if err := json.Unmarshal([]byte(toString(v)), &out); err != nil {
+				return nil, fmt.Errorf("fromJson: %w", err)
+			}
+			return out, nil
+		},
+		"b64enc": func(v interface{}) string { return base64.StdEncoding.EncodeToString([]byte(toString(v))) },
+		"b64dec": func(v interface{}) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(toString(v))
+			if err != nil {
+				return "", fmt.Errorf("b64dec: %w", err)
+			}
+			return string(data), nil
+		},
+		"sha256": func(v interface{}) string {
+			sum := sha256.Sum256([]byte(toString(v)))
+			return hex.EncodeToString(sum[:])
+		},
+		"quote":      func(v interface{}) string { return strconv.Quote(toString(v)) },
+		"shellquote": func(v interface{}) string { return utils.ShellQuote(toString(v)) },
+		"indent": func(n int, v interface{}) string {
+			pad := strings.Repeat(" ", n)
+			return pad + strings.ReplaceAll(toString(v), "\n", "\n"+pad)
+		},
+		"env":  os.Getenv,
+		"now":  time.Now,
+		"date": formatDate,
+		"uuid": newUUID,
+		"ipaddr": func(v interface{}) (string, error) {
+			ip, _, err := parseAddr(toString(v))
+			if err != nil {
+				return "", err
+			}
+			return ip.String(), nil
+		},
+		"cidr": func(v interface{}) (string, error) {
+			_, network, err := parseAddr(toString(v))
+			if err != nil {
+				return "", err
+			}
+			return network.String(), nil
+		},
+		"cidrHost":    cidrHost,
+		"cidrNetmask": cidrNetmask,
+		"randomPassword": func(length int) (string, error) {
+			if length <= 0 {
+				return "", fmt.Errorf("randomPassword: length must be positive")
+			}
+			max := big.NewInt(int64(len(passwordChars)))
+			buf := make([]byte, length)
+			for i := range buf {
+				n, err := rand.Int(rand.Reader, max)
+				if err != nil {
+					return "", err
+				}
+				buf[i] = passwordChars[n.Int64()]
+			}
+			return string(buf), nil
+		},
+	}
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+func toStringSlice(v interface{}) []string {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case []string:
+		return val
+	case []interface{}:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			out = append(out, toString(item))
+		}
+		return out
+	default:
+		return []string{toString(val)}
+	}
+}
+
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Bool:
+		return !rv.Bool()
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// formatDate formats a time.Time or a unix timestamp using a Go layout string
+func formatDate(layout string, v interface{}) (string, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(layout), nil
+	case int:
+		return time.Unix(int64(t), 0).Format(layout), nil
+	case int64:
+		return time.Unix(t, 0).Format(layout), nil
+	case float64:
+		return time.Unix(int64(t), 0).Format(layout), nil
+	}
+	return "", fmt.Errorf("date: unsupported time value %v", v)
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// parseAddr accepts either a bare IP address or an address in CIDR notation.
+// A bare address is treated as a single-host network.
+func parseAddr(s string) (net.IP, *net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		ip, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid address %q: %w", s, err)
+		}
+		return ip, network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// cidrHost returns the n-th address of a network, e.g. {{ cidrHost 1 "10.0.0.0/24" }}
+func cidrHost(n int, v interface{}) (string, error) {
+	_, network, err := parseAddr(toString(v))
+	if err != nil {
+		return "", err
+	}
+	ones, bits := network.Mask.Size()
+	if n < 0 || (bits-ones < 63 && uint64(n) >= uint64(1)<<uint(bits-ones)) {
+		return "", fmt.Errorf("cidrHost: host number %d out of range for %s", n, network)
+	}
+
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	// Add n to the lowest 8 bytes of the address
+	offset := len(ip) - 8
+	if offset < 0 {
+		offset = 0
+	}
+	low := make([]byte, 8)
+	copy(low[8-(len(ip)-offset):], ip[offset:])
+	sum := binary.BigEndian.Uint64(low) + uint64(n)
+	binary.BigEndian.PutUint64(low, sum)
+	copy(ip[offset:], low[8-(len(ip)-offset):])
+	return ip.String(), nil
+}
+
+// cidrNetmask returns the dotted netmask of an IPv4 network
+func cidrNetmask(v interface{}) (string, error) {
+	_, network, err := parseAddr(toString(v))
+	if err != nil {
+		return "", err
+	}
+	if len(network.Mask) != net.IPv4len {
+		return "", fmt.Errorf("cidrNetmask: %s is not an IPv4 network", network)
+	}
+	return net.IP(network.Mask).String(), nil
+}
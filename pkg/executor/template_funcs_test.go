@@ -0,0 +1,110 @@
+package executor
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExecutor_SubstituteVarsFunctions(t *testing.T) {
+	t.Setenv("SSHOT_TEST_ENV", "from-env")
+
+	executor := &Executor{
+		Variables: map[string]interface{}{
+			"name":    "Web Server",
+			"empty":   "",
+			"path":    "/var/www/my site",
+			"csv":     "a,b,c",
+			"list":    []interface{}{"x", "y", "z"},
+			"port":    8080,
+			"nested":  map[string]interface{}{"key": "value"},
+			"json":    `{"enabled":true}`,
+			"encoded": "aGVsbG8=",
+			"network": "10.1.2.3/24",
+			"multi":   "line1\nline2",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"default with value", `{{ .name | default "none" }}`, "Web Server"},
+		{"default with empty", `{{ .empty | default "none" }}`, "none"},
+		{"default with missing", `{{ index . "missing" | default "none" }}`, "none"},
+		{"upper", `{{ .name | upper }}`, "WEB SERVER"},
+		{"lower", `{{ .name | lower }}`, "web server"},
+		{"trim", `{{ "  padded  " | trim }}`, "padded"},
+		{"replace", `{{ .name | replace " " "-" }}`, "Web-Server"},
+		{"regexReplace", `{{ .name | regexReplace "[aeiou]" "_" }}`, "W_b S_rv_r"},
+		{"split and join", `{{ .csv | split "," | join ";" }}`, "a;b;c"},
+		{"join interface list", `{{ .list | join "," }}`, "x,y,z"},
+		{"toJson", `{{ .nested | toJson }}`, `{"key":"value"}`},
+		{"toYaml", `{{ .nested | toYaml }}`, "key: value"},
+		{"fromJson", `{{ (.json | fromJson).enabled }}`, "true"},
+		{"b64enc", `{{ "hello" | b64enc }}`, "aGVsbG8="},
+		{"b64dec", `{{ .encoded | b64dec }}`, "hello"},
+		{"sha256", `{{ "abc" | sha256 }}`, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"quote", `{{ .name | quote }}`, `"Web Server"`},
+		{"shellquote", `ls {{ .path | shellquote }}`, "ls '/var/www/my site'"},
+		{"shellquote non-string", `{{ .port | shellquote }}`, "8080"},
+		{"indent", `{{ .multi | indent 2 }}`, "  line1\n  line2"},
+		{"env", `{{ env "SSHOT_TEST_ENV" }}`, "from-env"},
+		{"date from unix", `{{ 0 | date "2006" }}`, "1970"},
+		{"ipaddr", `{{ .network | ipaddr }}`, "10.1.2.3"},
+		{"cidr", `{{ .network | cidr }}`, "10.1.2.0/24"},
+		{"cidrHost", `{{ .network | cidrHost 10 }}`, "10.1.2.10"},
+		{"cidrNetmask", `{{ .network | cidrNetmask }}`, "255.255.255.0"},
+		{"fact still available", `{{ fact "nested.key" }}`, "value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := executor.SubstituteVars(tt.input)
+			if result != tt.expected {
+				t.Errorf("SubstituteVars(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecutor_SubstituteVarsGeneratedValues(t *testing.T) {
+	executor := &Executor{Variables: map[string]interface{}{}}
+
+	uuid := executor.SubstituteVars(`{{ uuid }}`)
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(uuid) {
+		t.Errorf("uuid = %q, want a version 4 UUID", uuid)
+	}
+
+	password := executor.SubstituteVars(`{{ randomPassword 24 }}`)
+	if len(password) != 24 {
+		t.Errorf("randomPassword length = %d, want 24", len(password))
+	}
+	for _, c := range password {
+		if !strings.ContainsRune(passwordChars, c) {
+			t.Errorf("randomPassword contains unexpected character %q", c)
+		}
+	}
+
+	year := executor.SubstituteVars(`{{ now | date "2006" }}`)
+	if len(year) != 4 {
+		t.Errorf("now | date = %q, want a 4 digit year", year)
+	}
+}
+
+func TestExecutor_SubstituteVarsFunctionErrors(t *testing.T) {
+	executor := &Executor{Variables: map[string]interface{}{}}
+
+	// Invalid input makes the function fail, which leaves the text untouched
+	for _, input := range []string{
+		`{{ "not-an-ip" | ipaddr }}`,
+		`{{ "%%%" | b64dec }}`,
+		`{{ "x" | regexReplace "(" "" }}`,
+		`{{ "10.0.0.0/30" | cidrHost 4 }}`,
+	} {
+		if result := executor.SubstituteVars(input); result != input {
+			t.Errorf("SubstituteVars(%q) = %q, want input unchanged", input, result)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// killGracePeriod is how long a timed out command gets to exit after
+	// SIGTERM before it is killed
+	killGracePeriod = 2 * time.Second
+
+	// killWaitTimeout bounds the cleanup of a timed out command, so a dead
+	// connection cannot block the host either
+	killWaitTimeout = 10 * time.Second
+
+	// cleanupTimeout bounds a cleanup command run once its task attempt ended
+	cleanupTimeout = 30 * time.Second
+)
+
+// killScript terminates the process group of the command whose pid file is
+// given as $0. The pid is the one of the remote login shell, which sshd makes
+// a session leader, so its group holds every process the command started.
+const killScript = `p=$(cat "$0" 2>/dev/null) || exit 0
+g=$(ps -o pgid= -p "$p" 2>/dev/null | tr -d ' ')
+kill -TERM -- "-${g:-$p}" 2>/dev/null || kill -TERM "$p" 2>/dev/null
+sleep %d
+kill -KILL -- "-${g:-$p}" 2>/dev/null
+rm -f "$0"`
+
+// interruptContextKey holds the context done once the run was interrupted,
+// when the next interrupt cancels the run and kills its commands
+type interruptContextKey struct{}
+
+// WithInterruptContext returns ctx with the context done once the run was
+// interrupted
+func WithInterruptContext(ctx, interrupted context.Context) context.Context {
+	return context.WithValue(ctx, interruptContextKey{}, interrupted)
+}
+
+// InterruptContext returns the context done once the run was interrupted, or
+// nil when ctx has none
+func InterruptContext(ctx context.Context) context.Context {
+	interrupted, _ := ctx.Value(interruptContextKey{}).(context.Context)
+	return interrupted
+}
+
+// cleanupContextKey marks the context of a cleanup command
+type cleanupContextKey struct{}
+
+// runCleanup runs a command removing what a task attempt left behind. It gets
+// its own context, since the attempt one may have just timed out or been
+// interrupted, bounded by cleanupTimeout.
+func (e *Executor) runCleanup(cmd string) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), cleanupContextKey{}, true), cleanupTimeout)
+	defer cancel()
+
+	_, _ = e.runContext(ctx, cmd, false)
+}
+
+// runContext runs a remote command under ctx instead of the task attempt
+// context, killing it when ctx expires
+func (e *Executor) runContext(ctx context.Context, cmd string, sudo bool) (string, error) {
+	attemptCtx := e.ctx
+	e.ctx = ctx
+	defer func() { e.ctx = attemptCtx }()
+
+	return e.runWithStdin(cmd, nil, sudo)
+}
+
+// taskContext returns the context of the running task attempt
+func (e *Executor) taskContext() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// attemptContext returns the context of one task attempt, limited by the task
+// timeout when there is one
+func attemptContext(ctx context.Context, timeout int) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, time.Duration(timeout)*time.Second,
+		fmt.Errorf("timeout after %d seconds", timeout))
+}
+
+// contextError returns why ctx is done, the timeout or deadline that expired
+// rather than a generic context error
+func contextError(ctx context.Context) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return ctx.Err()
+}
+
+// pidFileCommand prefixes cmd so the remote login shell writes its pid to
+// pidFile before running it
+func pidFileCommand(cmd, pidFile string) string {
+	return `sh -c 'echo "$PPID" > "$0"' ` + utils.ShellQuote(pidFile) + "; " + cmd
+}
+
+// remotePidFile returns a pid file path for a command that may be killed: it
+// has a deadline, or the run was interrupted and the next interrupt kills it.
+// Other commands are only stopped by signaling and closing their session,
+// which spares them the pid file.
+func (e *Executor) remotePidFile() string {
+	if e.conn == nil || !killable(e.taskContext()) {
+		return ""
+	}
+
+	dir, err := e.remoteTempDir()
+	if err != nil {
+		if types.ExecOptions.Verbose {
+			e.mu.Lock()
+			log.SetOutput(e.OutputWriter)
+			log.Printf("[VERBOSE] [%s] No pid file for the command, a timeout will only close its session: %v", e.Host.Name, err)
+			log.SetOutput(os.Stderr)
+			e.mu.Unlock()
+		}
+		return ""
+	}
+	return dir + "/cmd-" + randomSuffix() + ".pid"
+}
+
+// killable reports whether a command running under ctx may have to be
+// killed. Cleanup commands are short and only get their session closed.
+func killable(ctx context.Context) bool {
+	if ctx.Value(cleanupContextKey{}) != nil {
+		return false
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return true
+	}
+	interrupted := InterruptContext(ctx)
+	return interrupted != nil && interrupted.Err() != nil
+}
+
+// waitSession waits for a started session. When the task context expires
+// first, the remote command is killed, the session closed, and the timeout
+// returned.
+func (e *Executor) waitSession(session *ssh.Session, pidFile string, sudo bool) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	ctx := e.taskContext()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	if types.ExecOptions.Verbose {
+		e.mu.Lock()
+		log.SetOutput(e.OutputWriter)
+		log.Printf("[VERBOSE] [%s] %v, killing the remote command", e.Host.Name, contextError(ctx))
+		log.SetOutput(os.Stderr)
+		e.mu.Unlock()
+	}
+
+	// Servers that support signals stop the command right away, the
+	// process group is killed for the others and for its children
+	_ = session.Signal(ssh.SIGTERM)
+	if pidFile != "" {
+		e.killRemoteCommand(pidFile, sudo)
+	}
+	_ = session.Close()
+
+	select {
+	case <-done:
+	case <-time.After(killWaitTimeout):
+	}
+	return fmt.Errorf("%w, remote command killed", contextError(ctx))
+}
+
+// killRemoteCommand kills the process group recorded in pidFile. It runs in
+// its own session since the task one is still busy with the command.
+func (e *Executor) killRemoteCommand(pidFile string, sudo bool) {
+	session, err := e.newSession()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	cmd := "sh -c " + utils.ShellQuote(fmt.Sprintf(killScript, int(killGracePeriod.Seconds()))) + " " + utils.ShellQuote(pidFile)
+	if sudo {
+		cmd = "sudo -n " + cmd
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(cmd)
+	}()
+	select {
+	case <-done:
+	case <-time.After(killWaitTimeout):
+	}
+}
+
+// killLocalProcessGroup kills a local command and every process it started
+func killLocalProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, as session output is
+// copied by the SSH library goroutines while a timed out task reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
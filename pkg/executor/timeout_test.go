@@ -0,0 +1,240 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestExecutor_LocalActionTimeout(t *testing.T) {
+	var output bytes.Buffer
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &output,
+	}
+
+	// The background sleep keeps the output pipe open, it must be killed
+	// with the rest of the process group
+	task := types.Task{
+		Name:        "Hang",
+		LocalAction: "echo started; sleep 30 & wait",
+		Timeout:     1,
+	}
+
+	start := time.Now()
+	err := executor.ExecuteTask(task)
+	if err == nil || !strings.Contains(err.Error(), "timeout after 1 seconds") {
+		t.Fatalf("ExecuteTask() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ExecuteTask() returned after %s, the command was not killed", elapsed)
+	}
+	if !strings.Contains(output.String(), "timed out after 1 seconds") {
+		t.Errorf("Output should report the timeout, got: %q", output.String())
+	}
+	if !strings.Contains(output.String(), "started") {
+		t.Errorf("Output should keep the partial output, got: %q", output.String())
+	}
+}
+
+func TestExecutor_RetriesStopAtDeadline(t *testing.T) {
+	executor := &Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+		OutputWriter:   &bytes.Buffer{},
+	}
+
+	deadline := errors.New("playbook deadline of 200ms exceeded")
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 200*time.Millisecond, deadline)
+	defer cancel()
+
+	task := types.Task{
+		Name:        "Flaky",
+		LocalAction: "exit 1",
+		Retries:     5,
+		RetryDelay:  10,
+	}
+
+	start := time.Now()
+	err := executor.ExecuteTaskContext(ctx, task)
+	if !errors.Is(err, deadline) {
+		t.Fatalf("ExecuteTaskContext() error = %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ExecuteTaskContext() kept retrying for %s after the deadline", elapsed)
+	}
+
+	// A task never starts once the deadline has passed
+	err = executor.ExecuteTaskContext(ctx, types.Task{Name: "Next", LocalAction: "true"})
+	if !errors.Is(err, deadline) {
+		t.Errorf("ExecuteTaskContext() error = %v, want the deadline", err)
+	}
+}
+
+func TestAttemptContext(t *testing.T) {
+	ctx, cancel := attemptContext(context.Background(), 0)
+	cancel()
+	if ctx.Done() != nil {
+		t.Error("attemptContext() without timeout should not have a deadline")
+	}
+
+	ctx, cancel = attemptContext(context.Background(), 1)
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Fatal("attemptContext() should set a deadline")
+	}
+	cancel()
+	if err := contextError(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("contextError() = %v, want context.Canceled", err)
+	}
+}
+
+func TestKillable(t *testing.T) {
+	withDeadline, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	running, stop := context.WithCancel(context.Background())
+	defer stop()
+	interrupted, interrupt := context.WithCancel(context.Background())
+	interrupt()
+	cleanup, cancelCleanup := context.WithTimeout(context.WithValue(context.Background(), cleanupContextKey{}, true), time.Minute)
+	defer cancelCleanup()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want bool
+	}{
+		{"no deadline", context.Background(), false},
+		{"cancelable only", running, false},
+		{"deadline", withDeadline, true},
+		{"not interrupted", WithInterruptContext(running, running), false},
+		{"interrupted", WithInterruptContext(running, interrupted), true},
+		{"cleanup", cleanup, false},
+	}
+
+	for _, tt := range tests {
+		if got := killable(tt.ctx); got != tt.want {
+			t.Errorf("killable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExecutor_CleanupAfterTimeout(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		cmds    []string
+		removed bool
+	)
+	_, host := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		mu.Lock()
+		cmds = append(cmds, cmd)
+		mu.Unlock()
+		switch {
+		case strings.Contains(cmd, "mktemp"):
+			return "/tmp/sshot-test\n", 0
+		case strings.Contains(cmd, "echo \"$PPID\""):
+			// The script outlives the task timeout
+			time.Sleep(3 * time.Second)
+		case strings.HasPrefix(cmd, "rm -f"):
+			time.Sleep(500 * time.Millisecond)
+			mu.Lock()
+			removed = true
+			mu.Unlock()
+		}
+		return "", 0
+	})
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	exec.OutputWriter = &bytes.Buffer{}
+
+	script := filepath.Join(t.TempDir(), "slow.sh")
+	if err := os.WriteFile(script, []byte("sleep 10\n"), 0600); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	err = exec.ExecuteTask(types.Task{Name: "Slow", Script: &types.ScriptTask{Path: script}, Timeout: 1})
+	if err == nil || !strings.Contains(err.Error(), "timeout after 1 seconds") {
+		t.Fatalf("ExecuteTask() error = %v, want a timeout", err)
+	}
+
+	// The uploaded script is removed once the attempt timed out, the task
+	// waiting for the removal instead of closing its session right away
+	mu.Lock()
+	defer mu.Unlock()
+	last := cmds[len(cmds)-1]
+	if !strings.HasPrefix(last, "rm -f /tmp/sshot-test/") || !strings.HasSuffix(last, "-slow.sh") {
+		t.Errorf("last command = %q, want the removal of the script", last)
+	}
+	if !removed {
+		t.Error("the task returned before the script was removed")
+	}
+}
+
+func TestKillScript(t *testing.T) {
+	if _, err := exec.LookPath("ps"); err != nil {
+		t.Skip("ps is not available")
+	}
+
+	pidFile := filepath.Join(t.TempDir(), "cmd.pid")
+
+	// The outer shell plays the remote login shell, leading its own process
+	// group like sshd sessions do
+	cmd := exec.Command("/bin/sh", "-c", pidFileCommand("sleep 30 & sleep 30", pidFile))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start command: %v", err)
+	}
+	defer func() {
+		_ = killLocalProcessGroup(cmd.Process.Pid)
+	}()
+
+	for i := 0; i < 50; i++ {
+		if content, err := os.ReadFile(pidFile); err == nil && len(content) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	content, _ := os.ReadFile(pidFile)
+	if strings.TrimSpace(string(content)) != fmt.Sprint(cmd.Process.Pid) {
+		t.Fatalf("pid file = %q, want %d", content, cmd.Process.Pid)
+	}
+
+	if out, err := exec.Command("/bin/sh", "-c", fmt.Sprintf(killScript, 0), pidFile).CombinedOutput(); err != nil {
+		t.Fatalf("kill script failed: %v\n%s", err, out)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("command should have been killed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command is still running after the kill script")
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Error("kill script should remove the pid file")
+	}
+}
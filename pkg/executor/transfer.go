@@ -0,0 +1,400 @@
+package executor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+	"github.com/pkg/sftp"
+)
+
+// fileSource is content to transfer: either a local file, streamed from disk,
+// or content rendered in memory
+type fileSource struct {
+	Name    string
+	Path    string
+	Content []byte
+	Size    int64
+	ModTime time.Time
+}
+
+// localFileSource describes a local file without reading it
+func localFileSource(p string) (fileSource, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return fileSource{}, fmt.Errorf("failed to read source file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fileSource{}, fmt.Errorf("source %s is not a regular file", p)
+	}
+	return fileSource{Name: p, Path: p, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// memorySource wraps rendered content
+func memorySource(name string, content []byte) fileSource {
+	return fileSource{Name: name, Content: content, Size: int64(len(content))}
+}
+
+func (s fileSource) open() (io.ReadCloser, error) {
+	if s.Path == "" {
+		return io.NopCloser(bytes.NewReader(s.Content)), nil
+	}
+	f, err := os.Open(filepath.Clean(s.Path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", s.Path, err)
+	}
+	return f, nil
+}
+
+func (s fileSource) checksum() (string, error) {
+	if s.Path == "" {
+		sum := sha256.Sum256(s.Content)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return fileChecksum(s.Path)
+}
+
+func (s fileSource) readAll() ([]byte, error) {
+	if s.Path == "" {
+		return s.Content, nil
+	}
+	return os.ReadFile(filepath.Clean(s.Path))
+}
+
+// getSFTP returns the SFTP client of the connection, opening it on first use.
+// It returns nil when the server has no SFTP subsystem, in which case callers
+// fall back to piping content through a shell.
+func (e *Executor) getSFTP() *sftp.Client {
+	e.sftpMu.Lock()
+	defer e.sftpMu.Unlock()
+
+	// The SFTP session is opened again once the connection was replaced
+	sshClient := e.conn.Client()
+	if sshClient != nil && sshClient != e.sftpConn {
+		if e.sftpClient != nil {
+			_ = e.sftpClient.Close()
+			e.sftpClient = nil
+		}
+		e.sftpUnavailable = false
+	}
+
+	if e.sftpClient != nil || e.sftpUnavailable || sshClient == nil {
+		return e.sftpClient
+	}
+
+	e.sftpConn = sshClient
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		e.sftpUnavailable = true
+		if types.ExecOptions.Verbose {
+			e.mu.Lock()
+			log.SetOutput(e.OutputWriter)
+			log.Printf("[VERBOSE] [%s] SFTP unavailable, falling back to shell transfers: %v", e.Host.Name, err)
+			log.SetOutput(os.Stderr)
+			e.mu.Unlock()
+		}
+		return nil
+	}
+
+	e.sftpClient = client
+	return client
+}
+
+// defaultRemoteTmp is the parent of the per-run remote temporary directory
+// when the host has no remote_tmp
+const defaultRemoteTmp = "/tmp"
+
+// remoteTempDir returns the private temporary directory of this run on the
+// remote host, creating it on first use. It is removed by Close.
+func (e *Executor) remoteTempDir() (string, error) {
+	e.remoteTmpMu.Lock()
+	defer e.remoteTmpMu.Unlock()
+
+	if e.remoteTmpDir != "" {
+		return e.remoteTmpDir, nil
+	}
+
+	base := e.remoteHost().RemoteTmp
+	if base == "" {
+		base = defaultRemoteTmp
+	}
+	parent := remotePath(base)
+
+	script := fmt.Sprintf(`umask 077 && mkdir -p %s && mktemp -d %s/sshot-XXXXXXXX`, parent, parent)
+	output, err := e.runWithStdin("sh -c "+utils.ShellQuote(script), nil, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to create remote temporary directory in %s: %w", base, err)
+	}
+
+	e.remoteTmpDir = strings.TrimSpace(output)
+	if types.ExecOptions.Verbose {
+		e.mu.Lock()
+		log.SetOutput(e.OutputWriter)
+		log.Printf("[VERBOSE] [%s] Using remote temporary directory %s", e.Host.Name, e.remoteTmpDir)
+		log.SetOutput(os.Stderr)
+		e.mu.Unlock()
+	}
+	return e.remoteTmpDir, nil
+}
+
+// removeRemoteTempDir deletes the remote temporary directory of this run, if any
+func (e *Executor) removeRemoteTempDir() {
+	e.remoteTmpMu.Lock()
+	defer e.remoteTmpMu.Unlock()
+
+	if e.remoteTmpDir == "" || e.conn == nil {
+		return
+	}
+	e.runCleanup("rm -rf " + utils.ShellQuote(e.remoteTmpDir))
+	e.remoteTmpDir = ""
+}
+
+// uploadTemp streams a source into a new file of the remote temporary
+// directory and returns its path. The file name ends with the base name of
+// the source so it can be identified in process listings.
+func (e *Executor) uploadTemp(src fileSource) (string, error) {
+	dir, err := e.remoteTempDir()
+	if err != nil {
+		return "", err
+	}
+	tmpFile := path.Join(dir, randomSuffix()+"-"+tempBaseName(src.Name))
+
+	if client := e.getSFTP(); client != nil {
+		if err := e.sftpWrite(client, src, tmpFile, 0600, false); err != nil {
+			return "", fmt.Errorf("failed to upload file: %w", err)
+		}
+		return tmpFile, nil
+	}
+
+	r, err := src.open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	// noclobber makes the redirection fail if the file already exists
+	if _, err := e.runWithStdin(fmt.Sprintf("set -C && umask 077 && cat > %s", utils.ShellQuote(tmpFile)), e.progressReader(r, src), false); err != nil {
+		return "", fmt.Errorf("failed to upload file: %w", err)
+	}
+	return tmpFile, nil
+}
+
+// tempBaseName returns a file name safe to use in remote temporary paths
+func tempBaseName(name string) string {
+	base := path.Base(filepath.ToSlash(name))
+	clean := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, base)
+	if clean == "" || clean == "." || clean == ".." || clean == "_" {
+		return "upload"
+	}
+	return clean
+}
+
+// putFile transfers a source to dest with the given mode, preserving the
+// modification time. The content is written to a temporary name next to the
+// destination and renamed into place.
+func (e *Executor) putFile(src fileSource, dest string, mode os.FileMode, sudo bool) error {
+	client := e.getSFTP()
+
+	if client != nil && !sudo {
+		target := sftpPath(dest)
+		tmpFile := path.Join(path.Dir(target), ".sshot."+randomSuffix())
+		if err := e.sftpWrite(client, src, tmpFile, mode, true); err != nil {
+			return err
+		}
+		if err := client.PosixRename(tmpFile, target); err != nil {
+			_ = client.Remove(tmpFile)
+			return fmt.Errorf("failed to rename %s: %w", tmpFile, err)
+		}
+		return nil
+	}
+
+	// Either SFTP is unavailable or the file must be installed with sudo: the
+	// content goes through a shell, reading it from an SFTP upload when possible
+	var stdin io.Reader
+	source := `cat > "$t"`
+	if client != nil {
+		tmpFile, err := e.uploadTemp(src)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = client.Remove(tmpFile) }()
+		source = fmt.Sprintf(`cat %s > "$t"`, utils.ShellQuote(tmpFile))
+	} else {
+		r, err := src.open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		stdin = e.progressReader(r, src)
+	}
+
+	touch := ""
+	if !src.ModTime.IsZero() {
+		touch = fmt.Sprintf(` && touch -m -d @%d "$t"`, src.ModTime.Unix())
+	}
+	script := fmt.Sprintf(`set -e; p=%s; t=$(mktemp "$(dirname "$p")/.sshot.XXXXXX"); trap 'rm -f "$t"' EXIT; %s && chmod %o "$t"%s && mv -f "$t" "$p"`,
+		remotePath(dest), source, mode, touch)
+	if _, err := e.runWithStdin("sh -c "+utils.ShellQuote(script), stdin, sudo); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", dest, err)
+	}
+	return nil
+}
+
+// sftpPath returns the SFTP path of a remote path. SFTP does not expand ~,
+// but relative paths start from the home directory.
+func sftpPath(p string) string {
+	if p == "~" {
+		return "."
+	}
+	return strings.TrimPrefix(p, "~/")
+}
+
+// readRemoteFile streams a remote file into w
+func (e *Executor) readRemoteFile(remotePath string, w io.Writer, sudo bool) error {
+	if client := e.getSFTP(); client != nil && !sudo {
+		f, err := client.Open(remotePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.WriteTo(w)
+		return err
+	}
+
+	if sudo {
+		return e.streamCommand("sudo -S cat "+utils.ShellQuote(remotePath), w)
+	}
+	return e.streamCommand("cat "+utils.ShellQuote(remotePath), w)
+}
+
+// streamCommand runs a remote command, streaming its stdout into w
+func (e *Executor) streamCommand(cmd string, w io.Writer) error {
+	session, err := e.newSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdout = w
+	session.Stderr = &stderr
+
+	if err := session.Run(cmd); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// sftpWrite streams a source into a new remote file
+func (e *Executor) sftpWrite(client *sftp.Client, src fileSource, remotePath string, mode os.FileMode, keepModTime bool) error {
+	r, err := src.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", remotePath, err)
+	}
+
+	// Restrict the mode before writing any content
+	if err := f.Chmod(mode); err != nil {
+		_ = f.Close()
+		_ = client.Remove(remotePath)
+		return fmt.Errorf("failed to chmod %s: %w", remotePath, err)
+	}
+
+	if _, err := f.ReadFrom(e.progressReader(r, src)); err != nil {
+		_ = f.Close()
+		_ = client.Remove(remotePath)
+		return fmt.Errorf("failed to write %s: %w", remotePath, err)
+	}
+
+	if err := f.Close(); err != nil {
+		_ = client.Remove(remotePath)
+		return fmt.Errorf("failed to write %s: %w", remotePath, err)
+	}
+
+	if keepModTime && !src.ModTime.IsZero() {
+		if err := client.Chtimes(remotePath, time.Now(), src.ModTime); err != nil {
+			_ = client.Remove(remotePath)
+			return fmt.Errorf("failed to set mtime of %s: %w", remotePath, err)
+		}
+	}
+
+	return nil
+}
+
+// progressReader reports transfer progress when --progress is enabled
+func (e *Executor) progressReader(r io.Reader, src fileSource) io.Reader {
+	if !types.ExecOptions.Progress || src.Size == 0 {
+		return r
+	}
+	return &transferProgress{reader: r, executor: e, name: src.Name, total: src.Size}
+}
+
+// transferProgress prints a line every 10% of a transfer
+type transferProgress struct {
+	reader   io.Reader
+	executor *Executor
+	name     string
+	total    int64
+	done     int64
+	reported int64
+}
+
+func (p *transferProgress) Read(buf []byte) (int, error) {
+	n, err := p.reader.Read(buf)
+	p.done += int64(n)
+
+	percent := p.done * 100 / p.total
+	if percent/10 > p.reported/10 || (err == io.EOF && p.reported < 100) {
+		p.reported = percent
+		writer := p.executor.OutputWriter
+		if writer == nil {
+			writer = os.Stdout
+		}
+		p.executor.mu.Lock()
+		fmt.Fprintf(writer, "    %s⇪%s %s: %d%% (%s / %s)\n", utils.Color(utils.ColorGray), utils.Color(utils.ColorReset),
+			p.name, percent, formatBytes(p.done), formatBytes(p.total))
+		p.executor.mu.Unlock()
+	}
+
+	return n, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func randomSuffix() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,200 @@
+package executor
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/pkg/sftp"
+)
+
+// newLocalSFTPClient returns an SFTP client served in-process on the local
+// filesystem
+func newLocalSFTPClient(t *testing.T) *sftp.Client {
+	t.Helper()
+
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if err != nil {
+		t.Fatalf("Failed to create SFTP server: %v", err)
+	}
+	go func() { _ = server.Serve() }()
+
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatalf("Failed to create SFTP client: %v", err)
+	}
+	t.Cleanup(func() {
+		// Closing the server ends the client receive loop
+		_ = server.Close()
+		_ = client.Close()
+	})
+	return client
+}
+
+func TestExecutor_PutFileSFTP(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source file")
+	dest := filepath.Join(tmpDir, "remote dir", "app.bin")
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	content := []byte("binary\x00content\n")
+	if err := os.WriteFile(src, content, 0600); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	if err := os.WriteFile(dest, []byte("old"), 0600); err != nil {
+		t.Fatalf("Failed to write destination: %v", err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+
+	executor := &Executor{
+		Host:         types.Host{Name: "testhost"},
+		OutputWriter: &bytes.Buffer{},
+		sftpClient:   newLocalSFTPClient(t),
+	}
+
+	source, err := localFileSource(src)
+	if err != nil {
+		t.Fatalf("localFileSource() error = %v", err)
+	}
+	if err := executor.putFile(source, dest, 0640, false); err != nil {
+		t.Fatalf("putFile() error = %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("Failed to read destination: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("destination content = %q, want %q", got, content)
+	}
+
+	info, err := os.Stat(dest)
+	if err != nil {
+		t.Fatalf("Failed to stat destination: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("destination mode = %o, want 640", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("destination mtime = %v, want %v", info.ModTime(), mtime)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(dest))
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".sshot.") {
+			t.Errorf("staging file %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestExecutor_UploadTempSFTP(t *testing.T) {
+	tmpDir := t.TempDir()
+	executor := &Executor{
+		Host:         types.Host{Name: "testhost"},
+		OutputWriter: &bytes.Buffer{},
+		sftpClient:   newLocalSFTPClient(t),
+		remoteTmpDir: tmpDir,
+	}
+
+	src := memorySource("scripts/set up.sh", []byte("#!/bin/sh\necho ok\n"))
+	tmpFile, err := executor.uploadTemp(src)
+	if err != nil {
+		t.Fatalf("uploadTemp() error = %v", err)
+	}
+	if filepath.Dir(tmpFile) != tmpDir || !strings.HasSuffix(tmpFile, "-set_up.sh") {
+		t.Errorf("uploadTemp() = %q, want a file named after the script in %s", tmpFile, tmpDir)
+	}
+
+	// Each upload gets its own name
+	other, err := executor.uploadTemp(src)
+	if err != nil {
+		t.Fatalf("uploadTemp() error = %v", err)
+	}
+	if other == tmpFile {
+		t.Errorf("uploadTemp() returned the same path twice: %s", tmpFile)
+	}
+
+	info, err := os.Stat(tmpFile)
+	if err != nil {
+		t.Fatalf("Failed to stat temporary file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("temporary file mode = %o, want 600", info.Mode().Perm())
+	}
+}
+
+func TestTempBaseName(t *testing.T) {
+	tests := map[string]string{
+		"scripts/setup.sh": "setup.sh",
+		"deploy app.sh":    "deploy_app.sh",
+		"$(reboot)":        "__reboot_",
+		"":                 "upload",
+		"/":                "upload",
+	}
+	for name, expected := range tests {
+		if result := tempBaseName(name); result != expected {
+			t.Errorf("tempBaseName(%q) = %q, want %q", name, result, expected)
+		}
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	types.ExecOptions.Progress = true
+	types.ExecOptions.NoColor = true
+	defer func() {
+		types.ExecOptions.Progress = false
+		types.ExecOptions.NoColor = false
+	}()
+
+	var output bytes.Buffer
+	executor := &Executor{Host: types.Host{Name: "testhost"}, OutputWriter: &output}
+
+	content := bytes.Repeat([]byte("x"), 4096)
+	reader := executor.progressReader(bytes.NewReader(content), memorySource("big.bin", content))
+
+	// Read in small chunks to get intermediate reports
+	buf := make([]byte, 512)
+	for {
+		if _, err := reader.Read(buf); err == io.EOF {
+			break
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) < 2 || len(lines) > 11 {
+		t.Errorf("expected between 2 and 11 progress lines, got %d:\n%s", len(lines), output.String())
+	}
+	if !strings.Contains(lines[len(lines)-1], "big.bin: 100% (4.0 KiB / 4.0 KiB)") {
+		t.Errorf("last progress line should report completion, got %q", lines[len(lines)-1])
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	}
+	for n, expected := range tests {
+		if result := formatBytes(n); result != expected {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, result, expected)
+		}
+	}
+}
@@ -0,0 +1,634 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// defaultWaitTimeout is how long a wait_for condition is checked for
+	defaultWaitTimeout = 60 * time.Second
+
+	// defaultWaitSleep is the pause between two checks of a wait_for condition
+	defaultWaitSleep = 2 * time.Second
+
+	// waitCheckTimeout bounds a single connection or HTTP request
+	waitCheckTimeout = 10 * time.Second
+
+	// waitBodyLimit is how much of an HTTP response is matched against
+	// search_regex
+	waitBodyLimit = 1 << 20
+)
+
+// errUncheckable marks a check failure that retrying does not fix, which
+// ends the wait right away
+var errUncheckable = errors.New("condition cannot be checked")
+
+// drainedScript prints the number of established TCP connections whose local
+// port is the given one, in uppercase hexadecimal as in /proc/net/tcp
+const drainedScript = `cat /proc/net/tcp /proc/net/tcp6 2>/dev/null | awk '$4 == "01" && $2 ~ /:%04X$/ {n++} END {print n+0}'`
+
+// waitStates lists the states each kind of condition accepts, the first one
+// being the default
+var waitStates = map[string][]string{
+	"port":    {"started", "stopped", "drained"},
+	"path":    {"present", "absent"},
+	"process": {"present", "absent"},
+	"service": {"started", "stopped"},
+	"url":     {""},
+	"command": {""},
+}
+
+// executeWaitFor checks a condition until it is met or the wait times out.
+// The first check happens after the delay, then every sleep seconds.
+func (e *Executor) executeWaitFor(waitTask *types.WaitForTask, sudo bool) (string, error) {
+	timeout, delay, sleep, err := waitForTimings(waitTask)
+	if err != nil {
+		return "", err
+	}
+
+	check := e.waitChecker(waitTask, sudo)
+
+	description := describeWaitFor(waitTask)
+	ctx := e.taskContext()
+	start := time.Now()
+	deadline := start.Add(timeout)
+	wait := delay
+
+	// Checks are bounded by the wait timeout, a hung one being killed
+	checkCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	for {
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return "", fmt.Errorf("%w waiting for %s", contextError(ctx), description)
+			case <-time.After(wait):
+			}
+		}
+
+		met, err := check(checkCtx)
+		if met {
+			return fmt.Sprintf("Condition met: %s (after %s)", description, utils.FormatDuration(time.Since(start))), nil
+		}
+		if errors.Is(err, errUncheckable) {
+			return "", fmt.Errorf("failed waiting for %s: %w", description, err)
+		}
+
+		if types.ExecOptions.Verbose {
+			e.mu.Lock()
+			log.SetOutput(e.OutputWriter)
+			log.Printf("[VERBOSE] [%s] Waiting for %s: %v", e.Host.Name, description, err)
+			log.SetOutput(os.Stderr)
+			e.mu.Unlock()
+		}
+
+		if time.Now().Add(sleep).After(deadline) {
+			if err != nil {
+				return "", fmt.Errorf("timeout after %s waiting for %s (last check: %w)", timeout, description, err)
+			}
+			return "", fmt.Errorf("timeout after %s waiting for %s", timeout, description)
+		}
+		wait = sleep
+	}
+}
+
+// waitForTimings returns the timeout, delay and sleep of a wait, with defaults
+func waitForTimings(waitTask *types.WaitForTask) (timeout, delay, sleep time.Duration, err error) {
+	if waitTask.Timeout < 0 || waitTask.Delay < 0 || waitTask.Sleep < 0 {
+		return 0, 0, 0, fmt.Errorf("wait_for timeout, delay and sleep must not be negative")
+	}
+
+	timeout = time.Duration(waitTask.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultWaitTimeout
+	}
+	delay = time.Duration(waitTask.Delay) * time.Second
+	sleep = time.Duration(waitTask.Sleep) * time.Second
+	if sleep == 0 {
+		sleep = defaultWaitSleep
+	}
+	return timeout, delay, sleep, nil
+}
+
+// renderWaitForTask renders the templated fields of a wait_for task and
+// normalizes it
+func (e *Executor) renderWaitForTask(taskName string, waitTask types.WaitForTask) (types.WaitForTask, error) {
+	var err error
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"wait_for", &waitTask.Condition},
+		{"wait_for host", &waitTask.Host},
+		{"wait_for path", &waitTask.Path},
+		{"wait_for url", &waitTask.URL},
+		{"wait_for process", &waitTask.Process},
+		{"wait_for service", &waitTask.Service},
+		{"wait_for command", &waitTask.Command},
+		{"wait_for search_regex", &waitTask.SearchRegex},
+	}
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+		if *f.value, err = e.renderField(taskName, f.name, *f.value); err != nil {
+			return waitTask, err
+		}
+	}
+
+	waitTask, err = normalizeWaitFor(waitTask)
+	if err != nil {
+		return waitTask, fmt.Errorf("%w in task '%s'", err, taskName)
+	}
+	return waitTask, nil
+}
+
+// waitKind returns which condition a normalized wait checks
+func waitKind(w *types.WaitForTask) string {
+	switch {
+	case w.Port != 0:
+		return "port"
+	case w.Path != "":
+		return "path"
+	case w.URL != "":
+		return "url"
+	case w.Process != "":
+		return "process"
+	case w.Service != "":
+		return "service"
+	default:
+		return "command"
+	}
+}
+
+// normalizeWaitFor expands the "type:value" shorthand, applies defaults and
+// validates the condition
+func normalizeWaitFor(w types.WaitForTask) (types.WaitForTask, error) {
+	if w.Condition != "" {
+		if w.Port != 0 || w.Path != "" || w.URL != "" || w.Process != "" || w.Service != "" || w.Command != "" {
+			return w, fmt.Errorf("wait_for condition cannot be combined with port, path, url, process, service or command")
+		}
+		if err := parseWaitCondition(&w); err != nil {
+			return w, err
+		}
+	}
+
+	kinds := 0
+	for _, set := range []bool{w.Port != 0, w.Path != "", w.URL != "", w.Process != "", w.Service != "", w.Command != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return w, fmt.Errorf("wait_for requires exactly one of port, path, url, process, service or command")
+	}
+
+	kind := waitKind(&w)
+	states := waitStates[kind]
+	if w.State == "" {
+		w.State = states[0]
+	}
+	valid := false
+	for _, state := range states {
+		valid = valid || state == w.State
+	}
+	if !valid {
+		if states[0] == "" {
+			return w, fmt.Errorf("wait_for state is not supported for a %s", kind)
+		}
+		return w, fmt.Errorf("invalid wait_for state '%s' for a %s (expected %s)", w.State, kind, strings.Join(states, ", "))
+	}
+
+	switch w.From {
+	case "":
+		w.From = "remote"
+	case "remote", "controller":
+	default:
+		return w, fmt.Errorf("invalid wait_for from '%s' (expected remote or controller)", w.From)
+	}
+	if w.From == "controller" && kind != "port" && kind != "url" {
+		return w, fmt.Errorf("wait_for from controller is only supported for a port or a url")
+	}
+
+	if kind == "port" {
+		if w.Port < 1 || w.Port > 65535 {
+			return w, fmt.Errorf("invalid wait_for port %d", w.Port)
+		}
+		if w.Host == "" {
+			w.Host = "localhost"
+		}
+		if w.State == "drained" && w.From == "controller" {
+			return w, fmt.Errorf("wait_for state drained can only be checked from the remote host")
+		}
+	} else if w.Host != "" {
+		return w, fmt.Errorf("wait_for host is only supported for a port")
+	}
+
+	if w.Status != 0 && kind != "url" {
+		return w, fmt.Errorf("wait_for status is only supported for a url")
+	}
+
+	if w.SearchRegex != "" {
+		if kind != "url" && kind != "command" && (kind != "path" || w.State != "present") {
+			return w, fmt.Errorf("wait_for search_regex is only supported for a present path, a url or a command")
+		}
+		if _, err := regexp.Compile(w.SearchRegex); err != nil {
+			return w, fmt.Errorf("invalid wait_for search_regex: %w", err)
+		}
+	}
+	if kind == "process" {
+		if _, err := regexp.Compile(w.Process); err != nil {
+			return w, fmt.Errorf("invalid wait_for process: %w", err)
+		}
+	}
+
+	return w, nil
+}
+
+// parseWaitCondition expands a "type:value" condition into its fields
+func parseWaitCondition(w *types.WaitForTask) error {
+	condition := w.Condition
+	w.Condition = ""
+
+	if strings.HasPrefix(condition, "http://") || strings.HasPrefix(condition, "https://") {
+		w.URL = condition
+		return nil
+	}
+
+	waitType, value, ok := strings.Cut(condition, ":")
+	if !ok || value == "" {
+		return fmt.Errorf("invalid wait_for format: %s (expected type:value)", condition)
+	}
+
+	switch waitType {
+	case "port":
+		host, port := "", value
+		if i := strings.LastIndex(value, ":"); i >= 0 {
+			host, port = value[:i], value[i+1:]
+		}
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("invalid wait_for port: %s", value)
+		}
+		w.Host, w.Port = strings.Trim(host, "[]"), n
+	case "service":
+		w.Service = value
+	case "file":
+		w.Path = value
+	case "process":
+		w.Process = value
+	case "http", "https":
+		switch {
+		case strings.HasPrefix(value, "//"):
+			w.URL = waitType + ":" + value
+		case strings.Contains(value, "://"):
+			w.URL = value
+		default:
+			w.URL = waitType + "://" + value
+		}
+	default:
+		return fmt.Errorf("unknown wait_for type: %s", waitType)
+	}
+	return nil
+}
+
+// describeWaitFor describes a normalized condition for messages
+func describeWaitFor(w *types.WaitForTask) string {
+	var desc string
+	switch waitKind(w) {
+	case "port":
+		state := map[string]string{"started": "open", "stopped": "closed", "drained": "drained"}[w.State]
+		desc = fmt.Sprintf("port %d on %s to be %s", w.Port, w.Host, state)
+	case "path":
+		if w.State == "absent" {
+			desc = fmt.Sprintf("%s to be absent", w.Path)
+		} else if w.SearchRegex != "" {
+			desc = fmt.Sprintf("%s to match '%s'", w.Path, w.SearchRegex)
+		} else {
+			desc = fmt.Sprintf("%s to exist", w.Path)
+		}
+	case "url":
+		status := "a 2xx status"
+		if w.Status != 0 {
+			status = fmt.Sprintf("status %d", w.Status)
+		}
+		desc = fmt.Sprintf("%s to return %s", w.URL, status)
+	case "process":
+		if w.State == "absent" {
+			desc = fmt.Sprintf("process '%s' to stop", w.Process)
+		} else {
+			desc = fmt.Sprintf("process '%s' to run", w.Process)
+		}
+	case "service":
+		if w.State == "stopped" {
+			desc = fmt.Sprintf("service %s to stop", w.Service)
+		} else {
+			desc = fmt.Sprintf("service %s to be active", w.Service)
+		}
+	case "command":
+		desc = fmt.Sprintf("command '%s' to succeed", w.Command)
+	}
+
+	if w.SearchRegex != "" && waitKind(w) != "path" {
+		desc += fmt.Sprintf(" matching '%s'", w.SearchRegex)
+	}
+	if w.From == "controller" {
+		desc += " (from the controller)"
+	}
+	return desc
+}
+
+// waitCheck checks a condition once. When the condition is not met, the
+// error tells why if it is known.
+type waitCheck func(ctx context.Context) (bool, error)
+
+// waitChecker returns the check of a normalized condition
+func (e *Executor) waitChecker(w *types.WaitForTask, sudo bool) waitCheck {
+	var re *regexp.Regexp
+	if w.SearchRegex != "" {
+		re = regexp.MustCompile(w.SearchRegex)
+	}
+
+	switch waitKind(w) {
+	case "port":
+		if w.State == "drained" {
+			return e.waitDrained(w.Port, sudo)
+		}
+		return e.waitPort(w)
+	case "path":
+		return e.waitPath(w, re, sudo)
+	case "url":
+		return e.waitURL(w, re)
+	case "process":
+		return e.waitProcess(w, sudo)
+	case "service":
+		return e.waitService(w, sudo)
+	default:
+		return e.waitCommand(w, re, sudo)
+	}
+}
+
+// waitDialer returns how connections are opened: through the SSH connection
+// so they start from the remote host, or directly from the controller
+func (e *Executor) waitDialer(from string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if from == "controller" {
+		var dialer net.Dialer
+		return dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client := e.conn.Client()
+		if client == nil {
+			return nil, fmt.Errorf("not connected to %s", e.remoteHost().Name)
+		}
+		conn, err := client.DialContext(ctx, network, addr)
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.Prohibited {
+			return nil, fmt.Errorf("%w: the SSH server of %s does not allow port forwarding (%v), check from: controller instead", errUncheckable, e.remoteHost().Name, err)
+		}
+		return conn, err
+	}
+}
+
+// waitPort connects to the port, without needing any tool on the remote host
+func (e *Executor) waitPort(w *types.WaitForTask) waitCheck {
+	dial := e.waitDialer(w.From)
+	addr := net.JoinHostPort(w.Host, strconv.Itoa(w.Port))
+
+	return func(ctx context.Context) (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, waitCheckTimeout)
+		defer cancel()
+
+		conn, err := dial(ctx, "tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+			if w.State == "stopped" {
+				return false, fmt.Errorf("port %d on %s is open", w.Port, w.Host)
+			}
+			return true, nil
+		}
+
+		// A forward failing to connect means the port is closed, other
+		// errors mean the remote host could not be asked
+		var openErr *ssh.OpenChannelError
+		if w.From == "remote" && (!errors.As(err, &openErr) || openErr.Reason != ssh.ConnectionFailed) {
+			return false, err
+		}
+		return w.State == "stopped", err
+	}
+}
+
+// waitDrained waits until no connection is established to a local port of
+// the remote host
+func (e *Executor) waitDrained(port int, sudo bool) waitCheck {
+	cmd := "sh -c " + utils.ShellQuote(fmt.Sprintf(drainedScript, port))
+
+	return func(ctx context.Context) (bool, error) {
+		output, err := e.runContext(ctx, cmd, sudo)
+		if err != nil {
+			return false, err
+		}
+		count := strings.TrimSpace(output)
+		if count != "0" {
+			return false, fmt.Errorf("%s connection(s) established", count)
+		}
+		return true, nil
+	}
+}
+
+// waitPath checks whether a remote file exists, or matches a pattern
+func (e *Executor) waitPath(w *types.WaitForTask, re *regexp.Regexp, sudo bool) waitCheck {
+	cmd := "sh -c " + utils.ShellQuote(fmt.Sprintf("if [ -e %s ]; then echo present; else echo absent; fi", remotePath(w.Path)))
+
+	return func(ctx context.Context) (bool, error) {
+		if re != nil {
+			return e.remoteFileMatches(ctx, w.Path, re, sudo)
+		}
+
+		output, err := e.runContext(ctx, cmd, sudo)
+		if err != nil {
+			return false, err
+		}
+		return strings.TrimSpace(output) == w.State, nil
+	}
+}
+
+// remoteFileMatches streams a remote file through a regular expression. When
+// ctx expires, the stream is closed and the read left behind.
+func (e *Executor) remoteFileMatches(ctx context.Context, path string, re *regexp.Regexp, sudo bool) (bool, error) {
+	reader, writer := io.Pipe()
+	readErr := make(chan error, 1)
+	go func() {
+		err := e.readRemoteFile(path, writer, sudo)
+		_ = writer.CloseWithError(err)
+		readErr <- err
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		_ = reader.CloseWithError(contextError(ctx))
+	})
+	defer stop()
+
+	matched := re.MatchReader(bufio.NewReader(reader))
+	_ = reader.Close()
+
+	var err error
+	select {
+	case err = <-readErr:
+	case <-ctx.Done():
+		err = contextError(ctx)
+	}
+
+	if matched {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("%s does not match", path)
+}
+
+// waitURL requests the URL, from the remote host through the SSH connection
+// or from the controller
+func (e *Executor) waitURL(w *types.WaitForTask, re *regexp.Regexp) waitCheck {
+	client := &http.Client{
+		Timeout:   waitCheckTimeout,
+		Transport: &http.Transport{DialContext: e.waitDialer(w.From)},
+	}
+
+	return func(ctx context.Context) (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.URL, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+
+		if w.Status != 0 && resp.StatusCode != w.Status || w.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+			return false, fmt.Errorf("status %d", resp.StatusCode)
+		}
+
+		if re != nil {
+			body, err := io.ReadAll(io.LimitReader(resp.Body, waitBodyLimit))
+			if err != nil {
+				return false, err
+			}
+			if !re.Match(body) {
+				return false, fmt.Errorf("body does not match")
+			}
+		}
+		return true, nil
+	}
+}
+
+// psScript prints the pid of the probe shell, then the pid, parent pid and
+// command line of every process
+const psScript = `echo $$; ps -eo pid=,ppid=,args=`
+
+// waitProcess matches the command lines of the remote processes
+func (e *Executor) waitProcess(w *types.WaitForTask, sudo bool) waitCheck {
+	cmd := "sh -c " + utils.ShellQuote(psScript)
+	re := regexp.MustCompile(w.Process)
+
+	return func(ctx context.Context) (bool, error) {
+		output, err := e.runContext(ctx, cmd, sudo)
+		if err != nil {
+			return false, err
+		}
+
+		running := processRunning(output, re)
+		if running != (w.State == "present") {
+			if running {
+				return false, fmt.Errorf("process is running")
+			}
+			return false, fmt.Errorf("process is not running")
+		}
+		return true, nil
+	}
+}
+
+// processRunning reports whether a process listed by psScript matches re. The
+// probe itself is skipped: its shell, the ps it runs and the ancestors of the
+// shell, such as sudo, whose command lines contain the pattern.
+func processRunning(output string, re *regexp.Regexp) bool {
+	lines := strings.Split(output, "\n")
+	self := strings.TrimSpace(lines[0])
+
+	type process struct{ ppid, args string }
+	processes := make(map[string]process)
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		processes[fields[0]] = process{ppid: fields[1], args: strings.Join(fields[2:], " ")}
+	}
+
+	probe := map[string]bool{}
+	for pid := self; pid != "" && !probe[pid]; pid = processes[pid].ppid {
+		probe[pid] = true
+	}
+
+	for pid, p := range processes {
+		if probe[pid] || p.ppid == self {
+			continue
+		}
+		if re.MatchString(p.args) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitService checks a systemd service
+func (e *Executor) waitService(w *types.WaitForTask, sudo bool) waitCheck {
+	cmd := "systemctl is-active " + utils.ShellQuote(w.Service)
+
+	return func(ctx context.Context) (bool, error) {
+		// is-active prints the state and fails when it is not active
+		output, err := e.runContext(ctx, cmd, sudo)
+		state := strings.TrimSpace(output)
+		if state == "" {
+			return false, err
+		}
+		if (state == "active") != (w.State == "started") {
+			return false, fmt.Errorf("service is %s", state)
+		}
+		return true, nil
+	}
+}
+
+// waitCommand runs a shell command until it succeeds, and its output
+// matches the pattern if there is one
+func (e *Executor) waitCommand(w *types.WaitForTask, re *regexp.Regexp, sudo bool) waitCheck {
+	cmd := "sh -c " + utils.ShellQuote(w.Command)
+
+	return func(ctx context.Context) (bool, error) {
+		output, err := e.runContext(ctx, cmd, sudo)
+		if err != nil {
+			return false, err
+		}
+		if re != nil && !re.MatchString(output) {
+			return false, fmt.Errorf("output does not match")
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,399 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestNormalizeWaitFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		wait     types.WaitForTask
+		expected types.WaitForTask
+		wantErr  string
+	}{
+		{
+			name:     "port shorthand",
+			wait:     types.WaitForTask{Condition: "port:5432"},
+			expected: types.WaitForTask{Port: 5432, Host: "localhost", State: "started", From: "remote"},
+		},
+		{
+			name:     "port shorthand with host",
+			wait:     types.WaitForTask{Condition: "port:db.internal:5432"},
+			expected: types.WaitForTask{Port: 5432, Host: "db.internal", State: "started", From: "remote"},
+		},
+		{
+			name:     "file shorthand",
+			wait:     types.WaitForTask{Condition: "file:/var/run/app.pid"},
+			expected: types.WaitForTask{Path: "/var/run/app.pid", State: "present", From: "remote"},
+		},
+		{
+			name:     "url shorthand",
+			wait:     types.WaitForTask{Condition: "http://localhost:8080/health"},
+			expected: types.WaitForTask{URL: "http://localhost:8080/health", From: "remote"},
+		},
+		{
+			name:     "http type shorthand",
+			wait:     types.WaitForTask{Condition: "http:localhost:8080/health"},
+			expected: types.WaitForTask{URL: "http://localhost:8080/health", From: "remote"},
+		},
+		{
+			name:     "service shorthand",
+			wait:     types.WaitForTask{Condition: "service:nginx"},
+			expected: types.WaitForTask{Service: "nginx", State: "started", From: "remote"},
+		},
+		{
+			name:     "drained port",
+			wait:     types.WaitForTask{Port: 443, State: "drained"},
+			expected: types.WaitForTask{Port: 443, Host: "localhost", State: "drained", From: "remote"},
+		},
+		{
+			name:     "url from the controller",
+			wait:     types.WaitForTask{URL: "https://app.example.com", Status: 204, SearchRegex: "ok", From: "controller"},
+			expected: types.WaitForTask{URL: "https://app.example.com", Status: 204, SearchRegex: "ok", From: "controller"},
+		},
+		{
+			name:    "unknown type",
+			wait:    types.WaitForTask{Condition: "socket:/run/app.sock"},
+			wantErr: "unknown wait_for type: socket",
+		},
+		{
+			name:    "no condition",
+			wait:    types.WaitForTask{Timeout: 10},
+			wantErr: "requires exactly one of",
+		},
+		{
+			name:    "two conditions",
+			wait:    types.WaitForTask{Port: 80, Path: "/tmp/ready"},
+			wantErr: "requires exactly one of",
+		},
+		{
+			name:    "invalid state",
+			wait:    types.WaitForTask{Path: "/tmp/ready", State: "stopped"},
+			wantErr: "invalid wait_for state 'stopped' for a path (expected present, absent)",
+		},
+		{
+			name:    "state on a url",
+			wait:    types.WaitForTask{URL: "http://localhost", State: "present"},
+			wantErr: "wait_for state is not supported for a url",
+		},
+		{
+			name:    "drained from the controller",
+			wait:    types.WaitForTask{Port: 80, State: "drained", From: "controller"},
+			wantErr: "drained can only be checked from the remote host",
+		},
+		{
+			name:    "file from the controller",
+			wait:    types.WaitForTask{Path: "/tmp/ready", From: "controller"},
+			wantErr: "only supported for a port or a url",
+		},
+		{
+			name:    "regex on an absent file",
+			wait:    types.WaitForTask{Path: "/tmp/ready", State: "absent", SearchRegex: "x"},
+			wantErr: "search_regex is only supported",
+		},
+		{
+			name:    "invalid regex",
+			wait:    types.WaitForTask{Command: "cat /tmp/x", SearchRegex: "("},
+			wantErr: "invalid wait_for search_regex",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := normalizeWaitFor(tt.wait)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("normalizeWaitFor() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizeWaitFor() error = %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("normalizeWaitFor() = %+v, want %+v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDescribeWaitFor(t *testing.T) {
+	tests := []struct {
+		wait     types.WaitForTask
+		expected string
+	}{
+		{types.WaitForTask{Condition: "port:5432"}, "port 5432 on localhost to be open"},
+		{types.WaitForTask{Port: 80, State: "drained"}, "port 80 on localhost to be drained"},
+		{types.WaitForTask{Path: "/var/log/app.log", SearchRegex: "started"}, "/var/log/app.log to match 'started'"},
+		{types.WaitForTask{Path: "/var/run/app.lock", State: "absent"}, "/var/run/app.lock to be absent"},
+		{types.WaitForTask{URL: "http://lb/health", Status: 200, From: "controller"}, "http://lb/health to return status 200 (from the controller)"},
+		{types.WaitForTask{Process: "java .*kafka", State: "absent"}, "process 'java .*kafka' to stop"},
+		{types.WaitForTask{Command: "pg_isready", SearchRegex: "accepting"}, "command 'pg_isready' to succeed matching 'accepting'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			wait, err := normalizeWaitFor(tt.wait)
+			if err != nil {
+				t.Fatalf("normalizeWaitFor() error = %v", err)
+			}
+			if result := describeWaitFor(&wait); result != tt.expected {
+				t.Errorf("describeWaitFor() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExecutor_WaitPortFromController(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	executor := &Executor{Host: types.Host{Name: "testhost"}, OutputWriter: &bytes.Buffer{}}
+	ctx := context.Background()
+
+	open := executor.waitPort(&types.WaitForTask{Port: port, Host: "127.0.0.1", State: "started", From: "controller"})
+	closed := executor.waitPort(&types.WaitForTask{Port: port, Host: "127.0.0.1", State: "stopped", From: "controller"})
+
+	if met, err := open(ctx); !met {
+		t.Errorf("open port check = false (%v), want true", err)
+	}
+	if met, _ := closed(ctx); met {
+		t.Error("closed port check = true while listening")
+	}
+
+	_ = listener.Close()
+	if met, _ := open(ctx); met {
+		t.Error("open port check = true after closing")
+	}
+	if met, err := closed(ctx); !met {
+		t.Errorf("closed port check = false (%v), want true", err)
+	}
+}
+
+func TestExecutor_WaitURLFromController(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"status": "starting"}`)
+	}))
+	defer server.Close()
+
+	executor := &Executor{Host: types.Host{Name: "testhost"}, OutputWriter: &bytes.Buffer{}}
+	ctx := context.Background()
+
+	anyStatus := executor.waitURL(&types.WaitForTask{URL: server.URL, From: "controller"}, nil)
+	if met, err := anyStatus(ctx); met || err == nil || err.Error() != "status 503" {
+		t.Errorf("url check = %v, %v, want false, status 503", met, err)
+	}
+
+	status = http.StatusOK
+	if met, err := anyStatus(ctx); !met {
+		t.Errorf("url check = false (%v), want true", err)
+	}
+
+	ready := executor.waitURL(&types.WaitForTask{URL: server.URL, Status: 200, From: "controller"},
+		regexpMustCompile(t, `"status": "ready"`))
+	if met, err := ready(ctx); met || err == nil || err.Error() != "body does not match" {
+		t.Errorf("url check = %v, %v, want false, body does not match", met, err)
+	}
+}
+
+func TestExecutor_ExecuteWaitForReportsDuration(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	executor := &Executor{Host: types.Host{Name: "testhost"}, OutputWriter: &bytes.Buffer{}}
+
+	wait, err := normalizeWaitFor(types.WaitForTask{Port: port, Host: "127.0.0.1", From: "controller"})
+	if err != nil {
+		t.Fatalf("normalizeWaitFor() error = %v", err)
+	}
+	output, err := executor.executeWaitFor(&wait, false)
+	if err != nil {
+		t.Fatalf("executeWaitFor() error = %v", err)
+	}
+	expected := fmt.Sprintf("Condition met: port %d on 127.0.0.1 to be open (from the controller) (after 0s)", port)
+	if output != expected {
+		t.Errorf("executeWaitFor() = %q, want %q", output, expected)
+	}
+
+	wait.State = "stopped"
+	wait.Timeout = 1
+	wait.Sleep = 1
+	_, err = executor.executeWaitFor(&wait, false)
+	if err == nil || !strings.Contains(err.Error(), "timeout after 1s waiting for port "+strconv.Itoa(port)) ||
+		!strings.Contains(err.Error(), "(last check: port "+strconv.Itoa(port)+" on 127.0.0.1 is open)") {
+		t.Errorf("executeWaitFor() error = %v, want a timeout with the last check", err)
+	}
+}
+
+func TestExecutor_WaitPortFromRemote(t *testing.T) {
+	server, host := newTestSSHServer(t, echoHandler)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	exec.OutputWriter = &bytes.Buffer{}
+	ctx := context.Background()
+
+	closed := exec.waitPort(&types.WaitForTask{Port: port, Host: "127.0.0.1", State: "stopped", From: "remote"})
+	if met, _ := closed(ctx); met {
+		t.Error("closed port check = true while listening")
+	}
+	_ = listener.Close()
+	if met, err := closed(ctx); !met {
+		t.Errorf("closed port check = false (%v), want true", err)
+	}
+
+	// A server refusing to forward says nothing of the port, and the wait
+	// fails without waiting for its timeout
+	server.mu.Lock()
+	server.noForwarding = true
+	server.mu.Unlock()
+	if met, err := closed(ctx); met || !errors.Is(err, errUncheckable) {
+		t.Errorf("closed port check = %v, %v, want an uncheckable condition", met, err)
+	}
+
+	wait, err := normalizeWaitFor(types.WaitForTask{Port: port, Host: "127.0.0.1", State: "stopped", Timeout: 5})
+	if err != nil {
+		t.Fatalf("normalizeWaitFor() error = %v", err)
+	}
+	start := time.Now()
+	_, err = exec.executeWaitFor(&wait, false)
+	if err == nil || !strings.Contains(err.Error(), "does not allow port forwarding") {
+		t.Errorf("executeWaitFor() error = %v, want port forwarding refused", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("executeWaitFor() took %s, want an immediate failure", elapsed)
+	}
+}
+
+func TestExecutor_WaitCommandTimeout(t *testing.T) {
+	_, host := newTestSSHServer(t, func(cmd string) (string, uint32) {
+		switch {
+		case strings.HasPrefix(cmd, "mktemp"):
+			return "/tmp/sshot-test\n", 0
+		case strings.Contains(cmd, "check-ready"):
+			// The check hangs
+			time.Sleep(5 * time.Second)
+		}
+		return "", 0
+	})
+
+	exec, err := NewExecutor(host, "")
+	if err != nil {
+		t.Fatalf("NewExecutor() error = %v", err)
+	}
+	defer exec.Close()
+	exec.OutputWriter = &bytes.Buffer{}
+
+	wait, err := normalizeWaitFor(types.WaitForTask{Command: "check-ready", Timeout: 1})
+	if err != nil {
+		t.Fatalf("normalizeWaitFor() error = %v", err)
+	}
+	start := time.Now()
+	_, err = exec.executeWaitFor(&wait, false)
+	if err == nil || !strings.Contains(err.Error(), "timeout after 1s waiting for") {
+		t.Errorf("executeWaitFor() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("executeWaitFor() took %s, want the hung check killed at the timeout", elapsed)
+	}
+}
+
+func TestDrainedScript(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("/proc/net/tcp is not available")
+	}
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("awk is not available")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	count := func() string {
+		out, err := exec.Command("/bin/sh", "-c", fmt.Sprintf(drainedScript, port)).Output()
+		if err != nil {
+			t.Fatalf("drained script failed: %v", err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	if n := count(); n != "0" {
+		t.Errorf("connections before connecting = %s, want 0", n)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if n := count(); n != "1" {
+		t.Errorf("connections while connected = %s, want 1", n)
+	}
+	_ = conn.Close()
+}
+
+func TestProcessRunning(t *testing.T) {
+	// The probe runs as: sshd session shell (100) > sudo (200) > sh (300) > ps (301)
+	probe := `300
+  1     0 /sbin/init
+100     1 bash -c sudo -S sh -c 'echo $$; ps -eo pid=,ppid=,args=' # java kafka
+200   100 sudo -S sh -c echo $$; ps -eo pid=,ppid=,args= # java kafka
+300   200 sh -c echo $$; ps -eo pid=,ppid=,args= # java kafka
+301   300 ps -eo pid=,ppid=,args=
+`
+	re := regexpMustCompile(t, "java .*kafka")
+
+	if processRunning(probe, re) {
+		t.Error("processRunning() matched the probe's own processes")
+	}
+	if !processRunning(probe+"400     1 java -cp /opt/kafka/libs Kafka\n", re) {
+		t.Error("processRunning() missed a matching process")
+	}
+	if processRunning(probe+"400     1 java -jar app.jar\n", re) {
+		t.Error("processRunning() matched a process not matching the pattern")
+	}
+}
+
+func regexpMustCompile(t *testing.T, pattern string) *regexp.Regexp {
+	t.Helper()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatalf("regexp.Compile() error = %v", err)
+	}
+	return re
+}
@@ -0,0 +1,201 @@
+package playbook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/executor"
+	"github.com/fgouteroux/sshot/pkg/types"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+// taskNode is a task of the task graph of a host
+type taskNode struct {
+	task       types.Task
+	deps       []int
+	dependents []int
+}
+
+// buildTaskGraph links the tasks through their depends_on. Task names must be
+// unique and the dependencies must exist and not form a cycle.
+func buildTaskGraph(tasks []types.Task) ([]taskNode, error) {
+	index := make(map[string]int, len(tasks))
+	for i, task := range tasks {
+		if _, ok := index[task.Name]; ok {
+			return nil, fmt.Errorf("duplicate task name '%s', names must be unique with task_concurrency", task.Name)
+		}
+		index[task.Name] = i
+	}
+
+	nodes := make([]taskNode, len(tasks))
+	for i, task := range tasks {
+		nodes[i].task = task
+		for _, dep := range task.DependsOn {
+			j, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("task '%s' depends on unknown task '%s'", task.Name, dep)
+			}
+			nodes[i].deps = append(nodes[i].deps, j)
+			nodes[j].dependents = append(nodes[j].dependents, i)
+		}
+	}
+
+	// Depth-first search for a cycle, keeping the path to report it
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(nodes))
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		path = append(path, nodes[i].task.Name)
+		state[i] = visiting
+		for _, dep := range nodes[i].deps {
+			switch state[dep] {
+			case visiting:
+				start := 0
+				for k, name := range path {
+					if name == nodes[dep].task.Name {
+						start = k
+					}
+				}
+				return fmt.Errorf("dependency cycle: %s → %s", strings.Join(path[start:], " → "), nodes[dep].task.Name)
+			case unvisited:
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = visited
+		path = path[:len(path)-1]
+		return nil
+	}
+	for i := range nodes {
+		if state[i] == unvisited {
+			if err := visit(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nodes, nil
+}
+
+// taskResult is the outcome of a task run by executeTaskGraph
+type taskResult struct {
+	node     int
+	fork     *executor.Executor
+	output   *bytes.Buffer
+	err      error
+	duration time.Duration
+}
+
+// executeTaskGraph runs the tasks of a host as soon as the tasks they depend
+// on are completed, up to concurrency at a time. Each task runs on a fork of
+// the executor and its output is printed as a whole once it is finished. A
+// failure stops scheduling, the running tasks being waited for.
+func executeTaskGraph(ctx context.Context, exec *executor.Executor, tasks []types.Task, concurrency int, writer io.Writer, hostStart time.Time) error {
+	nodes, err := buildTaskGraph(tasks)
+	if err != nil {
+		fmt.Fprintf(writer, "%s└─ ✗ Invalid task graph:%s %v\n\n", utils.Color(utils.ColorRed), utils.Color(utils.ColorReset), err)
+		return err
+	}
+
+	waiting := make([]int, len(nodes))
+	var ready []int
+	for i, node := range nodes {
+		waiting[i] = len(node.deps)
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	results := make(chan taskResult)
+	running, completed := 0, 0
+	var failure, stopped error
+
+	for {
+		for failure == nil && stopped == nil && running < concurrency && len(ready) > 0 {
+			// Stop starting tasks after a Ctrl-C or once out of time
+			if err := schedulingError(ctx); err != nil {
+				stopped = err
+				break
+			}
+
+			i := ready[0]
+			ready = ready[1:]
+			running++
+
+			if types.ExecOptions.Verbose {
+				log.Printf("[VERBOSE] [%s] Starting task %d/%d: %s (%d running)", exec.Host.Name, i+1, len(nodes), nodes[i].task.Name, running)
+			}
+
+			output := &bytes.Buffer{}
+			fork := exec.Fork(output)
+			go func(i int) {
+				taskStart := time.Now()
+				err := fork.ExecuteTaskContext(ctx, nodes[i].task)
+				results <- taskResult{node: i, fork: fork, output: output, err: err, duration: time.Since(taskStart)}
+			}(i)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		task := nodes[result.node].task
+		exec.Join(task, result.fork)
+		exec.PublishVars()
+
+		// The output of a task is printed at once, so tasks are not interleaved
+		var block bytes.Buffer
+		fmt.Fprintf(&block, "%s│%s [%d/%d] %s\n", utils.Color(utils.ColorCyan), utils.Color(utils.ColorReset), result.node+1, len(nodes), task.Name)
+		block.Write(result.output.Bytes())
+		if result.err != nil {
+			log.SetOutput(&block)
+			log.Printf("  %s✗%s Task failed after %s: %v\n", utils.Color(utils.ColorRed), utils.Color(utils.ColorReset), utils.FormatDuration(result.duration), result.err)
+			log.SetOutput(os.Stderr)
+		} else if types.ExecOptions.Verbose || result.duration > 1*time.Second {
+			fmt.Fprintf(&block, "%s│%s         %s⏱%s  Task took %s%s%s\n",
+				utils.Color(utils.ColorCyan), utils.Color(utils.ColorReset), utils.Color(utils.ColorGray), utils.Color(utils.ColorReset), utils.Color(utils.ColorCyan), utils.FormatDuration(result.duration), utils.Color(utils.ColorReset))
+		}
+		_, _ = writer.Write(block.Bytes())
+
+		if result.err != nil {
+			if failure == nil {
+				failure = result.err
+			}
+			continue
+		}
+
+		completed++
+		for _, dependent := range nodes[result.node].dependents {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		sort.Ints(ready)
+	}
+
+	switch {
+	case failure != nil:
+		fmt.Fprintf(writer, "%s└─ ✗ Failed%s (total time: %s)\n\n", utils.Color(utils.ColorRed), utils.Color(utils.ColorReset), utils.FormatDuration(time.Since(hostStart)))
+		return failure
+	case stopped != nil:
+		fmt.Fprintf(writer, "%s└─ ✗ Stopped with %d/%d tasks completed:%s %v (total time: %s)\n\n", utils.Color(utils.ColorRed), completed, len(nodes), utils.Color(utils.ColorReset), stopped, utils.FormatDuration(time.Since(hostStart)))
+		return stopped
+	}
+	return nil
+}
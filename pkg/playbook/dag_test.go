@@ -0,0 +1,168 @@
+package playbook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/executor"
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func TestBuildTaskGraph(t *testing.T) {
+	tests := []struct {
+		name    string
+		tasks   []types.Task
+		wantErr string
+	}{
+		{
+			name: "independent and dependent tasks",
+			tasks: []types.Task{
+				{Name: "download a"},
+				{Name: "download b"},
+				{Name: "install", DependsOn: []string{"download a", "download b"}},
+			},
+		},
+		{
+			name:    "unknown dependency",
+			tasks:   []types.Task{{Name: "install", DependsOn: []string{"download"}}},
+			wantErr: "task 'install' depends on unknown task 'download'",
+		},
+		{
+			name:    "duplicate name",
+			tasks:   []types.Task{{Name: "restart"}, {Name: "restart"}},
+			wantErr: "duplicate task name 'restart'",
+		},
+		{
+			name: "cycle",
+			tasks: []types.Task{
+				{Name: "setup"},
+				{Name: "a", DependsOn: []string{"setup", "c"}},
+				{Name: "b", DependsOn: []string{"a"}},
+				{Name: "c", DependsOn: []string{"b"}},
+			},
+			wantErr: "dependency cycle: a → c → b → a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := buildTaskGraph(tt.tasks)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("buildTaskGraph() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildTaskGraph() error = %v", err)
+			}
+			if len(nodes[2].deps) != 2 || len(nodes[0].dependents) != 1 {
+				t.Errorf("buildTaskGraph() = %+v", nodes)
+			}
+		})
+	}
+}
+
+func newGraphExecutor() *executor.Executor {
+	return &executor.Executor{
+		Host:           types.Host{Name: "testhost"},
+		Variables:      make(map[string]interface{}),
+		Registers:      make(map[string]string),
+		CompletedTasks: make(map[string]bool),
+	}
+}
+
+func TestExecuteTaskGraph(t *testing.T) {
+	tasks := []types.Task{
+		{Name: "download a", LocalAction: "sleep 0.3; printf artifact-a", Register: "a"},
+		{Name: "download b", LocalAction: "sleep 0.3; printf artifact-b", Register: "b"},
+		{Name: "download c", LocalAction: "sleep 0.3; printf artifact-c", Register: "c"},
+		{Name: "install", LocalAction: "echo {{ .a }} {{ .b }} {{ .c }}", Register: "installed",
+			DependsOn: []string{"download a", "download b", "download c"}},
+	}
+
+	var output bytes.Buffer
+	exec := newGraphExecutor()
+	start := time.Now()
+	if err := executeTaskGraph(context.Background(), exec, tasks, 3, &output, start); err != nil {
+		t.Fatalf("executeTaskGraph() error = %v\n%s", err, output.String())
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("independent tasks took %s, want them to run concurrently", elapsed)
+	}
+
+	if exec.Registers["installed"] != "artifact-a artifact-b artifact-c\n" {
+		t.Errorf("Registers[installed] = %q, want the registers of the tasks it depends on", exec.Registers["installed"])
+	}
+	for _, task := range tasks {
+		if !exec.CompletedTasks[task.Name] {
+			t.Errorf("task '%s' should be completed", task.Name)
+		}
+	}
+
+	// The output of each task follows its header
+	out := output.String()
+	for i, name := range []string{"a", "b", "c"} {
+		header := fmt.Sprintf("[%d/4] download %s\n", i+1, name)
+		start := strings.Index(out, header)
+		if start < 0 {
+			t.Fatalf("Output should contain %q, got: %q", header, out)
+		}
+		block := out[start+len(header):]
+		if end := strings.Index(block, "/4] "); end >= 0 {
+			block = block[:end]
+		}
+		if !strings.Contains(block, "artifact-"+name) {
+			t.Errorf("output of task 'download %s' should follow its header, got: %q", name, out)
+		}
+	}
+	if strings.Index(out, "[4/4] install") < strings.Index(out, "download c") {
+		t.Errorf("install should be reported after its dependencies, got: %q", out)
+	}
+}
+
+func TestExecuteTaskGraph_ConcurrencyCap(t *testing.T) {
+	tasks := []types.Task{
+		{Name: "one", LocalAction: "sleep 0.3"},
+		{Name: "two", LocalAction: "sleep 0.3"},
+		{Name: "three", LocalAction: "sleep 0.3"},
+	}
+
+	start := time.Now()
+	if err := executeTaskGraph(context.Background(), newGraphExecutor(), tasks, 2, &bytes.Buffer{}, start); err != nil {
+		t.Fatalf("executeTaskGraph() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("3 tasks with a cap of 2 took %s, want at least 2 rounds", elapsed)
+	}
+}
+
+func TestExecuteTaskGraph_Failure(t *testing.T) {
+	tasks := []types.Task{
+		{Name: "build", LocalAction: "exit 2"},
+		{Name: "lint", LocalAction: "sleep 0.2"},
+		{Name: "deploy", LocalAction: "echo deployed", DependsOn: []string{"build"}},
+	}
+
+	var output bytes.Buffer
+	exec := newGraphExecutor()
+	err := executeTaskGraph(context.Background(), exec, tasks, 3, &output, time.Now())
+	if err == nil {
+		t.Fatal("executeTaskGraph() should fail")
+	}
+
+	out := output.String()
+	if strings.Contains(out, "deploy") {
+		t.Errorf("a task depending on a failed task should not run, got: %q", out)
+	}
+	if !exec.CompletedTasks["lint"] {
+		t.Error("running tasks should be waited for after a failure")
+	}
+	if !strings.Contains(out, "└─ ✗ Failed") {
+		t.Errorf("Output should report the failure, got: %q", out)
+	}
+}
@@ -0,0 +1,72 @@
+package playbook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/fgouteroux/sshot/pkg/executor"
+	"github.com/fgouteroux/sshot/pkg/utils"
+)
+
+// errInterrupted is the cause of the contexts canceled by Ctrl-C
+var errInterrupted = errors.New("interrupted")
+
+// handleInterrupts returns a context for the run. The first SIGINT stops
+// scheduling new tasks and lets the running ones finish, the second cancels
+// the returned context so running remote commands are killed, and a third
+// exits right away. The returned function stops handling signals.
+func handleInterrupts(parent context.Context) (context.Context, func()) {
+	stopCtx, stop := context.WithCancelCause(parent)
+	killCtx, kill := context.WithCancelCause(parent)
+	ctx := executor.WithInterruptContext(killCtx, stopCtx)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt)
+	done := make(chan struct{})
+
+	go func() {
+		for count := 1; ; count++ {
+			select {
+			case <-done:
+				return
+			case <-signals:
+			}
+
+			switch count {
+			case 1:
+				fmt.Fprintf(os.Stderr, "\n%s⚠ Interrupted, waiting for running tasks to finish (press Ctrl-C again to kill them)%s\n",
+					utils.Color(utils.ColorYellow), utils.Color(utils.ColorReset))
+				stop(errInterrupted)
+			case 2:
+				fmt.Fprintf(os.Stderr, "\n%s⚠ Interrupted again, killing running tasks and cleaning up (press Ctrl-C again to exit now)%s\n",
+					utils.Color(utils.ColorYellow), utils.Color(utils.ColorReset))
+				kill(errInterrupted)
+			default:
+				fmt.Fprintf(os.Stderr, "\n%s✗ Exiting without cleanup%s\n", utils.Color(utils.ColorRed), utils.Color(utils.ColorReset))
+				os.Exit(130)
+			}
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		stop(nil)
+		kill(nil)
+	}
+}
+
+// schedulingError returns why no new task may start: a Ctrl-C, an expired
+// deadline or host timeout. It returns nil while tasks can still be started.
+func schedulingError(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if stopCtx := executor.InterruptContext(ctx); stopCtx != nil && stopCtx.Err() != nil {
+		return context.Cause(stopCtx)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package playbook
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fgouteroux/sshot/pkg/executor"
+	"github.com/fgouteroux/sshot/pkg/types"
+)
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition not met after 1s")
+}
+
+func TestHandleInterrupts(t *testing.T) {
+	ctx, stopInterrupts := handleInterrupts(context.Background())
+	defer stopInterrupts()
+
+	if err := schedulingError(ctx); err != nil {
+		t.Fatalf("schedulingError() = %v before any interrupt", err)
+	}
+
+	// The first Ctrl-C only stops scheduling
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatalf("Failed to send SIGINT: %v", err)
+	}
+	waitFor(t, func() bool { return schedulingError(ctx) != nil })
+	if err := schedulingError(ctx); !errors.Is(err, errInterrupted) {
+		t.Errorf("schedulingError() = %v, want errInterrupted", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("running tasks should not be canceled by the first interrupt")
+	}
+
+	// The second one cancels the running tasks
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatalf("Failed to send SIGINT: %v", err)
+	}
+	waitFor(t, func() bool { return ctx.Err() != nil })
+	if cause := context.Cause(ctx); !errors.Is(cause, errInterrupted) {
+		t.Errorf("context.Cause() = %v, want errInterrupted", cause)
+	}
+}
+
+func TestExecuteOnHost_Interrupted(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	stopCtx, stop := context.WithCancelCause(context.Background())
+	stop(errInterrupted)
+	ctx := executor.WithInterruptContext(context.Background(), stopCtx)
+
+	host := types.Host{
+		Name:     "testhost",
+		Address:  "127.0.0.1",
+		User:     "testuser",
+		Password: "testpass",
+	}
+
+	result := executeOnHost(ctx, host, []types.Task{{Name: "Task1", Command: "echo hello"}}, true, "")
+
+	if result.Success || !result.Interrupted {
+		t.Fatalf("executeOnHost() = %+v, want an interrupted host", result)
+	}
+	if strings.Contains(result.Output, "Task1") {
+		t.Errorf("No task should start after an interrupt, got: %q", result.Output)
+	}
+}
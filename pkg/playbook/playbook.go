@@ -1,6 +1,8 @@
 package playbook
 
 import (
+	"context"
+	"errors"
 	"github.com/fgouteroux/sshot/pkg/config"
 	"github.com/fgouteroux/sshot/pkg/executor"
 	"github.com/fgouteroux/sshot/pkg/types"
@@ -14,7 +16,7 @@ import (
 	"time"
 )
 
-func executeOnHost(host types.Host, tasks []types.Task, captureOutput bool, groupName string) types.HostResult {
+func executeOnHost(ctx context.Context, host types.Host, tasks []types.Task, captureOutput bool, groupName string) types.HostResult {
 	var output bytes.Buffer
 	var writer io.Writer = os.Stdout
 
@@ -32,6 +34,19 @@ func executeOnHost(host types.Host, tasks []types.Task, captureOutput bool, grou
 	fmt.Fprintf(writer, "%s┌─ Host: %s%s%s (%s)\n", utils.Color(utils.ColorCyan), utils.Color(utils.ColorBold), host.Name, utils.Color(utils.ColorReset), displayTarget)
 	fmt.Fprintf(writer, "%s│%s\n", utils.Color(utils.ColorCyan), utils.Color(utils.ColorReset))
 
+	if err := schedulingError(ctx); err != nil {
+		fmt.Fprintf(writer, "%s└─ ✗ Not started:%s %v\n\n", utils.Color(utils.ColorRed), utils.Color(utils.ColorReset), err)
+		return types.HostResult{Host: host, Success: false, Error: err, Output: output.String(), Interrupted: errors.Is(err, errInterrupted)}
+	}
+
+	// The host timeout covers all of its tasks
+	if host.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, time.Duration(host.Timeout)*time.Second,
+			fmt.Errorf("host timeout of %d seconds exceeded", host.Timeout))
+		defer cancel()
+	}
+
 	exec, err := executor.NewExecutor(host, groupName)
 	if err != nil {
 		fmt.Fprintf(writer, "%s│%s %s✗ Connection failed:%s %v\n", utils.Color(utils.ColorCyan), utils.Color(utils.ColorReset), utils.Color(utils.ColorRed), utils.Color(utils.ColorReset), err)
@@ -44,6 +59,10 @@ func executeOnHost(host types.Host, tasks []types.Task, captureOutput bool, grou
 		exec.OutputWriter = writer
 	}
 
+	if globalConfig, ok := config.Cache.Get(); ok {
+		exec.Environment = globalConfig.Playbook.Environment
+	}
+
 	// Collect facts if collectors are configured
 	if globalConfig, ok := config.Cache.Get(); ok && len(globalConfig.Playbook.Facts.Collectors) > 0 {
 		fmt.Fprintf(writer, "%s│%s Gathering system facts...\n", utils.Color(utils.ColorCyan), utils.Color(utils.ColorReset))
@@ -56,17 +75,39 @@ func executeOnHost(host types.Host, tasks []types.Task, captureOutput bool, grou
 		}
 	}
 
+	// Other hosts see the variables of this host through hostvars
+	exec.PublishVars()
+
+	// Independent tasks run concurrently in task graph mode
+	if globalConfig, ok := config.Cache.Get(); ok && globalConfig.Playbook.TaskConcurrency > 1 {
+		if err := executeTaskGraph(ctx, exec, tasks, globalConfig.Playbook.TaskConcurrency, writer, hostStart); err != nil {
+			return types.HostResult{Host: host, Success: false, Error: err, Output: output.String(), Interrupted: errors.Is(err, errInterrupted)}
+		}
+		totalDuration := time.Since(hostStart)
+		fmt.Fprintf(writer, "%s└─ ✓ Completed%s (total time: %s%s%s)\n\n",
+			utils.Color(utils.ColorGreen), utils.Color(utils.ColorReset), utils.Color(utils.ColorCyan), utils.FormatDuration(totalDuration), utils.Color(utils.ColorReset))
+		return types.HostResult{Host: host, Success: true, Error: nil, Output: output.String()}
+	}
+
 	for i, task := range tasks {
+		// Stop before the next task after a Ctrl-C or once out of time
+		if err := schedulingError(ctx); err != nil {
+			fmt.Fprintf(writer, "%s└─ ✗ Stopped before task %d/%d:%s %v (total time: %s)\n\n", utils.Color(utils.ColorRed), i+1, len(tasks), utils.Color(utils.ColorReset), err, utils.FormatDuration(time.Since(hostStart)))
+			return types.HostResult{Host: host, Success: false, Error: err, Output: output.String(), Interrupted: errors.Is(err, errInterrupted)}
+		}
+
 		taskStart := time.Now()
 		fmt.Fprintf(writer, "%s│%s [%d/%d] %s\n", utils.Color(utils.ColorCyan), utils.Color(utils.ColorReset), i+1, len(tasks), task.Name)
 
-		if err := exec.ExecuteTask(task); err != nil {
+		err := exec.ExecuteTaskContext(ctx, task)
+		exec.PublishVars()
+		if err != nil {
 			taskDuration := time.Since(taskStart)
 			log.SetOutput(writer)
 			log.Printf("  %s✗%s Task failed after %s: %v\n", utils.Color(utils.ColorRed), utils.Color(utils.ColorReset), utils.FormatDuration(taskDuration), err)
 			log.SetOutput(os.Stderr)
 			fmt.Fprintf(writer, "%s└─ ✗ Failed%s (total time: %s)\n\n", utils.Color(utils.ColorRed), utils.Color(utils.ColorReset), utils.FormatDuration(time.Since(hostStart)))
-			return types.HostResult{Host: host, Success: false, Error: err, Output: output.String()}
+			return types.HostResult{Host: host, Success: false, Error: err, Output: output.String(), Interrupted: errors.Is(err, errInterrupted)}
 		}
 
 		taskDuration := time.Since(taskStart)
@@ -82,7 +123,7 @@ func executeOnHost(host types.Host, tasks []types.Task, captureOutput bool, grou
 	return types.HostResult{Host: host, Success: true, Error: nil, Output: output.String()}
 }
 
-func executeHostsParallel(hosts []types.Host, tasks []types.Task, groupName string) []types.HostResult {
+func executeHostsParallel(ctx context.Context, hosts []types.Host, tasks []types.Task, groupName string) []types.HostResult {
 	var wg sync.WaitGroup
 	resultsChan := make(chan types.HostResult, len(hosts))
 
@@ -90,7 +131,7 @@ func executeHostsParallel(hosts []types.Host, tasks []types.Task, groupName stri
 		wg.Add(1)
 		go func(h types.Host) {
 			defer wg.Done()
-			result := executeOnHost(h, tasks, true, groupName)
+			result := executeOnHost(ctx, h, tasks, true, groupName)
 			resultsChan <- result
 		}(host)
 	}
@@ -115,11 +156,11 @@ func executeHostsParallel(hosts []types.Host, tasks []types.Task, groupName stri
 	return results
 }
 
-func executeHostsSequential(hosts []types.Host, tasks []types.Task, groupName string) []types.HostResult {
+func executeHostsSequential(ctx context.Context, hosts []types.Host, tasks []types.Task, groupName string) []types.HostResult {
 	var results []types.HostResult
 
 	for _, host := range hosts {
-		result := executeOnHost(host, tasks, false, groupName)
+		result := executeOnHost(ctx, host, tasks, false, groupName)
 		results = append(results, result)
 
 		if !result.Success {
@@ -130,7 +171,7 @@ func executeHostsSequential(hosts []types.Host, tasks []types.Task, groupName st
 	return results
 }
 
-func executeWithGroups(cfg types.Config) ([]types.HostResult, error) {
+func executeWithGroups(ctx context.Context, cfg types.Config) ([]types.HostResult, error) {
 	// Store the cfg in the cache if not already set
 	config.Cache.Set(&cfg)
 
@@ -159,6 +200,10 @@ func executeWithGroups(cfg types.Config) ([]types.HostResult, error) {
 	completedGroups := make(map[string]bool)
 
 	for _, group := range sortedGroups {
+		if err := schedulingError(ctx); errors.Is(err, errInterrupted) {
+			return allResults, fmt.Errorf("group '%s' not started: %w", group.Name, err)
+		}
+
 		if len(group.DependsOn) > 0 {
 			for _, dep := range group.DependsOn {
 				if !completedGroups[dep] {
@@ -176,9 +221,9 @@ func executeWithGroups(cfg types.Config) ([]types.HostResult, error) {
 		var groupResults []types.HostResult
 
 		if group.Parallel {
-			groupResults = executeHostsParallel(group.Hosts, cfg.Playbook.Tasks, group.Name)
+			groupResults = executeHostsParallel(ctx, group.Hosts, cfg.Playbook.Tasks, group.Name)
 		} else {
-			groupResults = executeHostsSequential(group.Hosts, cfg.Playbook.Tasks, group.Name)
+			groupResults = executeHostsSequential(ctx, group.Hosts, cfg.Playbook.Tasks, group.Name)
 		}
 
 		allResults = append(allResults, groupResults...)
@@ -191,6 +236,9 @@ func executeWithGroups(cfg types.Config) ([]types.HostResult, error) {
 		}
 
 		if groupFailed {
+			if err := schedulingError(ctx); errors.Is(err, errInterrupted) {
+				return allResults, fmt.Errorf("group '%s' %w", group.Name, err)
+			}
 			return allResults, fmt.Errorf("group '%s' failed", group.Name)
 		}
 
@@ -203,21 +251,41 @@ func executeWithGroups(cfg types.Config) ([]types.HostResult, error) {
 func printPlaybookSummary(results []types.HostResult, totalDuration time.Duration, err error) {
 	successCount := 0
 	failCount := 0
+	interruptedCount := 0
 	for _, result := range results {
 		if result.Success {
 			successCount++
 		} else {
 			failCount++
 		}
+		if result.Interrupted {
+			interruptedCount++
+		}
 	}
 
 	fmt.Printf("╔════════════════════════════════════════════════════════════════╗\n")
 	if err != nil || failCount > 0 {
-		fmt.Printf("║  ✗ PLAYBOOK FAILED                                             ║\n")
+		if interruptedCount > 0 {
+			fmt.Printf("║  ✗ PLAYBOOK INTERRUPTED                                        ║\n")
+		} else {
+			fmt.Printf("║  ✗ PLAYBOOK FAILED                                             ║\n")
+		}
 		fmt.Printf("║    Successful: %-3d  Failed: %-3d                                ║\n", successCount, failCount)
+		if interruptedCount > 0 {
+			fmt.Printf("║    Interrupted: %-3d                                            ║\n", interruptedCount)
+		}
 		fmt.Printf("║    Total time: %-47s ║\n", utils.FormatDuration(totalDuration))
 		fmt.Printf("╚════════════════════════════════════════════════════════════════╝\n\n")
 
+		for _, result := range results {
+			if result.Interrupted {
+				fmt.Printf("  %s⚠ %s interrupted:%s %v\n", utils.Color(utils.ColorYellow), result.Host.Name, utils.Color(utils.ColorReset), result.Error)
+			}
+		}
+		if interruptedCount > 0 {
+			fmt.Printf("\n")
+		}
+
 		if types.ExecOptions.Verbose {
 			if err != nil {
 				log.Printf("[VERBOSE] Error: %v", err)
@@ -232,6 +300,8 @@ func printPlaybookSummary(results []types.HostResult, totalDuration time.Duratio
 	} else {
 		if types.ExecOptions.DryRun {
 			fmt.Printf("║  ✓ DRY-RUN COMPLETED                                           ║\n")
+		} else if types.ExecOptions.Check {
+			fmt.Printf("║  ✓ CHECK COMPLETED                                             ║\n")
 		} else {
 			fmt.Printf("║  ✓ PLAYBOOK COMPLETED SUCCESSFULLY                             ║\n")
 		}
@@ -246,9 +316,9 @@ func Run(playbookPath string, options *types.ExecutionOptions) error {
 	playbookStart := time.Now()
 
 	// Reset the run_once tracking
-	types.RunOnceTasks.Lock()
-	types.RunOnceTasks.Executed = make(map[string]bool)
-	types.RunOnceTasks.Unlock()
+	executor.ResetRunOnceTracking()
+	executor.ResetHostVars()
+	executor.ResetFetchClaims()
 
 	// Load config (either separate or combined files)
 	cfg, err := config.Load(playbookPath, types.ExecOptions.InventoryFile)
@@ -260,7 +330,21 @@ func Run(playbookPath string, options *types.ExecutionOptions) error {
 	config.Cache.Set(cfg)
 
 	// Apply SSH defaults to hosts
-	config.ApplySSHDefaults(cfg)
+	if err := config.ApplySSHDefaults(cfg); err != nil {
+		return err
+	}
+
+	// In task graph mode the dependencies are checked before connecting
+	if cfg.Playbook.TaskConcurrency > 1 {
+		if _, err := buildTaskGraph(cfg.Playbook.Tasks); err != nil {
+			return fmt.Errorf("invalid task graph: %w", err)
+		}
+	}
+
+	// The playbook can opt out of strict variable checking
+	if cfg.Playbook.StrictVars != nil && !*cfg.Playbook.StrictVars {
+		types.ExecOptions.NoStrictVars = true
+	}
 
 	parallel := cfg.Playbook.Parallel
 
@@ -268,10 +352,16 @@ func Run(playbookPath string, options *types.ExecutionOptions) error {
 		log.Printf("[VERBOSE] Playbook: %s", cfg.Playbook.Name)
 		log.Printf("[VERBOSE] Execution mode: %s", map[bool]string{true: "parallel", false: "sequential"}[parallel])
 		log.Printf("[VERBOSE] Dry-run: %v", types.ExecOptions.DryRun)
+		log.Printf("[VERBOSE] Strict variables: %v", !types.ExecOptions.NoStrictVars)
+		if types.ExecOptions.Deadline > 0 {
+			log.Printf("[VERBOSE] Deadline: %s", types.ExecOptions.Deadline)
+		}
 	}
 
 	if types.ExecOptions.DryRun {
 		fmt.Printf("\n🔍 DRY-RUN MODE - No actual changes will be made\n")
+	} else if types.ExecOptions.Check {
+		fmt.Printf("\n🔍 CHECK MODE - Reporting changes without applying them\n")
 	}
 
 	fmt.Printf("\n╔════════════════════════════════════════════════════════════════╗\n")
@@ -281,19 +371,37 @@ func Run(playbookPath string, options *types.ExecutionOptions) error {
 	}
 	fmt.Printf("╚════════════════════════════════════════════════════════════════╝\n\n")
 
+	// Ctrl-C stops the run gracefully, twice kills the running commands
+	ctx, stopInterrupts := handleInterrupts(context.Background())
+	defer stopInterrupts()
+
+	// Connections to delegate hosts are shared by every host of the play
+	defer executor.CloseDelegateConnections()
+
+	// The deadline covers the whole play, every host included
+	if types.ExecOptions.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, types.ExecOptions.Deadline,
+			fmt.Errorf("playbook deadline of %s exceeded", types.ExecOptions.Deadline))
+		defer cancel()
+	}
+
 	var results []types.HostResult
 
 	if len(cfg.Inventory.Groups) > 0 {
-		results, err = executeWithGroups(*cfg)
+		results, err = executeWithGroups(ctx, *cfg)
 		if err != nil {
 			printPlaybookSummary(results, time.Since(playbookStart), err)
+			if errors.Is(err, errInterrupted) {
+				return fmt.Errorf("playbook interrupted")
+			}
 			return fmt.Errorf("playbook execution failed")
 		}
 	} else if len(cfg.Inventory.Hosts) > 0 {
 		if parallel {
-			results = executeHostsParallel(cfg.Inventory.Hosts, cfg.Playbook.Tasks, "")
+			results = executeHostsParallel(ctx, cfg.Inventory.Hosts, cfg.Playbook.Tasks, "")
 		} else {
-			results = executeHostsSequential(cfg.Inventory.Hosts, cfg.Playbook.Tasks, "")
+			results = executeHostsSequential(ctx, cfg.Inventory.Hosts, cfg.Playbook.Tasks, "")
 		}
 	} else {
 		return fmt.Errorf("no hosts or groups defined in inventory")
@@ -301,15 +409,21 @@ func Run(playbookPath string, options *types.ExecutionOptions) error {
 
 	// Check if any host failed
 	hasFailure := false
+	interrupted := false
 	for _, result := range results {
 		if !result.Success {
 			hasFailure = true
-			break
+		}
+		if result.Interrupted {
+			interrupted = true
 		}
 	}
 
 	printPlaybookSummary(results, time.Since(playbookStart), nil)
 
+	if interrupted {
+		return fmt.Errorf("playbook interrupted")
+	}
 	if hasFailure {
 		return fmt.Errorf("playbook execution failed")
 	}
@@ -1,6 +1,8 @@
 package playbook
 
 import (
+	"context"
+	"fmt"
 	"github.com/fgouteroux/sshot/pkg/types"
 	"os"
 	"path/filepath"
@@ -43,6 +45,15 @@ func TestPrintPlaybookSummary(t *testing.T) {
 			err:      os.ErrInvalid,
 			duration: 20 * time.Second,
 		},
+		{
+			name: "interrupted",
+			results: []types.HostResult{
+				{Host: types.Host{Name: "host1"}, Success: true},
+				{Host: types.Host{Name: "host2"}, Success: false, Error: errInterrupted, Interrupted: true},
+			},
+			err:      nil,
+			duration: 10 * time.Second,
+		},
 	}
 
 	for _, tt := range tests {
@@ -173,7 +184,7 @@ func TestExecuteWithGroups_DependencyNotMet(t *testing.T) {
 		},
 	}
 
-	results, err := executeWithGroups(config)
+	results, err := executeWithGroups(context.Background(), config)
 	if err != nil {
 		t.Errorf("executeWithGroups failed: %v", err)
 	}
@@ -199,7 +210,7 @@ func TestExecuteHostsSequential(t *testing.T) {
 		{Name: "Task1", Command: "echo test"},
 	}
 
-	results := executeHostsSequential(hosts, tasks, "")
+	results := executeHostsSequential(context.Background(), hosts, tasks, "")
 
 	if len(results) != 2 {
 		t.Errorf("Expected 2 results, got %d", len(results))
@@ -230,7 +241,7 @@ func TestExecuteHostsParallel(t *testing.T) {
 		{Name: "Task2", Command: "echo test2"},
 	}
 
-	results := executeHostsParallel(hosts, tasks, "")
+	results := executeHostsParallel(context.Background(), hosts, tasks, "")
 
 	if len(results) != 3 {
 		t.Errorf("Expected 3 results, got %d", len(results))
@@ -244,6 +255,37 @@ func TestExecuteHostsParallel(t *testing.T) {
 	}
 }
 
+func TestExecuteOnHost_DeadlineExceeded(t *testing.T) {
+	types.ExecOptions.DryRun = true
+	defer func() {
+		types.ExecOptions.DryRun = false
+	}()
+
+	host := types.Host{
+		Name:     "testhost",
+		Address:  "127.0.0.1",
+		User:     "testuser",
+		Password: "testpass",
+	}
+
+	ctx, cancel := context.WithTimeoutCause(context.Background(), time.Millisecond,
+		fmt.Errorf("playbook deadline of 1ms exceeded"))
+	defer cancel()
+	<-ctx.Done()
+
+	result := executeOnHost(ctx, host, []types.Task{{Name: "Task1", Command: "echo hello"}}, true, "")
+
+	if result.Success {
+		t.Fatal("executeOnHost should fail once the deadline has passed")
+	}
+	if result.Error == nil || !strings.Contains(result.Error.Error(), "deadline of 1ms exceeded") {
+		t.Errorf("executeOnHost error = %v, want the deadline", result.Error)
+	}
+	if strings.Contains(result.Output, "Task1") {
+		t.Errorf("No task should start after the deadline, got: %q", result.Output)
+	}
+}
+
 func TestExecuteOnHost_DryRun(t *testing.T) {
 	types.ExecOptions.DryRun = true
 	defer func() {
@@ -262,7 +304,7 @@ func TestExecuteOnHost_DryRun(t *testing.T) {
 		{Name: "Task2", Command: "echo world"},
 	}
 
-	result := executeOnHost(host, tasks, false, "")
+	result := executeOnHost(context.Background(), host, tasks, false, "")
 
 	if !result.Success {
 		t.Errorf("executeOnHost should succeed in dry-run, got error: %v", result.Error)
@@ -297,7 +339,7 @@ func TestExecuteOnHost_DryRun(t *testing.T) {
 		},
 	}
 
-	_, err := executeWithGroups(config)
+	_, err := executeWithGroups(context.Background(), config)
 	if err == nil {
 		t.Error("executeWithGroups should fail with unmet dependency")
 	}
@@ -348,7 +390,7 @@ func TestExecuteWithGroups_SortByOrder(t *testing.T) {
 		},
 	}
 
-	results, err := executeWithGroups(config)
+	results, err := executeWithGroups(context.Background(), config)
 	if err != nil {
 		t.Errorf("executeWithGroups failed: %v", err)
 	}
@@ -1,15 +1,30 @@
 package types
 
 import (
+	"fmt"
 	"sync"
+	"time"
 
+	"gopkg.in/yaml.v3"
 )
 
+// RunOnceTasks holds the results of the run_once tasks of the current run,
+// keyed by play, group and task name
 var RunOnceTasks = struct {
-	sync.RWMutex
-	Executed map[string]bool
+	sync.Mutex
+	Results map[string]*RunOnceResult
 }{
-	Executed: make(map[string]bool),
+	Results: make(map[string]*RunOnceResult),
+}
+
+// RunOnceResult is the outcome of a run_once task, shared with every host in
+// its scope. Done is closed once the host running it is finished.
+type RunOnceResult struct {
+	Host       string
+	Output     string
+	Registered bool
+	Err        error
+	Done       chan struct{}
 }
 
 var ExecOptions ExecutionOptions
@@ -38,19 +53,27 @@ type FactsConfig struct {
 
 // PlaybookConfig represents a standalone playbook file
 type PlaybookConfig struct {
-	Name     string      `yaml:"name"`
-	Parallel bool        `yaml:"parallel,omitempty"`
-	Facts    FactsConfig `yaml:"facts,omitempty"`
-	Tasks    []Task      `yaml:"tasks"`
+	Name            string            `yaml:"name"`
+	Parallel        bool              `yaml:"parallel,omitempty"`
+	StrictVars      *bool             `yaml:"strict_vars,omitempty"`
+	Environment     map[string]string `yaml:"environment,omitempty"`
+	Facts           FactsConfig       `yaml:"facts,omitempty"`
+	TaskConcurrency int               `yaml:"task_concurrency,omitempty"`
+	Tasks           []Task            `yaml:"tasks"`
 }
 
 type ExecutionOptions struct {
 	DryRun        bool
+	Check         bool
+	Diff          bool
 	Verbose       bool
 	Progress      bool
 	NoColor       bool
 	FullOutput    bool
+	NoStrictVars  bool
+	Deadline      time.Duration
 	InventoryFile string
+	SSHConfigFile string
 }
 
 type Inventory struct {
@@ -60,13 +83,51 @@ type Inventory struct {
 }
 
 type SSHConfig struct {
-	User               string `yaml:"user,omitempty"`
-	Password           string `yaml:"password,omitempty"`
-	KeyFile            string `yaml:"key_file,omitempty"`
-	KeyPassword        string `yaml:"key_password,omitempty"`
-	UseAgent           bool   `yaml:"use_agent,omitempty"`
-	Port               int    `yaml:"port,omitempty"`
-	StrictHostKeyCheck *bool  `yaml:"strict_host_key_check,omitempty"`
+	User               string     `yaml:"user,omitempty"`
+	Password           string     `yaml:"password,omitempty"`
+	KeyFile            string     `yaml:"key_file,omitempty"`
+	KeyPassword        string     `yaml:"key_password,omitempty"`
+	UseAgent           bool       `yaml:"use_agent,omitempty"`
+	Port               int        `yaml:"port,omitempty"`
+	StrictHostKeyCheck *bool      `yaml:"strict_host_key_check,omitempty"`
+	RemoteTmp          string     `yaml:"remote_tmp,omitempty"`
+	KeepaliveInterval  int        `yaml:"keepalive_interval,omitempty"`
+	KeepaliveCountMax  int        `yaml:"keepalive_count_max,omitempty"`
+	ConnectTimeout     int        `yaml:"connect_timeout,omitempty"`
+	ConnectRetries     int        `yaml:"connect_retries,omitempty"`
+	ConnectRetryDelay  int        `yaml:"connect_retry_delay,omitempty"`
+	UseSSHConfig       *bool      `yaml:"use_ssh_config,omitempty"`
+	KnownHostsFile     StringList `yaml:"known_hosts_file,omitempty"`
+	HostKeyPolicy      string     `yaml:"host_key_policy,omitempty"`
+}
+
+// Host key policies of host_key_policy
+const (
+	// HostKeyPolicyStrict only accepts the keys of the known_hosts files
+	HostKeyPolicyStrict = "strict"
+	// HostKeyPolicyAcceptNew adds the keys of unknown hosts to the first
+	// known_hosts file, and rejects changed keys
+	HostKeyPolicyAcceptNew = "accept-new"
+	// HostKeyPolicyOff accepts any key
+	HostKeyPolicyOff = "off"
+)
+
+// StringList is a list of strings that can be given as a single string
+type StringList []string
+
+// UnmarshalYAML accepts both a single string and a sequence
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
 }
 
 type Group struct {
@@ -88,21 +149,44 @@ type Host struct {
 	KeyPassword        string                 `yaml:"key_password,omitempty"`
 	UseAgent           bool                   `yaml:"use_agent,omitempty"`
 	StrictHostKeyCheck *bool                  `yaml:"strict_host_key_check,omitempty"`
+	RemoteTmp          string                 `yaml:"remote_tmp,omitempty"`
+	Timeout            int                    `yaml:"timeout,omitempty"`
+	KeepaliveInterval  int                    `yaml:"keepalive_interval,omitempty"`
+	KeepaliveCountMax  int                    `yaml:"keepalive_count_max,omitempty"`
+	ConnectTimeout     int                    `yaml:"connect_timeout,omitempty"`
+	ConnectRetries     int                    `yaml:"connect_retries,omitempty"`
+	ConnectRetryDelay  int                    `yaml:"connect_retry_delay,omitempty"`
+	UseSSHConfig       *bool                  `yaml:"use_ssh_config,omitempty"`
+	ProxyJump          string                 `yaml:"proxy_jump,omitempty"`
+	IdentitiesOnly     bool                   `yaml:"identities_only,omitempty"`
+	KnownHostsFile     StringList             `yaml:"known_hosts_file,omitempty"`
+	HostKeyPolicy      string                 `yaml:"host_key_policy,omitempty"`
+	HostKey            StringList             `yaml:"host_key,omitempty"`
 	Vars               map[string]interface{} `yaml:"vars,omitempty"`
+	// Jumps are the hosts ProxyJump connects through, in order
+	Jumps []Host `yaml:"-"`
 }
 
 type Playbook struct {
-	Name     string      `yaml:"name"`
-	Parallel bool        `yaml:"parallel,omitempty"`
-	Facts    FactsConfig `yaml:"facts,omitempty"`
-	Tasks    []Task      `yaml:"tasks"`
+	Name        string            `yaml:"name"`
+	Parallel    bool              `yaml:"parallel,omitempty"`
+	StrictVars  *bool             `yaml:"strict_vars,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Facts       FactsConfig       `yaml:"facts,omitempty"`
+	// TaskConcurrency runs the tasks of each host as a graph ordered by
+	// depends_on, up to this many at a time, when greater than 1
+	TaskConcurrency int    `yaml:"task_concurrency,omitempty"`
+	Tasks           []Task `yaml:"tasks"`
 }
 
 type Task struct {
 	Name             string                 `yaml:"name"`
 	Command          string                 `yaml:"command,omitempty"`
-	Script           string                 `yaml:"script,omitempty"`
+	Script           *ScriptTask            `yaml:"script,omitempty"`
 	Copy             *CopyTask              `yaml:"copy,omitempty"`
+	Template         *TemplateTask          `yaml:"template,omitempty"`
+	Sync             *SyncTask              `yaml:"sync,omitempty"`
+	Fetch            *FetchTask             `yaml:"fetch,omitempty"`
 	Shell            string                 `yaml:"shell,omitempty"`
 	Sudo             bool                   `yaml:"sudo,omitempty"`
 	When             string                 `yaml:"when,omitempty"`
@@ -115,24 +199,168 @@ type Task struct {
 	IgnoreError      bool                   `yaml:"ignore_error,omitempty"`
 	Vars             map[string]interface{} `yaml:"vars,omitempty"`
 	DependsOn        []string               `yaml:"depends_on,omitempty"`
-	WaitFor          string                 `yaml:"wait_for,omitempty"`
+	WaitFor          *WaitForTask           `yaml:"wait_for,omitempty"`
 	Retries          int                    `yaml:"retries,omitempty"`
 	RetryDelay       int                    `yaml:"retry_delay,omitempty"`
+	RetryBackoff     string                 `yaml:"retry_backoff,omitempty"`
+	RetryMaxDelay    int                    `yaml:"retry_max_delay,omitempty"`
+	RetryJitter      float64                `yaml:"retry_jitter,omitempty"`
 	Timeout          int                    `yaml:"timeout,omitempty"`
 	UntilSuccess     bool                   `yaml:"until_success,omitempty"`
 	AllowedExitCodes []int                  `yaml:"allowed_exit_codes,omitempty"`
+	Executable       string                 `yaml:"executable,omitempty"`
+	Pipefail         *bool                  `yaml:"pipefail,omitempty"`
+	Stdin            string                 `yaml:"stdin,omitempty"`
+	Environment      map[string]string      `yaml:"environment,omitempty"`
+	Chdir            string                 `yaml:"chdir,omitempty"`
+	Umask            string                 `yaml:"umask,omitempty"`
+	Async            int                    `yaml:"async,omitempty"`
+	Poll             *int                   `yaml:"poll,omitempty"`
+	AsyncStatus      *AsyncStatusTask       `yaml:"async_status,omitempty"`
+	Reboot           *RebootTask            `yaml:"reboot,omitempty"`
 }
 
 type CopyTask struct {
-	Src  string `yaml:"src"`
-	Dest string `yaml:"dest"`
-	Mode string `yaml:"mode,omitempty"`
+	Src      string `yaml:"src"`
+	Dest     string `yaml:"dest"`
+	Mode     string `yaml:"mode,omitempty"`
+	Owner    string `yaml:"owner,omitempty"`
+	Group    string `yaml:"group,omitempty"`
+	Backup   bool   `yaml:"backup,omitempty"`
+	Validate string `yaml:"validate,omitempty"`
 }
 
+// ScriptTask uploads a local script and runs it on the remote host. It can be
+// given as a plain path.
+type ScriptTask struct {
+	Path        string            `yaml:"path"`
+	Args        []string          `yaml:"args,omitempty"`
+	Interpreter string            `yaml:"interpreter,omitempty"`
+	Env         map[string]string `yaml:"env,omitempty"`
+	Chdir       string            `yaml:"chdir,omitempty"`
+	Template    bool              `yaml:"template,omitempty"`
+	Creates     string            `yaml:"creates,omitempty"`
+	Removes     string            `yaml:"removes,omitempty"`
+}
+
+// UnmarshalYAML accepts both `script: path` and the mapping form
+func (s *ScriptTask) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		s.Path = value.Value
+		return nil
+	}
+
+	type plain ScriptTask
+	return value.Decode((*plain)(s))
+}
+
+// AsyncStatusTask checks an async job started with poll: 0, by the job id
+// registered when it started. It can be given as a plain job id.
+type AsyncStatusTask struct {
+	Jid     string `yaml:"jid"`
+	Cleanup bool   `yaml:"cleanup,omitempty"`
+}
+
+// UnmarshalYAML accepts both `async_status: jid` and the mapping form
+func (a *AsyncStatusTask) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		a.Jid = value.Value
+		return nil
+	}
+
+	type plain AsyncStatusTask
+	return value.Decode((*plain)(a))
+}
+
+// RebootTask reboots the host and waits for it to come back with a new boot
+// id. It can be given as `reboot: true` to use the defaults.
+type RebootTask struct {
+	RebootTimeout   int    `yaml:"reboot_timeout,omitempty"`
+	PreRebootDelay  int    `yaml:"pre_reboot_delay,omitempty"`
+	PostRebootDelay int    `yaml:"post_reboot_delay,omitempty"`
+	TestCommand     string `yaml:"test_command,omitempty"`
+}
+
+// UnmarshalYAML accepts both `reboot: true` and the mapping form
+func (r *RebootTask) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var enabled bool
+		if err := value.Decode(&enabled); err != nil || !enabled {
+			return fmt.Errorf("line %d: reboot must be true or a mapping", value.Line)
+		}
+		return nil
+	}
+
+	type plain RebootTask
+	return value.Decode((*plain)(r))
+}
+
+// WaitForTask waits until a condition is met: a port, a file, a URL, a
+// process, a service or a command. It can be given as a plain "type:value"
+// condition.
+type WaitForTask struct {
+	Condition   string `yaml:"condition,omitempty"`
+	Port        int    `yaml:"port,omitempty"`
+	Host        string `yaml:"host,omitempty"`
+	Path        string `yaml:"path,omitempty"`
+	URL         string `yaml:"url,omitempty"`
+	Status      int    `yaml:"status,omitempty"`
+	Process     string `yaml:"process,omitempty"`
+	Service     string `yaml:"service,omitempty"`
+	Command     string `yaml:"command,omitempty"`
+	SearchRegex string `yaml:"search_regex,omitempty"`
+	State       string `yaml:"state,omitempty"`
+	From        string `yaml:"from,omitempty"`
+	Timeout     int    `yaml:"timeout,omitempty"`
+	Delay       int    `yaml:"delay,omitempty"`
+	Sleep       int    `yaml:"sleep,omitempty"`
+}
+
+// UnmarshalYAML accepts both `wait_for: type:value` and the mapping form
+func (w *WaitForTask) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		w.Condition = value.Value
+		return nil
+	}
+
+	type plain WaitForTask
+	return value.Decode((*plain)(w))
+}
+
+// TemplateTask renders a local Go template file and installs the result
+type TemplateTask struct {
+	Src      string   `yaml:"src"`
+	Dest     string   `yaml:"dest"`
+	Mode     string   `yaml:"mode,omitempty"`
+	Owner    string   `yaml:"owner,omitempty"`
+	Group    string   `yaml:"group,omitempty"`
+	Backup   bool     `yaml:"backup,omitempty"`
+	Validate string   `yaml:"validate,omitempty"`
+	Partials []string `yaml:"partials,omitempty"`
+}
+
+// SyncTask pushes a local directory tree to a remote path
+type SyncTask struct {
+	Src     string   `yaml:"src"`
+	Dest    string   `yaml:"dest"`
+	Compare string   `yaml:"compare,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+	Delete  bool     `yaml:"delete,omitempty"`
+}
+
+// FetchTask pulls files from the remote host. Src can be a file, a directory
+// or a glob pattern.
+type FetchTask struct {
+	Src           string `yaml:"src"`
+	Dest          string `yaml:"dest"`
+	Flat          bool   `yaml:"flat,omitempty"`
+	FailOnMissing *bool  `yaml:"fail_on_missing,omitempty"`
+}
 
 type HostResult struct {
-	Host    Host
-	Success bool
-	Error   error
-	Output  string
+	Host        Host
+	Success     bool
+	Error       error
+	Output      string
+	Interrupted bool
 }
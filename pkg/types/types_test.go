@@ -1,7 +1,10 @@
 package types
 
 import (
+	"reflect"
 	"testing"
+
+	"gopkg.in/yaml.v3"
 )
 
 func TestConfig_Structure(t *testing.T) {
@@ -270,3 +273,159 @@ func TestInventory_Structure(t *testing.T) {
 		t.Errorf("SSHConfig.User = %q, want 'admin'", inventory.SSHConfig.User)
 	}
 }
+
+func TestScriptTask_UnmarshalYAML(t *testing.T) {
+	var tasks []Task
+	data := `
+- name: short form
+  script: ./setup.sh
+- name: long form
+  script:
+    path: ./migrate.py
+    interpreter: python3
+    args: ["--env", "prod"]
+    env:
+      APP_ENV: prod
+    chdir: /srv/app
+    template: true
+    creates: /srv/app/.migrated
+`
+	if err := yaml.Unmarshal([]byte(data), &tasks); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if tasks[0].Script == nil || tasks[0].Script.Path != "./setup.sh" {
+		t.Errorf("short form script = %+v, want path ./setup.sh", tasks[0].Script)
+	}
+	if tasks[0].Script.Template {
+		t.Error("scripts should not be templated by default")
+	}
+
+	script := tasks[1].Script
+	if script == nil {
+		t.Fatal("long form script should be parsed")
+	}
+	if script.Path != "./migrate.py" || script.Interpreter != "python3" || script.Chdir != "/srv/app" {
+		t.Errorf("long form script = %+v", script)
+	}
+	if len(script.Args) != 2 || script.Args[1] != "prod" {
+		t.Errorf("Args = %v, want [--env prod]", script.Args)
+	}
+	if script.Env["APP_ENV"] != "prod" || !script.Template || script.Creates != "/srv/app/.migrated" {
+		t.Errorf("long form script = %+v", script)
+	}
+}
+
+func TestWaitForTask_UnmarshalYAML(t *testing.T) {
+	var tasks []Task
+	data := `
+- name: short form
+  wait_for: port:8080
+- name: long form
+  wait_for:
+    condition: http:http://localhost/health
+    timeout: 300
+    delay: 10
+    sleep: 5
+`
+	if err := yaml.Unmarshal([]byte(data), &tasks); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if tasks[0].WaitFor == nil || tasks[0].WaitFor.Condition != "port:8080" {
+		t.Errorf("short form wait_for = %+v, want condition port:8080", tasks[0].WaitFor)
+	}
+
+	expected := WaitForTask{Condition: "http:http://localhost/health", Timeout: 300, Delay: 10, Sleep: 5}
+	if tasks[1].WaitFor == nil || *tasks[1].WaitFor != expected {
+		t.Errorf("long form wait_for = %+v, want %+v", tasks[1].WaitFor, expected)
+	}
+}
+
+func TestAsyncStatusTask_UnmarshalYAML(t *testing.T) {
+	var tasks []Task
+	data := `
+- name: start
+  shell: ./backup.sh
+  async: 3600
+  poll: 0
+  register: backup_job
+- name: short form
+  async_status: "{{ .backup_job }}"
+- name: long form
+  async_status:
+    jid: "{{ .backup_job }}"
+    cleanup: true
+`
+	if err := yaml.Unmarshal([]byte(data), &tasks); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if tasks[0].Async != 3600 || tasks[0].Poll == nil || *tasks[0].Poll != 0 {
+		t.Errorf("async = %d, poll = %v, want 3600 and 0", tasks[0].Async, tasks[0].Poll)
+	}
+
+	if tasks[1].AsyncStatus == nil || tasks[1].AsyncStatus.Jid != "{{ .backup_job }}" {
+		t.Errorf("short form async_status = %+v, want jid {{ .backup_job }}", tasks[1].AsyncStatus)
+	}
+
+	expected := AsyncStatusTask{Jid: "{{ .backup_job }}", Cleanup: true}
+	if tasks[2].AsyncStatus == nil || *tasks[2].AsyncStatus != expected {
+		t.Errorf("long form async_status = %+v, want %+v", tasks[2].AsyncStatus, expected)
+	}
+}
+
+func TestRebootTask_UnmarshalYAML(t *testing.T) {
+	var tasks []Task
+	data := `
+- name: short form
+  reboot: true
+- name: long form
+  reboot:
+    reboot_timeout: 900
+    pre_reboot_delay: 5
+    post_reboot_delay: 30
+    test_command: systemctl is-system-running
+`
+	if err := yaml.Unmarshal([]byte(data), &tasks); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if tasks[0].Reboot == nil || *tasks[0].Reboot != (RebootTask{}) {
+		t.Errorf("short form reboot = %+v, want defaults", tasks[0].Reboot)
+	}
+
+	expected := RebootTask{RebootTimeout: 900, PreRebootDelay: 5, PostRebootDelay: 30, TestCommand: "systemctl is-system-running"}
+	if tasks[1].Reboot == nil || *tasks[1].Reboot != expected {
+		t.Errorf("long form reboot = %+v, want %+v", tasks[1].Reboot, expected)
+	}
+
+	if err := yaml.Unmarshal([]byte("- name: disabled\n  reboot: false\n"), &tasks); err == nil {
+		t.Error("Unmarshal() accepted reboot: false")
+	}
+}
+
+func TestStringList_UnmarshalYAML(t *testing.T) {
+	var host Host
+	data := `
+name: web1
+known_hosts_file: ~/.ssh/known_hosts
+host_key:
+  - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGVH
+  - ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTY=
+`
+	if err := yaml.Unmarshal([]byte(data), &host); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	if want := (StringList{"~/.ssh/known_hosts"}); !reflect.DeepEqual(host.KnownHostsFile, want) {
+		t.Errorf("known_hosts_file = %v, want %v", host.KnownHostsFile, want)
+	}
+	if len(host.HostKey) != 2 || host.HostKey[0] != "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGVH" {
+		t.Errorf("host_key = %v, want 2 keys", host.HostKey)
+	}
+
+	if err := yaml.Unmarshal([]byte("host_key: {type: ed25519}\n"), &host); err == nil {
+		t.Error("Unmarshal() accepted a mapping host_key")
+	}
+}
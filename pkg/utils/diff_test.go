@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      string
+		new      string
+		expected string
+	}{
+		{
+			name:     "identical",
+			old:      "a\nb\n",
+			new:      "a\nb\n",
+			expected: "",
+		},
+		{
+			name: "single change",
+			old:  "a\nb\nc\n",
+			new:  "a\nB\nc\n",
+			expected: `--- old
++++ new
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`,
+		},
+		{
+			name: "new file",
+			old:  "",
+			new:  "line1\nline2\n",
+			expected: `--- old
++++ new
+@@ -0,0 +1,2 @@
++line1
++line2
+`,
+		},
+		{
+			name: "separate hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			expected: `--- old
++++ new
+@@ -1,4 +1,4 @@
+-1
++one
+ 2
+ 3
+ 4
+@@ -9,4 +9,4 @@
+ 9
+ 10
+ 11
+-12
++twelve
+`,
+		},
+		{
+			name: "append",
+			old:  "a\nb\n",
+			new:  "a\nb\nc\n",
+			expected: `--- old
++++ new
+@@ -1,2 +1,3 @@
+ a
+ b
++c
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := UnifiedDiff("old", "new", tt.old, tt.new)
+			if result != tt.expected {
+				t.Errorf("UnifiedDiff() =\n%s\nwant:\n%s", result, tt.expected)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/fgouteroux/sshot/pkg/types"
@@ -42,3 +43,102 @@ func FormatDuration(d time.Duration) string {
 	}
 	return fmt.Sprintf("%ds", s)
 }
+
+// ShellQuote quotes a string so that a POSIX shell treats it as a single word
+func ShellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+// SplitArgs splits a command line into words like a POSIX shell, without any
+// expansion. Single and double quotes group words and backslashes escape the
+// next character. Template actions ({{ ... }}) are kept intact so variables
+// can be rendered into a single word after splitting.
+func SplitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		if escaped {
+			word.WriteRune(r)
+			escaped = false
+			continue
+		}
+
+		if r == '{' && i+1 < len(runes) && runes[i+1] == '{' {
+			end := strings.Index(string(runes[i:]), "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated template action in %q", s)
+			}
+			action := []rune(string(runes[i:])[:end+2])
+			word.WriteString(string(action))
+			inWord = true
+			i += len(action) - 1
+			continue
+		}
+
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]):
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
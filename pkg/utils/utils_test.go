@@ -2,6 +2,7 @@ package utils
 
 import (
 	"github.com/fgouteroux/sshot/pkg/types"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -80,3 +81,63 @@ func TestFormatDuration(t *testing.T) {
 		})
 	}
 }
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", "''"},
+		{"simple", "simple"},
+		{"/var/log/app.log", "/var/log/app.log"},
+		{"with space", "'with space'"},
+		{"it's", `'it'"'"'s'`},
+		{"$(rm -rf /)", "'$(rm -rf /)'"},
+		{"a;b", "'a;b'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := ShellQuote(tt.input)
+			if result != tt.expected {
+				t.Errorf("ShellQuote(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		wantErr  bool
+	}{
+		{input: "echo hello world", expected: []string{"echo", "hello", "world"}},
+		{input: "  spaced\targs  ", expected: []string{"spaced", "args"}},
+		{input: `echo 'single quoted' "double quoted"`, expected: []string{"echo", "single quoted", "double quoted"}},
+		{input: `echo "say \"hi\"" it\'s`, expected: []string{"echo", `say "hi"`, "it's"}},
+		{input: `echo ''`, expected: []string{"echo", ""}},
+		{input: `echo a"b c"d`, expected: []string{"echo", "ab cd"}},
+		{input: `echo "$HOME" | wc`, expected: []string{"echo", "$HOME", "|", "wc"}},
+		{input: `deploy {{ .app_name }} --port {{ index . "app_port" | default "8080" }}`, expected: []string{"deploy", "{{ .app_name }}", "--port", `{{ index . "app_port" | default "8080" }}`}},
+		{input: `echo "Hello {{ .name }}!"`, expected: []string{"echo", "Hello {{ .name }}!"}},
+		{input: `echo 'unterminated`, wantErr: true},
+		{input: `echo {{ .broken`, wantErr: true},
+		{input: `echo trailing\`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := SplitArgs(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SplitArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("SplitArgs(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
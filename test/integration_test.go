@@ -549,7 +549,7 @@ playbook:
   name: Progress Indicator Test
   tasks:
     - name: Long Running Task
-      command: sleep 5 && echo done
+      shell: sleep 5 && echo done
       timeout: 10
 `
 